@@ -0,0 +1,325 @@
+package webcam
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+)
+
+// Algorithm used to reconstruct full color images from Bayer raw frames
+type DemosaicMethod int
+
+const (
+	// Averages the nearest samples of each missing color. Fast, but blurs
+	// edges and produces color fringes along them
+	DemosaicBilinear DemosaicMethod = iota
+	// Interpolates green along edges rather than across them, chosen by
+	// the local gradients, then interpolates red and blue differences
+	// to green. Slower, but keeps edges sharp and mostly free of fringes
+	DemosaicEdgeAware
+)
+
+// Colors of samples of a Bayer pattern
+const (
+	bayerRed = iota
+	bayerGreen
+	bayerBlue
+)
+
+// Bayer raw format, pattern holds colors of the top left 2x2 block
+// in the order (0,0), (1,0), (0,1), (1,1)
+type bayerFormat struct {
+	pattern [4]int
+	bits    uint
+	packing rawPacking
+}
+
+var (
+	bayerBGGR = [4]int{bayerBlue, bayerGreen, bayerGreen, bayerRed}
+	bayerGBRG = [4]int{bayerGreen, bayerBlue, bayerRed, bayerGreen}
+	bayerGRBG = [4]int{bayerGreen, bayerRed, bayerBlue, bayerGreen}
+	bayerRGGB = [4]int{bayerRed, bayerGreen, bayerGreen, bayerBlue}
+)
+
+var bayerFormats = map[string]bayerFormat{
+	"BA81": {bayerBGGR, 8, raw8},
+	"GBRG": {bayerGBRG, 8, raw8},
+	"GRBG": {bayerGRBG, 8, raw8},
+	"RGGB": {bayerRGGB, 8, raw8},
+	"BG10": {bayerBGGR, 10, rawUnpacked16},
+	"GB10": {bayerGBRG, 10, rawUnpacked16},
+	"BA10": {bayerGRBG, 10, rawUnpacked16},
+	"RG10": {bayerRGGB, 10, rawUnpacked16},
+	"pBAA": {bayerBGGR, 10, rawMIPI10},
+	"pGAA": {bayerGBRG, 10, rawMIPI10},
+	"pgAA": {bayerGRBG, 10, rawMIPI10},
+	"pRAA": {bayerRGGB, 10, rawMIPI10},
+	"BG12": {bayerBGGR, 12, rawUnpacked16},
+	"GB12": {bayerGBRG, 12, rawUnpacked16},
+	"BA12": {bayerGRBG, 12, rawUnpacked16},
+	"RG12": {bayerRGGB, 12, rawUnpacked16},
+	"pBCC": {bayerBGGR, 12, rawMIPI12},
+	"pGCC": {bayerGBRG, 12, rawMIPI12},
+	"pgCC": {bayerGRBG, 12, rawMIPI12},
+	"pRCC": {bayerRGGB, 12, rawMIPI12},
+	"BYR2": {bayerBGGR, 16, rawUnpacked16},
+	"GB16": {bayerGBRG, 16, rawUnpacked16},
+	"GR16": {bayerGRBG, 16, rawUnpacked16},
+	"RG16": {bayerRGGB, 16, rawUnpacked16},
+}
+
+// Returns a decoder of Bayer raw formats using the given demosaic method.
+// 8-bit formats are decoded to *image.RGBA, deeper ones to *image.RGBA64.
+// Bayer formats are registered with DemosaicBilinear, the method is
+// changed by registering them again with another decoder
+func BayerDecoder(method DemosaicMethod) Decoder {
+	return func(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout) (image.Image, error) {
+		return decodeBayer(frame, format, width, height, layout, method)
+	}
+}
+
+func decodeBayer(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout, method DemosaicMethod) (image.Image, error) {
+	f, ok := bayerFormats[DecodeFormat(format)]
+	if !ok {
+		return nil, fmt.Errorf("format %v is not a Bayer format: %w", DecodeFormat(format), ErrUnsupportedFormat)
+	}
+
+	samples, err := readRawSamples(frame, layout, 0, int(width), int(height), f.packing, f.bits)
+	if err != nil {
+		return nil, err
+	}
+
+	b := newBayerImage(samples, int(width), int(height), f.pattern)
+	maxValue := int32(1)<<f.bits - 1
+	var r, g, bl []int32
+	if method == DemosaicEdgeAware {
+		r, g, bl = b.edgeAware(maxValue)
+	} else {
+		r, g, bl = b.bilinear()
+	}
+
+	rect := image.Rect(0, 0, int(width), int(height))
+	if f.bits == 8 {
+		img := image.NewRGBA(rect)
+		for i := range r {
+			img.Pix[4*i] = uint8(r[i])
+			img.Pix[4*i+1] = uint8(g[i])
+			img.Pix[4*i+2] = uint8(bl[i])
+			img.Pix[4*i+3] = 0xff
+		}
+		return img, nil
+	}
+
+	img := image.NewRGBA64(rect)
+	for i := range r {
+		// Pixels of RGBA64 are stored big endian
+		pix := img.Pix[8*i : 8*i+8]
+		binary.BigEndian.PutUint16(pix[0:], scaleSample(r[i], f.bits))
+		binary.BigEndian.PutUint16(pix[2:], scaleSample(g[i], f.bits))
+		binary.BigEndian.PutUint16(pix[4:], scaleSample(bl[i], f.bits))
+		binary.BigEndian.PutUint16(pix[6:], 0xffff)
+	}
+	return img, nil
+}
+
+// Describes the pattern of a Bayer format, e.g. BGGR
+func (f bayerFormat) patternName() string {
+	name := ""
+	for _, c := range f.pattern {
+		name += string("RGB"[c])
+	}
+	return name
+}
+
+// Scales a sample of the given bit depth to 16 bits
+func scaleSample(v int32, bits uint) uint16 {
+	return uint16(uint32(v) * 0xffff / (1<<bits - 1))
+}
+
+// Bayer samples surrounded by a border of mirrored samples,
+// so that neighbours of edge samples can be read without bounds checks
+type bayerImage struct {
+	samples []int32
+	width   int
+	height  int
+	stride  int
+	pattern [4]int
+}
+
+// Width of the mirrored border, enough for the farthest
+// neighbour read by the demosaic methods
+const bayerBorder = 2
+
+func newBayerImage(samples []uint16, width int, height int, pattern [4]int) *bayerImage {
+	b := &bayerImage{
+		width:   width,
+		height:  height,
+		stride:  width + 2*bayerBorder,
+		pattern: pattern,
+	}
+	b.samples = make([]int32, b.stride*(height+2*bayerBorder))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			b.samples[b.index(x, y)] = int32(samples[y*width+x])
+		}
+	}
+	b.mirrorBorder(b.samples)
+	return b
+}
+
+// Index of sample (x, y) in a bordered plane
+func (b *bayerImage) index(x int, y int) int {
+	return (y+bayerBorder)*b.stride + x + bayerBorder
+}
+
+// Color of the sample at (x, y)
+func (b *bayerImage) color(x int, y int) int {
+	return b.pattern[(y&1)*2+(x&1)]
+}
+
+// Fills the border of a plane by mirroring samples at the edges.
+// Mirroring keeps the parity of coordinates, so border samples
+// have the color the pattern expects at their position
+func (b *bayerImage) mirrorBorder(plane []int32) {
+	for y := -bayerBorder; y < b.height+bayerBorder; y++ {
+		for x := -bayerBorder; x < b.width+bayerBorder; x++ {
+			if x >= 0 && x < b.width && y >= 0 && y < b.height {
+				continue
+			}
+			plane[b.index(x, y)] = plane[b.index(mirror(x, b.width), mirror(y, b.height))]
+		}
+	}
+}
+
+// Reflects a coordinate outside of [0, n) back into it
+func mirror(i int, n int) int {
+	if i < 0 {
+		i = -i
+	}
+	if i >= n {
+		i = 2*(n-1) - i
+	}
+	if i < 0 {
+		i = 0
+	}
+	if i >= n {
+		i = n - 1
+	}
+	return i
+}
+
+func (b *bayerImage) bilinear() (r []int32, g []int32, bl []int32) {
+	planes := [3][]int32{}
+	for c := range planes {
+		planes[c] = make([]int32, b.width*b.height)
+	}
+
+	s := b.samples
+	for y := 0; y < b.height; y++ {
+		for x := 0; x < b.width; x++ {
+			i := b.index(x, y)
+			o := y*b.width + x
+			c := b.color(x, y)
+			planes[c][o] = s[i]
+
+			horizontal := (s[i-1] + s[i+1] + 1) / 2
+			vertical := (s[i-b.stride] + s[i+b.stride] + 1) / 2
+			if c == bayerGreen {
+				// Red and blue are on the row and column, in the order the pattern says
+				planes[b.color(x+1, y)][o] = horizontal
+				planes[b.color(x, y+1)][o] = vertical
+				continue
+			}
+
+			diagonal := (s[i-b.stride-1] + s[i-b.stride+1] + s[i+b.stride-1] + s[i+b.stride+1] + 2) / 4
+			planes[bayerGreen][o] = (horizontal + vertical + 1) / 2
+			planes[bayerRed+bayerBlue-c][o] = diagonal
+		}
+	}
+	return planes[bayerRed], planes[bayerGreen], planes[bayerBlue]
+}
+
+// Hamilton-Adams interpolation of green followed by bilinear
+// interpolation of color differences
+func (b *bayerImage) edgeAware(maxValue int32) (r []int32, g []int32, bl []int32) {
+	s := b.samples
+	green := make([]int32, len(s))
+
+	for y := 0; y < b.height; y++ {
+		for x := 0; x < b.width; x++ {
+			i := b.index(x, y)
+			if b.color(x, y) == bayerGreen {
+				green[i] = s[i]
+				continue
+			}
+
+			// Second derivative of the sample's own color corrects the average of greens
+			h2 := 2*s[i] - s[i-2] - s[i+2]
+			v2 := 2*s[i] - s[i-2*b.stride] - s[i+2*b.stride]
+			gh := 2*(s[i-1]+s[i+1]) + h2
+			gv := 2*(s[i-b.stride]+s[i+b.stride]) + v2
+			dh := abs32(s[i-1]-s[i+1]) + abs32(h2)
+			dv := abs32(s[i-b.stride]-s[i+b.stride]) + abs32(v2)
+
+			switch {
+			case dh < dv:
+				green[i] = clamp32(gh/4, maxValue)
+			case dv < dh:
+				green[i] = clamp32(gv/4, maxValue)
+			default:
+				green[i] = clamp32((gh+gv)/8, maxValue)
+			}
+		}
+	}
+	b.mirrorBorder(green)
+
+	planes := [3][]int32{}
+	for c := range planes {
+		planes[c] = make([]int32, b.width*b.height)
+	}
+
+	// Differences of red and blue to green vary slower than the colors
+	// themselves, so they are interpolated instead
+	diff := func(i int) int32 {
+		return s[i] - green[i]
+	}
+
+	for y := 0; y < b.height; y++ {
+		for x := 0; x < b.width; x++ {
+			i := b.index(x, y)
+			o := y*b.width + x
+			c := b.color(x, y)
+			planes[c][o] = s[i]
+			planes[bayerGreen][o] = green[i]
+
+			if c == bayerGreen {
+				horizontal := green[i] + (diff(i-1)+diff(i+1))/2
+				vertical := green[i] + (diff(i-b.stride)+diff(i+b.stride))/2
+				planes[b.color(x+1, y)][o] = clamp32(horizontal, maxValue)
+				planes[b.color(x, y+1)][o] = clamp32(vertical, maxValue)
+				continue
+			}
+
+			diagonal := green[i] + (diff(i-b.stride-1)+diff(i-b.stride+1)+diff(i+b.stride-1)+diff(i+b.stride+1))/4
+			planes[bayerRed+bayerBlue-c][o] = clamp32(diagonal, maxValue)
+		}
+	}
+	return planes[bayerRed], planes[bayerGreen], planes[bayerBlue]
+}
+
+func abs32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func clamp32(v int32, maxValue int32) int32 {
+	if v < 0 {
+		return 0
+	}
+	if v > maxValue {
+		return maxValue
+	}
+	return v
+}
@@ -0,0 +1,141 @@
+package webcam
+
+import (
+	"errors"
+	"image"
+	"testing"
+)
+
+// Builds a Bayer frame of a scene of uniform color, pattern names colors
+// of the top left 2x2 block. Deeper samples are stored as unpacked 16 bits
+func bayerTestFrame(pattern string, width int, height int, bits uint, r uint16, g uint16, b uint16) []byte {
+	values := map[byte]uint16{'R': r, 'G': g, 'B': b}
+	var frame []byte
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := values[pattern[(y%2)*2+x%2]]
+			if bits == 8 {
+				frame = append(frame, byte(v))
+			} else {
+				frame = append(frame, byte(v), byte(v>>8))
+			}
+		}
+	}
+	return frame
+}
+
+// Returns 16-bit red, green and blue of a pixel
+func bayerTestPixel(img image.Image, x int, y int) [3]uint32 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return [3]uint32{r, g, b}
+}
+
+func TestBayerPatterns(t *testing.T) {
+	tests := []struct {
+		format  string
+		pattern string
+		bits    uint
+	}{
+		{"BA81", "BGGR", 8},
+		{"GBRG", "GBRG", 8},
+		{"GRBG", "GRBG", 8},
+		{"RGGB", "RGGB", 8},
+		{"RG10", "RGGB", 10},
+		{"BYR2", "BGGR", 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			// Red, green and blue at 3/4, 1/2 and 1/4 of the full scale
+			full := uint16(1)<<tt.bits - 1
+			r, g, b := full/4*3, full/2, full/4
+			frame := bayerTestFrame(tt.pattern, 6, 4, tt.bits, r, g, b)
+
+			for _, method := range []DemosaicMethod{DemosaicBilinear, DemosaicEdgeAware} {
+				img, err := BayerDecoder(method)(frame, EncodeFormat(tt.format), 6, 4, PackedLayout(tt.format, 6, 4))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := img.(*image.RGBA); ok != (tt.bits == 8) {
+					t.Errorf("%d-bit format decodes to %T", tt.bits, img)
+				}
+
+				want := [3]uint32{}
+				for c, v := range []uint16{r, g, b} {
+					want[c] = uint32(scaleSample(int32(v), tt.bits))
+				}
+				for y := 0; y < 4; y++ {
+					for x := 0; x < 6; x++ {
+						if got := bayerTestPixel(img, x, y); got != want {
+							t.Errorf("method %d: pixel (%d, %d) is %v, want %v", method, x, y, got, want)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBayerPacked(t *testing.T) {
+	// RGGB 4x2 in MIPI 10-bit packing, red 0x3ff, greens 0x200 and blue 0x000
+	frame := []byte{
+		0xff, 0x80, 0xff, 0x80, 0x33,
+		0x80, 0x00, 0x80, 0x00, 0x00,
+	}
+	img, err := Decode(frame, EncodeFormat("pRAA"), 4, 2, PackedLayout("pRAA", 4, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bayerTestPixel(img, 0, 0); got[0] != 0xffff || got[2] != 0 {
+		t.Errorf("red sample decodes to %v, want full red and no blue", got)
+	}
+
+	if _, err = Decode(frame[:9], EncodeFormat("pRAA"), 4, 2, PackedLayout("pRAA", 4, 2)); !errors.Is(err, ErrShortFrame) {
+		t.Errorf("Decode of a short frame = %v, want ErrShortFrame", err)
+	}
+	if _, err = BayerDecoder(DemosaicBilinear)(frame, EncodeFormat("YUYV"), 4, 2, PackedLayout("YUYV", 4, 2)); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Bayer decoding of YUYV = %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+// Edge-aware demosaicing keeps a sharp vertical edge between a dark and
+// a bright grey area intact, where bilinear demosaicing smears it
+func TestDemosaicEdgeAware(t *testing.T) {
+	const width, height, edge = 8, 6, 4
+	frame := make([]byte, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			frame[y*width+x] = 20
+			if x >= edge {
+				frame[y*width+x] = 220
+			}
+		}
+	}
+	code := EncodeFormat("RGGB")
+	layout := PackedLayout("RGGB", width, height)
+
+	img, err := BayerDecoder(DemosaicEdgeAware)(frame, code, width, height, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			want := uint8(20)
+			if x >= edge {
+				want = 220
+			}
+			c := img.(*image.RGBA).RGBAAt(x, y)
+			if c.R != want || c.G != want || c.B != want {
+				t.Errorf("pixel (%d, %d) is %v, want grey %d", x, y, c, want)
+			}
+		}
+	}
+
+	img, err = BayerDecoder(DemosaicBilinear)(frame, code, width, height, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := img.(*image.RGBA).RGBAAt(edge-1, 1); c.G == 20 {
+		t.Error("bilinear demosaicing keeps the edge sharp, the test does not tell the methods apart")
+	}
+}
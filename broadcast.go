@@ -0,0 +1,342 @@
+package webcam
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What a subscription does with a new frame when its queue is full
+type BackpressurePolicy int
+
+const (
+	// Drop the oldest queued frame to make room for the new one
+	DropOldest BackpressurePolicy = iota
+	// Drop the new frame
+	DropNewest
+	// Wait until the subscriber takes a frame. Note, that this holds up
+	// delivery to every other subscriber as well
+	Block
+)
+
+// Fans frames of a single Camera out to several subscribers.
+// A driver buffer is returned to the driver only after every subscriber
+// that received the frame has released it
+type Broadcaster struct {
+	cam *Camera
+
+	mutex       sync.Mutex
+	subscribers map[*Subscription]struct{}
+	refs        map[uint32]int
+	started     bool
+	finished    bool
+}
+
+// Subscriber of a Broadcaster
+type Subscription struct {
+	// Accessed atomically, first field to keep it 64-bit aligned on 32-bit platforms
+	dropped uint64
+
+	b      *Broadcaster
+	policy BackpressurePolicy
+	frames chan *SharedFrame
+	done   chan struct{}
+	once   sync.Once
+
+	// Guards sending on frames against closing it
+	mutex sync.RWMutex
+	ended bool
+}
+
+// Frame shared between subscribers of a Broadcaster.
+// Every subscriber must call Release once it is done with the frame.
+// The underlying Frame is not exposed, as releasing it directly would
+// return the buffer to the driver while other subscribers still read it
+type SharedFrame struct {
+	frame *Frame
+	b     *Broadcaster
+	// Accessed atomically, set once the subscriber released the frame
+	released int32
+}
+
+// Create a broadcaster for a camera. Streaming must be started
+// with StartStreaming before calling Run
+func NewBroadcaster(cam *Camera) *Broadcaster {
+	b := new(Broadcaster)
+	b.cam = cam
+	b.subscribers = make(map[*Subscription]struct{})
+	b.refs = make(map[uint32]int)
+	return b
+}
+
+// Add a subscriber that queues up to size frames and applies
+// policy when the queue is full
+func (b *Broadcaster) Subscribe(policy BackpressurePolicy, size int) (*Subscription, error) {
+	if size < 1 && policy != Block {
+		return nil, errors.New("Queue size must be positive")
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.finished {
+		return nil, errors.New("Broadcaster is finished")
+	}
+
+	s := &Subscription{
+		b:      b,
+		policy: policy,
+		frames: make(chan *SharedFrame, size),
+		done:   make(chan struct{}),
+	}
+	b.subscribers[s] = struct{}{}
+	return s, nil
+}
+
+// Dequeue frames from the camera and deliver them to subscribers until
+// ctx is cancelled or the device fails. Frame channels of all subscriptions
+// are closed when Run returns. Run may only be called once
+func (b *Broadcaster) Run(ctx context.Context) error {
+	b.mutex.Lock()
+	if b.started {
+		b.mutex.Unlock()
+		return errors.New("Broadcaster is already running")
+	}
+	b.started = true
+	b.mutex.Unlock()
+
+	err := b.cam.stream(ctx, func(frame *Frame) bool {
+		b.deliver(ctx, frame)
+		return true
+	})
+
+	b.mutex.Lock()
+	b.finished = true
+	subscribers := b.subscribers
+	b.subscribers = make(map[*Subscription]struct{})
+	b.mutex.Unlock()
+
+	for s := range subscribers {
+		s.end(false)
+	}
+
+	return err
+}
+
+func (b *Broadcaster) deliver(ctx context.Context, frame *Frame) {
+	b.mutex.Lock()
+	subscribers := make([]*Subscription, 0, len(b.subscribers))
+	for s := range b.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	if len(subscribers) > 0 {
+		b.refs[frame.Index] = len(subscribers)
+	}
+	b.mutex.Unlock()
+
+	if len(subscribers) == 0 {
+		frame.Release()
+		return
+	}
+
+	for _, s := range subscribers {
+		s.offer(ctx, &SharedFrame{frame: frame, b: b})
+	}
+}
+
+// Drop a reference to the frame, the last one returns the buffer to the driver
+func (b *Broadcaster) release(frame *Frame) error {
+	b.mutex.Lock()
+	b.refs[frame.Index]--
+	last := b.refs[frame.Index] <= 0
+	if last {
+		delete(b.refs, frame.Index)
+	}
+	b.mutex.Unlock()
+
+	if last {
+		return frame.Release()
+	}
+	return nil
+}
+
+// Returns channel delivering frames of the subscription
+// Channel is closed when the broadcaster stops or the subscription is closed
+func (s *Subscription) Frames() <-chan *SharedFrame {
+	return s.frames
+}
+
+// Returns number of frames dropped because the subscriber was too slow
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe and release all frames still queued for the subscriber
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.done)
+
+		s.b.mutex.Lock()
+		delete(s.b.subscribers, s)
+		s.b.mutex.Unlock()
+
+		s.end(true)
+	})
+}
+
+// Close frame channel, optionally releasing frames still queued
+func (s *Subscription) end(drain bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ended {
+		return
+	}
+	s.ended = true
+
+	for drain {
+		select {
+		case f := <-s.frames:
+			f.Release()
+		default:
+			drain = false
+		}
+	}
+	close(s.frames)
+}
+
+func (s *Subscription) offer(ctx context.Context, f *SharedFrame) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.ended {
+		f.Release()
+		return
+	}
+
+	switch s.policy {
+	case Block:
+		select {
+		case s.frames <- f:
+		case <-s.done:
+			f.Release()
+		case <-ctx.Done():
+			f.Release()
+		}
+
+	case DropNewest:
+		select {
+		case s.frames <- f:
+		case <-s.done:
+			f.Release()
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			f.Release()
+		}
+
+	default:
+		for sent := false; !sent; {
+			select {
+			case s.frames <- f:
+				sent = true
+				continue
+			case <-s.done:
+				f.Release()
+				return
+			default:
+			}
+
+			select {
+			case old := <-s.frames:
+				atomic.AddUint64(&s.dropped, 1)
+				old.Release()
+			default:
+			}
+		}
+	}
+}
+
+// Returns frame data, see Frame.Bytes
+func (f *SharedFrame) Bytes() []byte {
+	f.checkAccess()
+	return f.frame.Bytes()
+}
+
+// Returns frame data split into planes, see Frame.Planes
+func (f *SharedFrame) Planes() [][]byte {
+	f.checkAccess()
+	return f.frame.Planes()
+}
+
+// Returns sequence number of the frame, gaps indicate dropped frames
+func (f *SharedFrame) Sequence() uint32 {
+	return f.frame.Sequence
+}
+
+// Returns time the frame was captured, on the clock given by TimestampType
+func (f *SharedFrame) Timestamp() time.Duration {
+	return f.frame.Timestamp
+}
+
+// Returns the clock of the timestamp, see Frame.TimestampType
+func (f *SharedFrame) TimestampType() uint32 {
+	return f.frame.TimestampType()
+}
+
+// Returns buffer flags, see V4L2_BUF_FLAG_* constants
+func (f *SharedFrame) Flags() uint32 {
+	return f.frame.Flags
+}
+
+// Returns field order of the frame, see V4L2_FIELD_* constants
+func (f *SharedFrame) Field() uint32 {
+	return f.frame.Field
+}
+
+// Returns SMPTE timecode, nil if the driver did not provide one
+func (f *SharedFrame) Timecode() *Timecode {
+	if f.frame.Timecode == nil {
+		return nil
+	}
+	timecode := *f.frame.Timecode
+	return &timecode
+}
+
+// Returns true if the driver flagged the frame data as possibly corrupted
+func (f *SharedFrame) HasError() bool {
+	return f.frame.HasError()
+}
+
+// Returns a copy of the frame that stays valid after the frame is released
+func (f *SharedFrame) Clone() (*Frame, error) {
+	if f.Released() {
+		return nil, ErrFrameReleased
+	}
+	return f.frame.Clone()
+}
+
+// Returns true once the subscriber has released the frame
+func (f *SharedFrame) Released() bool {
+	return atomic.LoadInt32(&f.released) != 0
+}
+
+// Return the frame, buffer goes back to the driver once every
+// subscriber has released it. Returns the error of requeueing the
+// buffer, or ErrFrameReleased if the subscriber released the frame before
+func (f *SharedFrame) Release() error {
+	if !atomic.CompareAndSwapInt32(&f.released, 0, 1) {
+		return ErrFrameReleased
+	}
+	return f.b.release(f.frame)
+}
+
+func (f *SharedFrame) checkAccess() {
+	if debugFrames && f.Released() {
+		panic("webcam: frame accessed after release")
+	}
+}
@@ -0,0 +1,256 @@
+package webcam
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Delivers count frames not backed by a camera, with sequence numbers
+// and buffer indexes counting up from 0
+func deliverTestFrames(b *Broadcaster, count int) []*Frame {
+	frames := make([]*Frame, count)
+	for i := range frames {
+		frames[i] = &Frame{Index: uint32(i), Sequence: uint32(i), data: []byte{byte(i)}}
+		b.deliver(context.Background(), frames[i])
+	}
+	return frames
+}
+
+// Returns sequence numbers of the frames queued for the subscription
+func queuedTestFrames(s *Subscription) []uint32 {
+	var sequences []uint32
+	for {
+		select {
+		case f := <-s.Frames():
+			sequences = append(sequences, f.Sequence())
+			f.Release()
+		default:
+			return sequences
+		}
+	}
+}
+
+func TestBroadcasterRefcount(t *testing.T) {
+	b := NewBroadcaster(nil)
+	first, err := b.Subscribe(DropNewest, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.Subscribe(DropNewest, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := deliverTestFrames(b, 1)[0]
+	f1, f2 := <-first.Frames(), <-second.Frames()
+
+	if f1.Sequence() != 0 || f2.Sequence() != 0 || f1.Bytes()[0] != 0 {
+		t.Fatalf("subscribers got frames %d and %d, want 0", f1.Sequence(), f2.Sequence())
+	}
+
+	if err = f1.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Released() {
+		t.Fatal("frame was requeued while a subscriber holds it")
+	}
+	if err = f1.Release(); err != ErrFrameReleased {
+		t.Errorf("second Release = %v, want ErrFrameReleased", err)
+	}
+	if frame.Released() {
+		t.Fatal("second Release of one subscriber requeued the frame")
+	}
+	if _, err = f1.Clone(); err != ErrFrameReleased {
+		t.Errorf("Clone of a released frame = %v, want ErrFrameReleased", err)
+	}
+
+	clone, err := f2.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f2.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if !frame.Released() {
+		t.Error("frame was not requeued once every subscriber released it")
+	}
+	if clone.Sequence != 0 || clone.Bytes()[0] != 0 {
+		t.Error("clone changed with the release of the frame")
+	}
+}
+
+// Errors of requeueing the buffer reach the subscriber releasing it last
+func TestBroadcasterReleaseError(t *testing.T) {
+	b := NewBroadcaster(nil)
+	s, err := b.Subscribe(DropNewest, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := deliverTestFrames(b, 1)[0]
+	frame.Release()
+
+	if err = (<-s.Frames()).Release(); err != ErrFrameReleased {
+		t.Errorf("Release of a requeued frame = %v, want ErrFrameReleased", err)
+	}
+}
+
+func TestBroadcasterPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   BackpressurePolicy
+		queued   []uint32
+		released []bool
+	}{
+		{"drop oldest", DropOldest, []uint32{2, 3}, []bool{true, true, false, false}},
+		{"drop newest", DropNewest, []uint32{0, 1}, []bool{false, false, true, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBroadcaster(nil)
+			s, err := b.Subscribe(tt.policy, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			frames := deliverTestFrames(b, 4)
+
+			if s.Dropped() != 2 {
+				t.Errorf("dropped %d frames, want 2", s.Dropped())
+			}
+			for i, frame := range frames {
+				if frame.Released() != tt.released[i] {
+					t.Errorf("frame %d released %v, want %v", i, frame.Released(), tt.released[i])
+				}
+			}
+
+			queued := queuedTestFrames(s)
+			if len(queued) != len(tt.queued) {
+				t.Fatalf("queued frames %v, want %v", queued, tt.queued)
+			}
+			for i := range queued {
+				if queued[i] != tt.queued[i] {
+					t.Errorf("queued frames %v, want %v", queued, tt.queued)
+				}
+			}
+		})
+	}
+}
+
+func TestBroadcasterBlock(t *testing.T) {
+	b := NewBroadcaster(nil)
+	s, err := b.Subscribe(Block, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered := make(chan []*Frame)
+	go func() { delivered <- deliverTestFrames(b, 2) }()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-delivered:
+			t.Fatal("delivery did not wait for the subscriber")
+		case <-time.After(50 * time.Millisecond):
+		}
+		f := <-s.Frames()
+		if f.Sequence() != uint32(i) {
+			t.Errorf("got frame %d, want %d", f.Sequence(), i)
+		}
+		f.Release()
+	}
+	<-delivered
+
+	if s.Dropped() != 0 {
+		t.Errorf("blocking subscription dropped %d frames", s.Dropped())
+	}
+
+	// Cancelling the broadcast releases a frame still waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	frame := &Frame{}
+	done := make(chan struct{})
+	go func() {
+		b.deliver(ctx, frame)
+		close(done)
+	}()
+	cancel()
+	<-done
+	if !frame.Released() {
+		t.Error("frame was not released on cancellation")
+	}
+}
+
+func TestSubscriptionClose(t *testing.T) {
+	b := NewBroadcaster(nil)
+	s, err := b.Subscribe(DropNewest, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := deliverTestFrames(b, 2)
+	s.Close()
+	s.Close()
+
+	for i, frame := range frames {
+		if !frame.Released() {
+			t.Errorf("queued frame %d was not released by Close", i)
+		}
+	}
+	if _, ok := <-s.Frames(); ok {
+		t.Error("frame channel is open after Close")
+	}
+
+	// Frames without subscribers go straight back to the driver
+	if frame := deliverTestFrames(b, 1)[0]; !frame.Released() {
+		t.Error("frame without subscribers was not released")
+	}
+}
+
+func TestBroadcasterRun(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	b := NewBroadcaster(cam)
+	if err := b.Run(context.Background()); !errors.Is(err, ErrNotStreaming) {
+		t.Errorf("Run before StartStreaming = %v, want ErrNotStreaming", err)
+	}
+
+	b = NewBroadcaster(cam)
+	s, err := b.Subscribe(DropOldest, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- b.Run(ctx) }()
+
+	for i := 0; i < 3; i++ {
+		f := <-s.Frames()
+		if len(f.Bytes()) != 640*480*2 {
+			t.Errorf("frame has %d bytes, want %d", len(f.Bytes()), 640*480*2)
+		}
+		if err = f.Release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancel()
+	if err = <-result; err != context.Canceled {
+		t.Errorf("Run = %v, want context.Canceled", err)
+	}
+	for f := range s.Frames() {
+		f.Release()
+	}
+	if err = b.Run(ctx); err == nil {
+		t.Error("second Run succeeded")
+	}
+	if _, err = b.Subscribe(DropOldest, 1); err == nil {
+		t.Error("Subscribe to a finished broadcaster succeeded")
+	}
+}
@@ -0,0 +1,316 @@
+package webcam
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// Item of a menu control
+type MenuItem struct {
+	Index uint32
+	// Name of the item, empty for integer menus
+	Name string
+	// Value of the item of integer menus
+	Value int64
+}
+
+// Returns descriptor of a single control
+func (w *Camera) QueryControl(id ControlID) (Control, error) {
+	if err := w.enter(); err != nil {
+		return Control{}, err
+	}
+	defer w.leave()
+
+	c, err := w.dev.queryControl(uint32(id))
+
+	if err != nil {
+		return Control{}, err
+	}
+
+	return w.newControl(c), nil
+}
+
+// Get the value of a control with VIDIOC_G_EXT_CTRLS.
+// Works for controls of any class, including 64-bit ones
+func (w *Camera) GetExtControl(id ControlID) (int64, error) {
+	if err := w.enter(); err != nil {
+		return 0, err
+	}
+	defer w.leave()
+
+	ctrl, err := w.extControl(id)
+
+	if err != nil {
+		return 0, err
+	}
+
+	controls := []extControl{ctrl}
+	_, err = w.dev.getExtControls(controls)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return controls[0].value, nil
+}
+
+// Set the value of a control with VIDIOC_S_EXT_CTRLS.
+// Value of a button control is ignored, setting it triggers the action
+func (w *Camera) SetExtControl(id ControlID, value int64) error {
+	if err := w.enter(); err != nil {
+		return err
+	}
+	defer w.leave()
+
+	ctrl, err := w.extControl(id)
+
+	if err != nil {
+		return err
+	}
+
+	ctrl.value = value
+	_, err = w.dev.setExtControls([]extControl{ctrl})
+	return err
+}
+
+// Check a control value with VIDIOC_TRY_EXT_CTRLS without applying it.
+// Returns the value adjusted by the driver, e.g. clamped to the range
+// or rounded to the step
+func (w *Camera) TryExtControl(id ControlID, value int64) (int64, error) {
+	if err := w.enter(); err != nil {
+		return 0, err
+	}
+	defer w.leave()
+
+	ctrl, err := w.extControl(id)
+
+	if err != nil {
+		return 0, err
+	}
+
+	ctrl.value = value
+	controls := []extControl{ctrl}
+	_, err = w.dev.tryExtControls(controls)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return controls[0].value, nil
+}
+
+// Apply several controls at once. All values are checked with
+// VIDIOC_TRY_EXT_CTRLS first and then set with a single VIDIOC_S_EXT_CTRLS,
+// so the driver applies them atomically where it can.
+// If the driver rejects a control, *ControlError names it, and if some
+// controls were already set, their previous values are restored
+func (w *Camera) SetControls(values map[ControlID]int64) error {
+	if err := w.enter(); err != nil {
+		return err
+	}
+	defer w.leave()
+
+	ids := make([]ControlID, 0, len(values))
+	for id := range values {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	controls := make([]extControl, 0, len(ids))
+	previous := make([]extControl, 0, len(ids))
+	for _, id := range ids {
+		c, err := w.dev.queryControl(uint32(id))
+
+		if err != nil {
+			return &ControlError{ID: id, Err: err}
+		}
+
+		ctrl, err := newExtControl(c)
+
+		if err != nil {
+			return &ControlError{ID: id, Err: err}
+		}
+
+		// Write-only controls like buttons can't be restored
+		if (c.flags&V4L2_CTRL_FLAG_WRITE_ONLY) == 0 && c.c_type != V4L2_CTRL_TYPE_BUTTON {
+			previous = append(previous, ctrl)
+		}
+
+		ctrl.value = values[id]
+		controls = append(controls, ctrl)
+	}
+
+	if len(controls) == 0 {
+		return nil
+	}
+
+	_, err := w.dev.getExtControls(previous)
+
+	if err != nil {
+		return &ControlError{Err: err}
+	}
+
+	// Driver adjusts values when trying, so set the values as given
+	try := make([]extControl, len(controls))
+	copy(try, controls)
+
+	errorIdx, err := w.dev.tryExtControls(try)
+
+	if err != nil {
+		return newControlError(controls, errorIdx, err)
+	}
+
+	errorIdx, err = w.dev.setExtControls(controls)
+
+	if err != nil {
+		cerr := newControlError(controls, errorIdx, err)
+
+		// Index equal to count means that validation failed and nothing was set
+		if errorIdx < uint32(len(controls)) {
+			_, cerr.RollbackErr = w.dev.setExtControls(previous)
+		}
+
+		return cerr
+	}
+
+	return nil
+}
+
+func newControlError(controls []extControl, errorIdx uint32, err error) *ControlError {
+	cerr := &ControlError{Err: err}
+	if errorIdx < uint32(len(controls)) {
+		cerr.ID = ControlID(controls[errorIdx].id)
+	}
+	return cerr
+}
+
+// Get the value of a string control
+func (w *Camera) GetStringControl(id ControlID) (string, error) {
+	if err := w.enter(); err != nil {
+		return "", err
+	}
+	defer w.leave()
+
+	c, err := w.dev.queryControl(uint32(id))
+
+	if err != nil {
+		return "", err
+	}
+
+	if c.c_type != V4L2_CTRL_TYPE_STRING {
+		return "", errors.New("Not a string control")
+	}
+
+	// Maximum is the length of the string without terminating zero
+	controls := []extControl{{id: c.id, c_type: c.c_type, payload: make([]byte, c.max+1)}}
+	_, err = w.dev.getExtControls(controls)
+
+	if err != nil {
+		return "", err
+	}
+
+	return CToGoString(controls[0].payload), nil
+}
+
+// Set the value of a string control
+func (w *Camera) SetStringControl(id ControlID, value string) error {
+	if err := w.enter(); err != nil {
+		return err
+	}
+	defer w.leave()
+
+	c, err := w.dev.queryControl(uint32(id))
+
+	if err != nil {
+		return err
+	}
+
+	if c.c_type != V4L2_CTRL_TYPE_STRING {
+		return errors.New("Not a string control")
+	}
+
+	if int64(len(value)) > c.max {
+		return errors.New("String is too long for the control")
+	}
+
+	payload := make([]byte, len(value)+1)
+	copy(payload, value)
+	_, err = w.dev.setExtControls([]extControl{{id: c.id, c_type: c.c_type, payload: payload}})
+	return err
+}
+
+// Prepare a scalar control for extended control ioctls,
+// the driver interprets the value according to the control type
+func (w *Camera) extControl(id ControlID) (extControl, error) {
+	c, err := w.dev.queryControl(uint32(id))
+
+	if err != nil {
+		return extControl{}, err
+	}
+
+	return newExtControl(c)
+}
+
+func newExtControl(c control) (extControl, error) {
+	switch c.c_type {
+	case V4L2_CTRL_TYPE_STRING:
+		return extControl{}, errors.New("String controls are accessed with GetStringControl and SetStringControl")
+	case V4L2_CTRL_TYPE_CTRL_CLASS:
+		return extControl{}, errors.New("Control class has no value")
+	}
+
+	if c.c_type >= V4L2_CTRL_COMPOUND_TYPES {
+		return extControl{}, errors.New("Compound controls are not supported")
+	}
+
+	return extControl{id: c.id, c_type: c.c_type}, nil
+}
+
+// Converts a value to int32, values out of range become the closest limit
+func saturateInt32(v int64) int32 {
+	switch {
+	case v > math.MaxInt32:
+		return math.MaxInt32
+	case v < math.MinInt32:
+		return math.MinInt32
+	}
+	return int32(v)
+}
+
+// Convert a control descriptor, enumerating menu items with VIDIOC_QUERYMENU
+func (w *Camera) newControl(c control) Control {
+	result := Control{
+		Name:    c.name,
+		Min:     saturateInt32(c.min),
+		Max:     saturateInt32(c.max),
+		Min64:   c.min,
+		Max64:   c.max,
+		Type:    c.c_type,
+		Step:    c.step,
+		Default: c.def,
+		Flags:   c.flags,
+		Class:   c.id & 0x0fff0000, // V4L2_CTRL_ID2CLASS
+	}
+
+	if c.c_type == V4L2_CTRL_TYPE_MENU || c.c_type == V4L2_CTRL_TYPE_INTEGER_MENU {
+		for index := c.min; index <= c.max; index++ {
+			name, value, err := w.dev.queryMenu(c.id, uint32(index))
+
+			// Drivers skip menu items that are not supported
+			if err != nil {
+				continue
+			}
+
+			item := MenuItem{Index: uint32(index)}
+			if c.c_type == V4L2_CTRL_TYPE_MENU {
+				item.Name = name
+			} else {
+				item.Value = value
+			}
+			result.Menu = append(result.Menu, item)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,231 @@
+package webcam
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	testInteger64Control = V4L2_CID_PRIVATE_BASE
+	testBitmaskControl   = V4L2_CID_PRIVATE_BASE + 1
+)
+
+func controlTestConfig() FakeConfig {
+	config := DefaultFakeConfig()
+	config.Controls = append(config.Controls,
+		FakeControl{ID: ControlID(testInteger64Control), Name: "Pixel Rate", Min: -1 << 40, Max: 1 << 40,
+			Type: V4L2_CTRL_TYPE_INTEGER64, Value: 1 << 35},
+		FakeControl{ID: ControlID(testBitmaskControl), Name: "Flash Faults", Max: 0xffffffff,
+			Type: V4L2_CTRL_TYPE_BITMASK, Value: 0x80000001},
+	)
+	return config
+}
+
+func TestControlValue32(t *testing.T) {
+	tests := []struct {
+		c_type uint32
+		value  uint32
+		want   int64
+	}{
+		{V4L2_CTRL_TYPE_INTEGER, 5, 5},
+		{V4L2_CTRL_TYPE_INTEGER, 0xffffffff, -1},
+		{V4L2_CTRL_TYPE_MENU, 0x80000000, math.MinInt32},
+		{V4L2_CTRL_TYPE_BITMASK, 0xffffffff, 0xffffffff},
+		{V4L2_CTRL_TYPE_BITMASK, 0x80000001, 0x80000001},
+	}
+
+	for _, tt := range tests {
+		if got := controlValue32(tt.c_type, tt.value); got != tt.want {
+			t.Errorf("controlValue32(%d, %#x) = %d, want %d", tt.c_type, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestQueryControlRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         uint32
+		min, max   int32
+		min64      int64
+		max64      int64
+		wantType   uint32
+		wantStep   int64
+		wantDefVal int64
+	}{
+		{"integer", V4L2_CID_BASE, 0, 255, 0, 255, V4L2_CTRL_TYPE_INTEGER, 1, 128},
+		{"64-bit", testInteger64Control, math.MinInt32, math.MaxInt32, -1 << 40, 1 << 40, V4L2_CTRL_TYPE_INTEGER64, 1, 1 << 35},
+		{"bitmask", testBitmaskControl, 0, math.MaxInt32, 0, 0xffffffff, V4L2_CTRL_TYPE_BITMASK, 1, 0x80000001},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cam := openTestFake(t, controlTestConfig())
+
+			c, err := cam.QueryControl(ControlID(tt.id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Min != tt.min || c.Max != tt.max {
+				t.Errorf("range is %d..%d, want %d..%d", c.Min, c.Max, tt.min, tt.max)
+			}
+			if c.Min64 != tt.min64 || c.Max64 != tt.max64 {
+				t.Errorf("64-bit range is %d..%d, want %d..%d", c.Min64, c.Max64, tt.min64, tt.max64)
+			}
+			if c.Type != tt.wantType || c.Step != tt.wantStep || c.Default != tt.wantDefVal {
+				t.Errorf("got type %d, step %d, default %d, want %d, %d, %d",
+					c.Type, c.Step, c.Default, tt.wantType, tt.wantStep, tt.wantDefVal)
+			}
+		})
+	}
+}
+
+func TestBitmaskControl(t *testing.T) {
+	cam := openTestFake(t, controlTestConfig())
+
+	value, err := cam.GetExtControl(ControlID(testBitmaskControl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 0x80000001 {
+		t.Errorf("GetExtControl = %#x, want 0x80000001", value)
+	}
+
+	if err = cam.SetExtControl(ControlID(testBitmaskControl), 0xfffffffe); err != nil {
+		t.Fatal(err)
+	}
+	if value, err = cam.GetExtControl(ControlID(testBitmaskControl)); err != nil || value != 0xfffffffe {
+		t.Errorf("GetExtControl after set = %#x, %v, want 0xfffffffe", value, err)
+	}
+
+	if err = cam.SetExtControl(ControlID(testBitmaskControl), 1<<32); !errors.Is(err, unix.ERANGE) {
+		t.Errorf("SetExtControl of bits out of mask = %v, want ERANGE", err)
+	}
+}
+
+// Events carry 32-bit values, which must not be sign extended for bitmasks
+func TestBitmaskControlEvent(t *testing.T) {
+	d := newFakeDevice(controlTestConfig())
+	d.setBufferType(V4L2_BUF_TYPE_VIDEO_CAPTURE)
+	defer d.close()
+
+	if err := d.subscribeEvent(V4L2_EVENT_CTRL, testBitmaskControl, V4L2_EVENT_SUB_FL_SEND_INITIAL); err != nil {
+		t.Fatal(err)
+	}
+	event, err := d.dequeueEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := newControlEvent(&event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Value != 0x80000001 {
+		t.Errorf("event value = %#x, want 0x80000001", e.Value)
+	}
+	if e.Max != 0xffffffff || e.Default != 0x80000001 {
+		t.Errorf("event range is %#x..%#x with default %#x, want 0..0xffffffff with default 0x80000001",
+			e.Min, e.Max, e.Default)
+	}
+}
+
+func TestSetControls(t *testing.T) {
+	cam := openTestFake(t, controlTestConfig())
+
+	brightness, contrast := ControlID(V4L2_CID_BASE), ControlID(V4L2_CID_BASE+1)
+	err := cam.SetControls(map[ControlID]int64{brightness: 10, contrast: 20, ControlID(testInteger64Control): 1 << 36})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[ControlID]int32{brightness: 10, contrast: 20} {
+		if value, err := cam.GetControl(id); err != nil || value != want {
+			t.Errorf("control %#x is %d (%v), want %d", id, value, err, want)
+		}
+	}
+	if value, err := cam.GetExtControl(ControlID(testInteger64Control)); err != nil || value != 1<<36 {
+		t.Errorf("64-bit control is %d (%v), want %d", value, err, int64(1<<36))
+	}
+}
+
+func TestSetControlsRollback(t *testing.T) {
+	brightness, contrast := ControlID(V4L2_CID_BASE), ControlID(V4L2_CID_BASE+1)
+
+	tests := []struct {
+		name string
+		// Failures of setting contrast, the second control set
+		failSets        int
+		wantRollbackErr bool
+	}{
+		{"restored", 1, false},
+		{"restore failed", 2, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultFakeConfig()
+			config.Controls[1].FailSets = tt.failSets
+			cam := openTestFake(t, config)
+
+			err := cam.SetControls(map[ControlID]int64{brightness: 10, contrast: 20})
+
+			var cerr *ControlError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("SetControls = %v, want *ControlError", err)
+			}
+			if cerr.ID != contrast {
+				t.Errorf("error names control %#x, want %#x from error_idx", cerr.ID, contrast)
+			}
+			if !errors.Is(err, unix.EIO) {
+				t.Errorf("error %v does not unwrap to EIO", err)
+			}
+			if (cerr.RollbackErr != nil) != tt.wantRollbackErr {
+				t.Errorf("rollback error is %v, want failure %v", cerr.RollbackErr, tt.wantRollbackErr)
+			}
+
+			// Brightness set before the failure is restored either way
+			if value, err := cam.GetControl(brightness); err != nil || value != 128 {
+				t.Errorf("brightness is %d (%v) after the failure, want 128", value, err)
+			}
+			if value, err := cam.GetControl(contrast); err != nil || value != 128 {
+				t.Errorf("contrast is %d (%v) after the failure, want 128", value, err)
+			}
+		})
+	}
+}
+
+func TestSetControlsValidation(t *testing.T) {
+	brightness, contrast := ControlID(V4L2_CID_BASE), ControlID(V4L2_CID_BASE+1)
+
+	// Menu item the device skips fails TRY, naming the control
+	cam := openTestFake(t, DefaultFakeConfig())
+	err := cam.SetControls(map[ControlID]int64{brightness: 10, ControlID(V4L2_CID_EXPOSURE_AUTO): 2})
+
+	var cerr *ControlError
+	if !errors.As(err, &cerr) || cerr.ID != ControlID(V4L2_CID_EXPOSURE_AUTO) || cerr.RollbackErr != nil {
+		t.Errorf("SetControls with an invalid menu item = %v, want error of the menu control", err)
+	}
+	if value, _ := cam.GetControl(brightness); value != 128 {
+		t.Errorf("brightness is %d after failed validation, want 128", value)
+	}
+
+	// Grabbed control passes TRY but fails SET with error_idx equal to
+	// count, so that no control can be named and nothing was set
+	config := DefaultFakeConfig()
+	config.Controls[1].Flags |= V4L2_CTRL_FLAG_GRABBED
+	cam = openTestFake(t, config)
+	err = cam.SetControls(map[ControlID]int64{brightness: 10, contrast: 20})
+
+	if !errors.As(err, &cerr) || cerr.ID != 0 || cerr.RollbackErr != nil || !errors.Is(err, ErrBusy) {
+		t.Errorf("SetControls of a grabbed control = %v, want unnamed busy error without rollback", err)
+	}
+	if value, _ := cam.GetControl(brightness); value != 128 {
+		t.Errorf("brightness is %d after failed validation, want 128", value)
+	}
+	if _, err = cam.GetControl(contrast); err != nil {
+		t.Error(err)
+	}
+}
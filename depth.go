@@ -0,0 +1,262 @@
+package webcam
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Metres per unit of depth samples of most depth cameras
+const DefaultDepthScale = 0.001
+
+// Depth map with a 16-bit sample per pixel, in units of Scale metres.
+// Samples of 0 mark pixels without a depth measurement.
+// As an image.Image it reads as Gray16 of the raw samples
+type DepthImage struct {
+	Pix []uint16
+	// Distance between vertically adjacent pixels in samples
+	Stride int
+	Rect   image.Rectangle
+	// Metres per unit of samples
+	Scale float64
+}
+
+// Returns Gray16 color model of raw samples
+func (d *DepthImage) ColorModel() color.Model {
+	return color.Gray16Model
+}
+
+// Returns bounds of the depth map
+func (d *DepthImage) Bounds() image.Rectangle {
+	return d.Rect
+}
+
+// Returns the raw sample at (x, y) as color.Gray16
+func (d *DepthImage) At(x, y int) color.Color {
+	return color.Gray16{Y: d.DepthAt(x, y)}
+}
+
+// Returns the raw depth sample at (x, y), 0 outside of the image
+func (d *DepthImage) DepthAt(x, y int) uint16 {
+	if !(image.Point{x, y}.In(d.Rect)) {
+		return 0
+	}
+	return d.Pix[(y-d.Rect.Min.Y)*d.Stride+x-d.Rect.Min.X]
+}
+
+// Returns the distance at (x, y) in metres, 0 if there is no measurement
+func (d *DepthImage) Distance(x, y int) float64 {
+	return float64(d.DepthAt(x, y)) * d.Scale
+}
+
+// Colormaps depth is rendered with
+type Colormap int
+
+const (
+	// Blue through cyan, yellow and red, the classic MATLAB colormap
+	ColormapJet Colormap = iota
+	// Perceptually smoother variant of jet with dark ends, by Google
+	ColormapTurbo
+)
+
+// How depth is mapped to colors. Pixels without depth are black
+type DepthRendering struct {
+	Colormap Colormap
+	// Range of distances in metres spread over the colormap, nearer and
+	// farther distances get the colors of the ends. If Far is 0, the range
+	// spans the nearest and the farthest distance of each frame
+	Near float64
+	Far  float64
+}
+
+// Returns an image with depth mapped to colors
+func (d *DepthImage) Render(rendering DepthRendering) *image.RGBA {
+	img := image.NewRGBA(d.Rect)
+	lut, ok := colormaps[rendering.Colormap]
+	if !ok {
+		lut = colormaps[ColormapJet]
+	}
+
+	near, far := d.depthRange(rendering)
+	span := far - near
+	if span <= 0 {
+		span = 1
+	}
+
+	width := d.Rect.Dx()
+	for y := 0; y < d.Rect.Dy(); y++ {
+		for x := 0; x < width; x++ {
+			o := y*img.Stride + 4*x
+			img.Pix[o+3] = 0xff
+
+			v := d.Pix[y*d.Stride+x]
+			if v == 0 {
+				continue
+			}
+
+			i := int((float64(v) - near) * 255 / span)
+			if i < 0 {
+				i = 0
+			} else if i > 255 {
+				i = 255
+			}
+
+			c := lut[i]
+			img.Pix[o], img.Pix[o+1], img.Pix[o+2] = c.R, c.G, c.B
+		}
+	}
+	return img
+}
+
+// Returns the range of samples spread over the colormap
+func (d *DepthImage) depthRange(rendering DepthRendering) (float64, float64) {
+	if rendering.Far > 0 && d.Scale > 0 {
+		return rendering.Near / d.Scale, rendering.Far / d.Scale
+	}
+
+	near, far := uint16(math.MaxUint16), uint16(0)
+	for y := 0; y < d.Rect.Dy(); y++ {
+		for _, v := range d.Pix[y*d.Stride : y*d.Stride+d.Rect.Dx()] {
+			if v == 0 {
+				continue
+			}
+			if v < near {
+				near = v
+			}
+			if v > far {
+				far = v
+			}
+		}
+	}
+	if far < near {
+		return 0, 0
+	}
+	return float64(near), float64(far)
+}
+
+// Depth format, ir is true if frames hold an infrared plane before depth
+type depthFormat struct {
+	ir bool
+}
+
+var depthFormats = map[string]depthFormat{
+	"Z16 ": {false},
+	"INVZ": {false},
+	"INZI": {true},
+}
+
+// Layout of INZI frames, a Y10 infrared plane followed by a Z16 depth plane.
+// Drivers report lines of both planes together, 4 bytes per pixel
+func depthIRLayout(width uint32, height uint32, bytesPerLine uint32) FrameLayout {
+	stride := int(bytesPerLine) / 2
+	if stride == 0 {
+		stride = int(width) * 2
+	}
+	return FrameLayout{Planes: []PlaneLayout{
+		{Offset: 0, Stride: stride},
+		{Offset: stride * int(height), Stride: stride},
+	}}
+}
+
+// Decodes depth of Z16, INVZ and INZI frames, with samples of scale metres.
+// Scale of 0 stands for DefaultDepthScale
+func DecodeDepth(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout, scale float64) (*DepthImage, error) {
+	f, ok := depthFormats[DecodeFormat(format)]
+	if !ok {
+		return nil, fmt.Errorf("format %v is not a depth format: %w", DecodeFormat(format), ErrUnsupportedFormat)
+	}
+
+	if scale == 0 {
+		scale = DefaultDepthScale
+	}
+
+	plane := 0
+	if f.ir {
+		plane = 1
+	}
+
+	samples, err := readRawSamples(frame, layout, plane, int(width), int(height), rawUnpacked16, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DepthImage{
+		Pix:    samples,
+		Stride: int(width),
+		Rect:   image.Rect(0, 0, int(width), int(height)),
+		Scale:  scale,
+	}, nil
+}
+
+// Splits INZI frames into depth, with samples of scale metres,
+// and the 10-bit infrared image scaled to 16 bits
+func DecodeDepthIR(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout, scale float64) (*DepthImage, *image.Gray16, error) {
+	f, ok := depthFormats[DecodeFormat(format)]
+	if !ok || !f.ir {
+		return nil, nil, fmt.Errorf("format %v has no infrared plane: %w", DecodeFormat(format), ErrUnsupportedFormat)
+	}
+
+	if len(layout.Planes) < 2 {
+		return nil, nil, fmt.Errorf("Frame layout has %d planes, infrared and depth planes are needed", len(layout.Planes))
+	}
+
+	depth, err := DecodeDepth(frame, format, width, height, layout, scale)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ir, err := GrayDecoder(GrayWindow{})(frame, EncodeFormat("Y10"), width, height, FrameLayout{Planes: layout.Planes[:1]})
+	if err != nil {
+		return nil, nil, err
+	}
+	return depth, ir.(*image.Gray16), nil
+}
+
+// Returns a decoder of depth formats that renders depth, with samples
+// of scale metres, to colors. Depth formats are registered with
+// DefaultDepthScale and jet colors spanning the range of each frame,
+// rendering is changed by registering them again with another decoder
+func DepthDecoder(scale float64, rendering DepthRendering) Decoder {
+	return func(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout) (image.Image, error) {
+		depth, err := DecodeDepth(frame, format, width, height, layout, scale)
+		if err != nil {
+			return nil, err
+		}
+		return depth.Render(rendering), nil
+	}
+}
+
+// 256 colors of each colormap, from near to far
+var colormaps = map[Colormap][256]color.RGBA{
+	ColormapJet:   makeColormap(jet),
+	ColormapTurbo: makeColormap(turbo),
+}
+
+func makeColormap(fn func(x float64) (float64, float64, float64)) [256]color.RGBA {
+	var lut [256]color.RGBA
+	for i := range lut {
+		r, g, b := fn(float64(i) / 255)
+		lut[i] = color.RGBA{unitToByte(r), unitToByte(g), unitToByte(b), 0xff}
+	}
+	return lut
+}
+
+func unitToByte(v float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(1, v)) * 255))
+}
+
+func jet(x float64) (float64, float64, float64) {
+	channel := func(center float64) float64 {
+		return 1.5 - math.Abs(4*x-center)
+	}
+	return channel(3), channel(2), channel(1)
+}
+
+// Polynomial approximation of turbo published along with the colormap
+func turbo(x float64) (float64, float64, float64) {
+	r := 0.13572138 + x*(4.61539260+x*(-42.66032258+x*(132.13108234+x*(-152.94239396+x*59.28637943))))
+	g := 0.09140261 + x*(2.19418839+x*(4.84296658+x*(-14.18503333+x*(4.27729857+x*2.82956604))))
+	b := 0.10667330 + x*(12.64194608+x*(-60.58204836+x*(110.36276771+x*(-89.90310912+x*27.34824973))))
+	return r, g, b
+}
@@ -0,0 +1,205 @@
+package webcam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// INZI frame of width x height pixels, infrared samples of 10 bits
+// followed by depth samples
+func testDepthIRFrame(width int, height int, ir uint16, depth uint16) []byte {
+	frame := make([]byte, 4*width*height)
+	for i := 0; i < width*height; i++ {
+		binary.LittleEndian.PutUint16(frame[2*i:], ir)
+		binary.LittleEndian.PutUint16(frame[2*(width*height+i):], depth)
+	}
+	return frame
+}
+
+func TestDecodeDepthIR(t *testing.T) {
+	frame := testDepthIRFrame(4, 2, 0x3ff, 1500)
+	format := EncodeFormat("INZI")
+
+	tests := []struct {
+		name    string
+		layout  FrameLayout
+		wantErr bool
+	}{
+		{"driver layout", depthIRLayout(4, 2, 16), false},
+		{"no planes", FrameLayout{}, true},
+		{"infrared plane only", FrameLayout{Planes: []PlaneLayout{{Offset: 0, Stride: 8}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			depth, ir, err := DecodeDepthIR(frame, format, 4, 2, tt.layout, 0)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("DecodeDepthIR succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := depth.Distance(3, 1); d != 1.5 {
+				t.Errorf("distance is %v, want 1.5", d)
+			}
+			if v := ir.Gray16At(3, 1).Y; v != 0xffff {
+				t.Errorf("infrared is %#x, want 0xffff", v)
+			}
+		})
+	}
+}
+
+func TestGrayWindowClip(t *testing.T) {
+	// Infrared plane of an INZI frame is a Y10 frame
+	frame := testDepthIRFrame(4, 2, 0x200, 0)[:16]
+	layout := PackedLayout("Y10 ", 4, 2)
+
+	// Clip alone must decode like no window at all
+	img, err := GrayDecoder(GrayWindow{Clip: 0.01})(frame, EncodeFormat("Y10 "), 4, 2, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.(*image.Gray16); !ok {
+		t.Errorf("decoded to %T, want *image.Gray16", img)
+	}
+
+	img, err = GrayDecoder(GrayWindow{Normalize: true, Clip: 0.01})(frame, EncodeFormat("Y10 "), 4, 2, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.(*image.Gray); !ok {
+		t.Errorf("normalised frame decoded to %T, want *image.Gray", img)
+	}
+}
+
+// Depth map of a single line of samples in millimetres
+func testDepthLine(samples ...uint16) *DepthImage {
+	return &DepthImage{Pix: samples, Stride: len(samples), Rect: image.Rect(0, 0, len(samples), 1), Scale: 0.001}
+}
+
+func TestColormaps(t *testing.T) {
+	tests := []struct {
+		colormap Colormap
+		near     color.RGBA
+		far      color.RGBA
+	}{
+		// Jet runs from dark blue to dark red
+		{ColormapJet, color.RGBA{0, 0, 128, 255}, color.RGBA{128, 0, 0, 255}},
+		// Turbo has dark ends, the polynomial leaves a little green in the red
+		{ColormapTurbo, color.RGBA{35, 23, 27, 255}, color.RGBA{144, 13, 0, 255}},
+	}
+
+	for _, tt := range tests {
+		lut := colormaps[tt.colormap]
+		if lut[0] != tt.near || lut[255] != tt.far {
+			t.Errorf("colormap %d runs from %v to %v, want %v to %v", tt.colormap, lut[0], lut[255], tt.near, tt.far)
+		}
+	}
+}
+
+func TestDepthRender(t *testing.T) {
+	jet := colormaps[ColormapJet]
+	turbo := colormaps[ColormapTurbo]
+	black := color.RGBA{0, 0, 0, 255}
+
+	tests := []struct {
+		name      string
+		depth     *DepthImage
+		rendering DepthRendering
+		want      []color.RGBA
+	}{
+		{"range of the frame", testDepthLine(0, 1000, 2000, 3000), DepthRendering{},
+			[]color.RGBA{black, jet[0], jet[127], jet[255]}},
+		{"near and far clamped", testDepthLine(0, 1000, 2000, 3000), DepthRendering{Near: 1.5, Far: 2.5},
+			[]color.RGBA{black, jet[0], jet[127], jet[255]}},
+		{"partial range", testDepthLine(1500, 2000, 2500), DepthRendering{Near: 1, Far: 3},
+			[]color.RGBA{jet[63], jet[127], jet[191]}},
+		{"turbo", testDepthLine(1000, 3000), DepthRendering{Colormap: ColormapTurbo},
+			[]color.RGBA{turbo[0], turbo[255]}},
+		{"unknown colormap", testDepthLine(1000, 3000), DepthRendering{Colormap: Colormap(42)},
+			[]color.RGBA{jet[0], jet[255]}},
+		{"single distance", testDepthLine(0, 1500, 1500), DepthRendering{},
+			[]color.RGBA{black, jet[0], jet[0]}},
+		{"no measurements", testDepthLine(0, 0), DepthRendering{},
+			[]color.RGBA{black, black}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := tt.depth.Render(tt.rendering)
+			for x, want := range tt.want {
+				if got := img.RGBAAt(x, 0); got != want {
+					t.Errorf("pixel %d is %v, want %v", x, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDepthRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		depth     *DepthImage
+		rendering DepthRendering
+		near, far float64
+	}{
+		{"range of the frame", testDepthLine(0, 3000, 1000, 0), DepthRendering{}, 1000, 3000},
+		{"given range", testDepthLine(0, 3000, 1000), DepthRendering{Near: 0.5, Far: 4}, 500, 4000},
+		{"near without far", testDepthLine(3000, 1000), DepthRendering{Near: 2}, 1000, 3000},
+		{"single distance", testDepthLine(1500, 0, 1500), DepthRendering{}, 1500, 1500},
+		{"no measurements", testDepthLine(0, 0), DepthRendering{}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		if near, far := tt.depth.depthRange(tt.rendering); near != tt.near || far != tt.far {
+			t.Errorf("%s: range is %v-%v, want %v-%v", tt.name, near, far, tt.near, tt.far)
+		}
+	}
+
+	// Samples right of the image in padded lines are not part of the range
+	padded := &DepthImage{Pix: []uint16{1000, 9000, 2000, 9000}, Stride: 2, Rect: image.Rect(0, 0, 1, 2), Scale: 0.001}
+	if near, far := padded.depthRange(DepthRendering{}); near != 1000 || far != 2000 {
+		t.Errorf("range of padded lines is %v-%v, want 1000-2000", near, far)
+	}
+}
+
+// Registered depth decoders render frames that Compress encodes to JPEG
+func TestDepthDecoderCompress(t *testing.T) {
+	const width, height = 16, 12
+	frame := make([]byte, 2*width*height)
+	for i := 0; i < width*height; i++ {
+		binary.LittleEndian.PutUint16(frame[2*i:], uint16(500+i*10))
+	}
+
+	img, err := Decode(frame, EncodeFormat("Z16 "), width, height, PackedLayout("Z16 ", width, height))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.(*image.RGBA); !ok {
+		t.Errorf("Z16 decoded to %T, want *image.RGBA", img)
+	}
+
+	out, _, err := CompressLayout(frame, "Z16 ", width, height, PackedLayout("Z16 ", width, height), 90, "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds() != image.Rect(0, 0, width, height) {
+		t.Errorf("JPEG is %v, want %dx%d", decoded.Bounds(), width, height)
+	}
+
+	if _, _, err = CompressLayout(frame[:len(frame)-1], "Z16 ", width, height, PackedLayout("Z16 ", width, height), 90, "", 0, 0); !errors.Is(err, ErrShortFrame) {
+		t.Errorf("CompressLayout of a short frame = %v, want ErrShortFrame", err)
+	}
+}
@@ -0,0 +1,225 @@
+package webcam
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Backend that carries out device operations on behalf of Camera.
+// The default backend talks to a V4L2 device node, see v4l2Device.
+// A fake backend producing synthetic frames lives in fake.go
+type device interface {
+	checkCapabilities() (capabilities uint32, deviceCard string, err error)
+	setBufferType(bufType uint32)
+	getPixelFormat(index uint32) (code uint32, description string, err error)
+	getFrameSize(index uint32, code uint32) (FrameSize, error)
+	getFrameInterval(index uint32, code uint32, width uint32, height uint32) (FrameInterval, error)
+	getImageFormat() (v4l2_pix_format, error)
+	setImageFormat(pix *v4l2_pix_format) error
+	tryImageFormat(pix *v4l2_pix_format) error
+	getImageFormatMplane() (v4l2_pix_format_mplane, error)
+	setImageFormatMplane(pix *v4l2_pix_format_mplane) error
+	tryImageFormatMplane(pix *v4l2_pix_format_mplane) error
+	getStreamParm() (v4l2_captureparm, error)
+	setStreamParm(parm *v4l2_captureparm) error
+	requestBuffers(memory uint32, buf_count *uint32) error
+	queryBuffer(index uint32, length *uint32) ([]byte, error)
+	dequeueBuffer(memory uint32) (v4l2_buffer, error)
+	enqueueBuffer(index uint32) error
+	enqueueUserBuffer(index uint32, buffer []byte) error
+	enqueueDmabuf(index uint32, dmafd int, length uint32) error
+	exportBuffer(index uint32, plane uint32) (int, error)
+	mapDmabuf(dmafd int) ([]byte, error)
+	queryPlanes(index uint32) ([][]byte, error)
+	dequeuePlanes(memory uint32) (v4l2_buffer, []v4l2_plane, error)
+	enqueuePlanes(index uint32, numPlanes uint32) error
+	releaseBuffer(buffer []byte) error
+	read(buffer []byte) (int, error)
+	startStreaming() error
+	stopStreaming() error
+	waitForFrame(timeout time.Duration) (frame bool, event bool, err error)
+	subscribeEvent(eventType uint32, id uint32, flags uint32) error
+	unsubscribeEvent(eventType uint32, id uint32) error
+	dequeueEvent() (v4l2_event, error)
+	getControl(id uint32) (int32, error)
+	setControl(id uint32, val int32) error
+	queryControls() []control
+	queryControl(id uint32) (control, error)
+	queryMenu(id uint32, index uint32) (name string, value int64, err error)
+	getExtControls(controls []extControl) (errorIdx uint32, err error)
+	setExtControls(controls []extControl) (errorIdx uint32, err error)
+	tryExtControls(controls []extControl) (errorIdx uint32, err error)
+	close() error
+}
+
+// V4L2 device node backend
+// Buffer type is either V4L2_BUF_TYPE_VIDEO_CAPTURE or _MPLANE
+type v4l2Device struct {
+	fd      uintptr
+	bufType uint32
+}
+
+func (d *v4l2Device) checkCapabilities() (uint32, string, error) {
+	return checkCapabilities(d.fd)
+}
+
+func (d *v4l2Device) setBufferType(bufType uint32) {
+	d.bufType = bufType
+}
+
+func (d *v4l2Device) getPixelFormat(index uint32) (uint32, string, error) {
+	return getPixelFormat(d.fd, d.bufType, index)
+}
+
+func (d *v4l2Device) getFrameSize(index uint32, code uint32) (FrameSize, error) {
+	return getFrameSize(d.fd, index, code)
+}
+
+func (d *v4l2Device) getFrameInterval(index uint32, code uint32, width uint32, height uint32) (FrameInterval, error) {
+	return getFrameInterval(d.fd, index, code, width, height)
+}
+
+func (d *v4l2Device) getImageFormat() (v4l2_pix_format, error) {
+	return getImageFormat(d.fd)
+}
+
+func (d *v4l2Device) setImageFormat(pix *v4l2_pix_format) error {
+	return setImageFormat(d.fd, pix)
+}
+
+func (d *v4l2Device) tryImageFormat(pix *v4l2_pix_format) error {
+	return tryImageFormat(d.fd, pix)
+}
+
+func (d *v4l2Device) getImageFormatMplane() (v4l2_pix_format_mplane, error) {
+	return getImageFormatMplane(d.fd)
+}
+
+func (d *v4l2Device) setImageFormatMplane(pix *v4l2_pix_format_mplane) error {
+	return setImageFormatMplane(d.fd, pix)
+}
+
+func (d *v4l2Device) tryImageFormatMplane(pix *v4l2_pix_format_mplane) error {
+	return tryImageFormatMplane(d.fd, pix)
+}
+
+func (d *v4l2Device) getStreamParm() (v4l2_captureparm, error) {
+	return getStreamParm(d.fd, d.bufType)
+}
+
+func (d *v4l2Device) setStreamParm(parm *v4l2_captureparm) error {
+	return setStreamParm(d.fd, d.bufType, parm)
+}
+
+func (d *v4l2Device) requestBuffers(memory uint32, buf_count *uint32) error {
+	return requestBuffers(d.fd, d.bufType, memory, buf_count)
+}
+
+func (d *v4l2Device) queryBuffer(index uint32, length *uint32) ([]byte, error) {
+	return mmapQueryBuffer(d.fd, index, length)
+}
+
+func (d *v4l2Device) dequeueBuffer(memory uint32) (v4l2_buffer, error) {
+	return dequeueBuffer(d.fd, memory)
+}
+
+func (d *v4l2Device) enqueueBuffer(index uint32) error {
+	return mmapEnqueueBuffer(d.fd, index)
+}
+
+func (d *v4l2Device) enqueueUserBuffer(index uint32, buffer []byte) error {
+	return userptrEnqueueBuffer(d.fd, index, buffer)
+}
+
+func (d *v4l2Device) enqueueDmabuf(index uint32, dmafd int, length uint32) error {
+	return dmabufEnqueueBuffer(d.fd, index, dmafd, length)
+}
+
+func (d *v4l2Device) exportBuffer(index uint32, plane uint32) (int, error) {
+	return exportBuffer(d.fd, d.bufType, index, plane)
+}
+
+func (d *v4l2Device) mapDmabuf(dmafd int) ([]byte, error) {
+	return dmabufMap(dmafd)
+}
+
+func (d *v4l2Device) queryPlanes(index uint32) ([][]byte, error) {
+	return mmapQueryPlanes(d.fd, index)
+}
+
+func (d *v4l2Device) dequeuePlanes(memory uint32) (v4l2_buffer, []v4l2_plane, error) {
+	return dequeuePlanes(d.fd, memory)
+}
+
+func (d *v4l2Device) enqueuePlanes(index uint32, numPlanes uint32) error {
+	return mmapEnqueuePlanes(d.fd, index, numPlanes)
+}
+
+func (d *v4l2Device) releaseBuffer(buffer []byte) error {
+	return mmapReleaseBuffer(buffer)
+}
+
+func (d *v4l2Device) read(buffer []byte) (int, error) {
+	return readFrame(d.fd, buffer)
+}
+
+func (d *v4l2Device) startStreaming() error {
+	return startStreaming(d.fd, d.bufType)
+}
+
+func (d *v4l2Device) stopStreaming() error {
+	return stopStreaming(d.fd, d.bufType)
+}
+
+func (d *v4l2Device) waitForFrame(timeout time.Duration) (bool, bool, error) {
+	return waitForFrame(d.fd, timeout)
+}
+
+func (d *v4l2Device) subscribeEvent(eventType uint32, id uint32, flags uint32) error {
+	return subscribeEvent(d.fd, eventType, id, flags)
+}
+
+func (d *v4l2Device) unsubscribeEvent(eventType uint32, id uint32) error {
+	return unsubscribeEvent(d.fd, eventType, id)
+}
+
+func (d *v4l2Device) dequeueEvent() (v4l2_event, error) {
+	return dequeueEvent(d.fd)
+}
+
+func (d *v4l2Device) getControl(id uint32) (int32, error) {
+	return getControl(d.fd, id)
+}
+
+func (d *v4l2Device) setControl(id uint32, val int32) error {
+	return setControl(d.fd, id, val)
+}
+
+func (d *v4l2Device) queryControls() []control {
+	return queryControls(d.fd)
+}
+
+func (d *v4l2Device) queryControl(id uint32) (control, error) {
+	return queryControl(d.fd, id)
+}
+
+func (d *v4l2Device) queryMenu(id uint32, index uint32) (string, int64, error) {
+	return queryMenu(d.fd, id, index)
+}
+
+func (d *v4l2Device) getExtControls(controls []extControl) (uint32, error) {
+	return getExtControls(d.fd, controls)
+}
+
+func (d *v4l2Device) setExtControls(controls []extControl) (uint32, error) {
+	return setExtControls(d.fd, controls)
+}
+
+func (d *v4l2Device) tryExtControls(controls []extControl) (uint32, error) {
+	return tryExtControls(d.fd, controls)
+}
+
+func (d *v4l2Device) close() error {
+	return unix.Close(int(d.fd))
+}
@@ -0,0 +1,193 @@
+package webcam
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Default location of video4linux device nodes and their sysfs entries
+const (
+	devicePath = "/dev"
+	sysfsPath  = "/sys/class/video4linux"
+)
+
+// Video device node found by ListDevices
+type DeviceInfo struct {
+	// Path of the device node, to be passed to Open
+	Path string
+	// Name of the node, e.g. video0
+	Name string
+	// Reported by VIDIOC_QUERYCAP
+	Card         string
+	Driver       string
+	BusInfo      string
+	Version      uint32
+	Capabilities uint32
+	// Capabilities of this node, rather than of the whole physical device
+	DeviceCaps uint32
+	// USB attributes from sysfs, empty for other buses
+	VendorID     string
+	ProductID    string
+	Serial       string
+	Manufacturer string
+	Product      string
+	// Physical USB port, e.g. 1-1.2
+	USBPort string
+	// Error querying the device, e.g. missing permissions.
+	// Only sysfs attributes are set if this is not nil
+	Err error
+}
+
+// Returns true if the node captures video with the single-planar
+// or multiplanar API. Devices often have further nodes, e.g. for metadata
+func (d *DeviceInfo) IsCapture() bool {
+	return (d.DeviceCaps & (V4L2_CAP_VIDEO_CAPTURE | V4L2_CAP_VIDEO_CAPTURE_MPLANE)) != 0
+}
+
+// Returns all video4linux device nodes found in /dev and sysfs,
+// ordered by their number
+func ListDevices() ([]DeviceInfo, error) {
+	return listDevices(devicePath, sysfsPath)
+}
+
+// Lists device nodes found in devDir and the video4linux class directory
+// sysfsDir of sysfs
+func listDevices(devDir string, sysfsDir string) ([]DeviceInfo, error) {
+	names := make(map[string]bool)
+
+	nodes, err := filepath.Glob(filepath.Join(devDir, "video*"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range nodes {
+		names[filepath.Base(node)] = true
+	}
+
+	entries, err := ioutil.ReadDir(sysfsDir)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "video") {
+			names[entry.Name()] = true
+		}
+	}
+
+	devices := make([]DeviceInfo, 0, len(names))
+	for name := range names {
+		devices = append(devices, deviceInfo(filepath.Join(devDir, name), sysfsDir))
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return deviceNumber(devices[i].Name) < deviceNumber(devices[j].Name)
+	})
+
+	return devices, nil
+}
+
+// Query a single device node, e.g. /dev/video0 or a symlink
+// from /dev/v4l/by-id
+func GetDeviceInfo(path string) DeviceInfo {
+	return deviceInfo(path, sysfsPath)
+}
+
+func deviceInfo(path string, sysfsDir string) DeviceInfo {
+	name := filepath.Base(path)
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		name = filepath.Base(target)
+	}
+
+	info := DeviceInfo{
+		Path: path,
+		Name: name,
+	}
+
+	readUSBAttributes(&info, sysfsDir)
+	info.Err = queryDeviceInfo(&info)
+
+	return info
+}
+
+func queryDeviceInfo(info *DeviceInfo) error {
+	handle, err := unix.Open(info.Path, unix.O_RDWR|unix.O_NONBLOCK, 0666)
+
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(handle)
+
+	caps, err := queryCapabilities(uintptr(handle))
+
+	if err != nil {
+		return err
+	}
+
+	info.Card = CToGoString(caps.card[:])
+	info.Driver = CToGoString(caps.driver[:])
+	info.BusInfo = CToGoString(caps.bus_info[:])
+	info.Version = caps.version
+	info.Capabilities = caps.capabilities
+	info.DeviceCaps = caps.capabilities
+	if (caps.capabilities & V4L2_CAP_DEVICE_CAPS) != 0 {
+		info.DeviceCaps = caps.device_caps
+	}
+
+	return nil
+}
+
+// Walk up from the node's device in sysfs to the USB device it belongs to
+func readUSBAttributes(info *DeviceInfo, sysfsDir string) {
+	dir, err := filepath.EvalSymlinks(filepath.Join(sysfsDir, info.Name, "device"))
+
+	if err != nil {
+		return
+	}
+
+	for ; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		vendor, err := readSysfsAttribute(dir, "idVendor")
+
+		if err != nil {
+			continue
+		}
+
+		info.VendorID = vendor
+		info.ProductID, _ = readSysfsAttribute(dir, "idProduct")
+		info.Serial, _ = readSysfsAttribute(dir, "serial")
+		info.Manufacturer, _ = readSysfsAttribute(dir, "manufacturer")
+		info.Product, _ = readSysfsAttribute(dir, "product")
+		info.USBPort = filepath.Base(dir)
+		return
+	}
+}
+
+func readSysfsAttribute(dir string, name string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Returns number of a node like video12, nodes without a number go last
+func deviceNumber(name string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(name, "video"))
+
+	if err != nil {
+		return int(^uint(0) >> 1)
+	}
+
+	return n
+}
@@ -0,0 +1,155 @@
+package webcam
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns a directory removed when the test ends
+func testTempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "webcam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// Creates a file with the given content, along with its directory
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Builds /dev and sysfs trees of a USB camera with nodes video0 and video1,
+// an unrelated platform node video10 and a node video2 seen only in /dev.
+// Returns the device and the video4linux class directories
+func testDeviceTree(t *testing.T) (string, string) {
+	t.Helper()
+
+	root := testTempDir(t)
+	devDir := filepath.Join(root, "dev")
+	classDir := filepath.Join(root, "sys", "class", "video4linux")
+
+	usb := filepath.Join(root, "sys", "devices", "pci0000:00", "usb1", "1-1")
+	writeTestFile(t, filepath.Join(usb, "idVendor"), "046d\n")
+	writeTestFile(t, filepath.Join(usb, "idProduct"), "0825\n")
+	writeTestFile(t, filepath.Join(usb, "serial"), "A1B2C3\n")
+	writeTestFile(t, filepath.Join(usb, "manufacturer"), "Logitech\n")
+	writeTestFile(t, filepath.Join(usb, "product"), "Webcam C270\n")
+	platform := filepath.Join(root, "sys", "devices", "platform", "isp")
+
+	for name, device := range map[string]string{
+		"video0":  filepath.Join(usb, "1-1:1.0"),
+		"video1":  filepath.Join(usb, "1-1:1.0"),
+		"video10": platform,
+	} {
+		if err := os.MkdirAll(filepath.Join(device, "video4linux", name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(classDir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(device, filepath.Join(classDir, name, "device")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"video0", "video1", "video10", "video2"} {
+		writeTestFile(t, filepath.Join(devDir, name), "")
+	}
+	return devDir, classDir
+}
+
+func TestListDevices(t *testing.T) {
+	devDir, classDir := testDeviceTree(t)
+
+	devices, err := listDevices(devDir, classDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"video0", "video1", "video2", "video10"}
+	if len(devices) != len(want) {
+		t.Fatalf("found %d devices, want %d", len(devices), len(want))
+	}
+	for i, d := range devices {
+		if d.Name != want[i] || d.Path != filepath.Join(devDir, want[i]) {
+			t.Errorf("device %d is %s at %s, want %s", i, d.Name, d.Path, want[i])
+		}
+		// Files standing in for the nodes fail VIDIOC_QUERYCAP
+		if d.Err == nil {
+			t.Errorf("querying %s succeeded", d.Name)
+		}
+	}
+
+	usb := devices[1]
+	if usb.VendorID != "046d" || usb.ProductID != "0825" || usb.Serial != "A1B2C3" ||
+		usb.Manufacturer != "Logitech" || usb.Product != "Webcam C270" || usb.USBPort != "1-1" {
+		t.Errorf("USB attributes are %s:%s %q %q %q at %s, want those of the C270",
+			usb.VendorID, usb.ProductID, usb.Serial, usb.Manufacturer, usb.Product, usb.USBPort)
+	}
+	for _, d := range []DeviceInfo{devices[2], devices[3]} {
+		if d.VendorID != "" || d.USBPort != "" {
+			t.Errorf("%s outside USB has vendor %q at port %q", d.Name, d.VendorID, d.USBPort)
+		}
+	}
+}
+
+func TestListDevicesWithoutSysfs(t *testing.T) {
+	devDir, _ := testDeviceTree(t)
+
+	devices, err := listDevices(devDir, filepath.Join(devDir, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 4 {
+		t.Errorf("found %d devices, want 4", len(devices))
+	}
+}
+
+// Symlinks like those of /dev/v4l/by-id are named after their target
+func TestDeviceInfoSymlink(t *testing.T) {
+	devDir, classDir := testDeviceTree(t)
+
+	link := filepath.Join(devDir, "v4l", "by-id", "usb-046d_0825_A1B2C3-video-index0")
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../video0", link); err != nil {
+		t.Fatal(err)
+	}
+
+	info := deviceInfo(link, classDir)
+	if info.Path != link || info.Name != "video0" || info.Serial != "A1B2C3" {
+		t.Errorf("device behind the link is %s with serial %q, want video0 with serial A1B2C3", info.Name, info.Serial)
+	}
+}
+
+func TestDeviceNumber(t *testing.T) {
+	tests := []struct {
+		name string
+		want int
+	}{
+		{"video0", 0},
+		{"video12", 12},
+		{"video", maxInt},
+		{"video-test", maxInt},
+	}
+
+	for _, tt := range tests {
+		if got := deviceNumber(tt.name); got != tt.want {
+			t.Errorf("deviceNumber(%q) = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
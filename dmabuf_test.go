@@ -0,0 +1,199 @@
+package webcam
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Creates count memfds of size bytes standing in for DMABUFs of another device
+func newTestDmabufs(t *testing.T, count int, size int) []int {
+	t.Helper()
+
+	fds := make([]int, count)
+	for i := range fds {
+		fd, err := unix.MemfdCreate("webcam-test", unix.MFD_CLOEXEC)
+		if err != nil {
+			t.Fatalf("MemfdCreate: %v", err)
+		}
+		if err = unix.Ftruncate(fd, int64(size)); err != nil {
+			t.Fatalf("Ftruncate: %v", err)
+		}
+		fds[i] = fd
+		t.Cleanup(func() { unix.Close(fd) })
+	}
+	return fds
+}
+
+// Maps a DMABUF the way another process receiving it would
+func mapTestDmabuf(t *testing.T, fd int) []byte {
+	t.Helper()
+
+	buffer, err := dmabufMap(fd)
+	if err != nil {
+		t.Fatalf("Failed to map DMABUF: %v", err)
+	}
+	t.Cleanup(func() { unix.Munmap(buffer) })
+	return buffer
+}
+
+func TestDmabufStreaming(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		count  int
+	}{
+		{"single buffer", "YUYV", 1},
+		{"YUYV", "YUYV", 3},
+		{"RGB3", "RGB3", 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cam, err := OpenFake(DefaultFakeConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cam.Close()
+
+			if _, _, _, err = cam.SetImageFormat(EncodeFormat(tt.format), 320, 240); err != nil {
+				t.Fatal(err)
+			}
+			f, err := cam.GetImageFormat()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fds := newTestDmabufs(t, tt.count, int(f.SizeImage))
+			if err = cam.SetDmabufBuffers(fds); err != nil {
+				t.Fatal(err)
+			}
+			if err = cam.StartStreaming(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2*tt.count; i++ {
+				if err = cam.WaitForFrame(1); err != nil {
+					t.Fatal(err)
+				}
+				frame, index, err := cam.GetFrame()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(frame) != int(f.SizeImage) {
+					t.Errorf("frame has %d bytes, want %d", len(frame), f.SizeImage)
+				}
+
+				fd, err := cam.FrameFd(index)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fd != fds[index] {
+					t.Errorf("FrameFd(%d) = %d, want %d", index, fd, fds[index])
+				}
+				if !bytes.Equal(frame, mapTestDmabuf(t, fd)[:len(frame)]) {
+					t.Errorf("frame %d differs from its DMABUF", index)
+				}
+
+				if err = cam.ReleaseFrame(index); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err = cam.StopStreaming(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSetDmabufBuffersInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		fds  []int
+	}{
+		{"no buffers", []int{}},
+		{"negative descriptor", []int{-1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cam, err := OpenFake(DefaultFakeConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cam.Close()
+
+			if err = cam.SetDmabufBuffers(tt.fds); err == nil {
+				t.Error("SetDmabufBuffers succeeded")
+			}
+		})
+	}
+}
+
+func TestSetDmabufBuffersWhileStreaming(t *testing.T) {
+	cam, err := OpenFake(DefaultFakeConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cam.Close()
+
+	if err = cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	err = cam.SetDmabufBuffers(newTestDmabufs(t, 1, 4096))
+	if !errors.Is(err, ErrAlreadyStreaming) {
+		t.Errorf("SetDmabufBuffers while streaming = %v, want ErrAlreadyStreaming", err)
+	}
+}
+
+func TestExportBuffer(t *testing.T) {
+	cam, err := OpenFake(DefaultFakeConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cam.Close()
+
+	if _, err = cam.ExportBuffer(0); !errors.Is(err, ErrNotStreaming) {
+		t.Errorf("ExportBuffer before streaming = %v, want ErrNotStreaming", err)
+	}
+
+	if err = cam.SetBufferCount(2); err != nil {
+		t.Fatal(err)
+	}
+	if err = cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	frame, index, err := cam.GetFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := cam.ExportBuffer(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	if !bytes.Equal(frame, mapTestDmabuf(t, fd)[:len(frame)]) {
+		t.Error("frame differs from the exported buffer")
+	}
+
+	if _, err = cam.ExportBuffer(2); !errors.Is(err, unix.EINVAL) {
+		t.Errorf("ExportBuffer of a missing buffer = %v, want EINVAL", err)
+	}
+	if _, err = cam.FrameFd(index); err == nil {
+		t.Error("FrameFd succeeded for the mmap method")
+	}
+
+	if err = cam.ReleaseFrame(index); err != nil {
+		t.Fatal(err)
+	}
+	if err = cam.StopStreaming(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,8 +1,145 @@
 package webcam
 
+import (
+	"errors"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// Errors to be checked for with errors.Is
+var (
+	// Device does not capture video
+	ErrNotCapture = errors.New("Not a video capture device")
+	// Operation requires streaming to be started
+	ErrNotStreaming = errors.New("Not streaming")
+	// Operation is not possible while streaming
+	ErrAlreadyStreaming = errors.New("Already streaming")
+	// Device has been unplugged, reported for ENODEV
+	ErrDeviceGone = errors.New("Device is gone")
+	// Device is in use, by this or another process, reported for EBUSY
+	ErrBusy = errors.New("Device is busy")
+	// Pixel format is not supported by the device or the decoder
+	ErrUnsupportedFormat = errors.New("Unsupported format")
+	// Camera has been closed
+	ErrClosed = errors.New("Camera is closed")
+	// Frame has already been released
+	ErrFrameReleased = errors.New("Frame already released")
+	// Frame is shorter than its format and layout require
+	ErrShortFrame = errors.New("Frame is truncated")
+	// Buffer supplied by the caller, or allocated for the read I/O method
+	// before the format changed, cannot hold a frame of the current format
+	ErrBufferTooSmall = errors.New("Buffer is too small for the format")
+	// Frames have not been released in time to stop streaming
+	ErrFramesHeld = errors.New("Frames are still held")
+)
+
 // Timeout error
 type Timeout struct{}
 
 func (e *Timeout) Error() string {
 	return "Timeout occured"
 }
+
+// Failed ioctl. Matches ErrDeviceGone and ErrBusy when errno indicates so,
+// and unwraps to errno, so that errors.Is(err, unix.EINVAL) works as well
+type IoctlError struct {
+	// Name of the ioctl, e.g. VIDIOC_S_FMT
+	Name string
+	// Request code of the ioctl
+	Request uintptr
+	// Error returned by the driver
+	Errno unix.Errno
+}
+
+func (e *IoctlError) Error() string {
+	return e.Name + " failed: " + e.Errno.Error()
+}
+
+func (e *IoctlError) Unwrap() error {
+	return e.Errno
+}
+
+func (e *IoctlError) Is(target error) bool {
+	return errnoIs(e.Errno, target)
+}
+
+// Failed system call other than an ioctl, i.e. read or select.
+// Matches ErrDeviceGone and ErrBusy like IoctlError and unwraps to errno
+type SyscallError struct {
+	// Name of the system call, e.g. read
+	Name string
+	// Error returned by the system call
+	Errno unix.Errno
+}
+
+func (e *SyscallError) Error() string {
+	return e.Name + " failed: " + e.Errno.Error()
+}
+
+func (e *SyscallError) Unwrap() error {
+	return e.Errno
+}
+
+func (e *SyscallError) Is(target error) bool {
+	return errnoIs(e.Errno, target)
+}
+
+// Returns true if errno means what target does
+func errnoIs(errno unix.Errno, target error) bool {
+	switch target {
+	case ErrDeviceGone:
+		return errno == unix.ENODEV
+	case ErrBusy:
+		return errno == unix.EBUSY
+	}
+	return false
+}
+
+// Wraps errno returned by an ioctl into IoctlError, other errors are returned as is
+func ioctlError(request uintptr, err error) error {
+	errno, ok := err.(unix.Errno)
+	if !ok {
+		return err
+	}
+
+	name, ok := ioctlNames[request]
+	if !ok {
+		name = "ioctl 0x" + strconv.FormatUint(uint64(request), 16)
+	}
+	return &IoctlError{Name: name, Request: request, Errno: errno}
+}
+
+// Wraps errno returned by a system call into SyscallError, other errors are returned as is
+func syscallError(name string, err error) error {
+	errno, ok := err.(unix.Errno)
+	if !ok {
+		return err
+	}
+	return &SyscallError{Name: name, Errno: errno}
+}
+
+// Error of applying a batch of controls, see SetControls
+type ControlError struct {
+	// Control rejected by the driver, 0 if the driver could not tell
+	ID ControlID
+	// Error reported by the driver
+	Err error
+	// Error of restoring previous values, if any
+	RollbackErr error
+}
+
+func (e *ControlError) Error() string {
+	msg := "Failed to set controls: " + e.Err.Error()
+	if e.ID != 0 {
+		msg = "Failed to set control 0x" + strconv.FormatUint(uint64(e.ID), 16) + ": " + e.Err.Error()
+	}
+	if e.RollbackErr != nil {
+		msg += ", failed to restore previous values: " + e.RollbackErr.Error()
+	}
+	return msg
+}
+
+func (e *ControlError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,88 @@
+package webcam
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSyscallError(t *testing.T) {
+	tests := []struct {
+		errno unix.Errno
+		gone  bool
+		busy  bool
+	}{
+		{unix.ENODEV, true, false},
+		{unix.EBUSY, false, true},
+		{unix.EIO, false, false},
+	}
+
+	for _, tt := range tests {
+		for _, err := range []error{syscallError("read", tt.errno), ioctlError(VIDIOC_DQBUF, tt.errno)} {
+			if errors.Is(err, ErrDeviceGone) != tt.gone || errors.Is(err, ErrBusy) != tt.busy {
+				t.Errorf("%v matches gone %v and busy %v, want %v and %v",
+					err, errors.Is(err, ErrDeviceGone), errors.Is(err, ErrBusy), tt.gone, tt.busy)
+			}
+			if !errors.Is(err, tt.errno) {
+				t.Errorf("%v does not unwrap to %v", err, tt.errno)
+			}
+		}
+	}
+
+	if err := syscallError("read", io.EOF); err != io.EOF {
+		t.Errorf("syscallError of a non-errno error = %v, want it unchanged", err)
+	}
+	if err := syscallError("read", nil); err != nil {
+		t.Errorf("syscallError of no error = %v", err)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	config := readWriteTestConfig()
+	config.DisconnectAfter = 2
+	cam := openTestFake(t, config)
+
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read before the first frame is due is retried by the streaming loops
+	_, _, err := cam.GetFrame()
+	var serr *SyscallError
+	if !errors.As(err, &serr) || serr.Name != "read" || !errors.Is(err, unix.EAGAIN) {
+		t.Errorf("GetFrame before the frame is due = %v, want read failing with EAGAIN", err)
+	}
+
+	captureTestFrames(t, cam, 2, 640*480*2)
+	if err = cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = cam.GetFrame(); !errors.Is(err, ErrDeviceGone) || !errors.As(err, &serr) {
+		t.Errorf("GetFrame of an unplugged device = %v, want SyscallError matching ErrDeviceGone", err)
+	}
+}
+
+func TestSelectErrors(t *testing.T) {
+	d := newFakeDevice(DefaultFakeConfig())
+	d.setBufferType(V4L2_BUF_TYPE_VIDEO_CAPTURE)
+
+	// Buffers requested rule out the read I/O method
+	count := uint32(2)
+	if err := d.requestBuffers(V4L2_MEMORY_MMAP, &count); err != nil {
+		t.Fatal(err)
+	}
+
+	var serr *SyscallError
+	_, _, err := d.waitForFrame(0)
+	if !errors.As(err, &serr) || serr.Name != "select" || !errors.Is(err, unix.EINVAL) {
+		t.Errorf("select without streaming = %v, want EINVAL", err)
+	}
+
+	d.close()
+	_, _, err = d.waitForFrame(0)
+	if !errors.As(err, &serr) || !errors.Is(err, unix.EBADF) || errors.Is(err, ErrDeviceGone) {
+		t.Errorf("select of a closed device = %v, want EBADF", err)
+	}
+}
@@ -0,0 +1,273 @@
+package webcam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Number of control and stream events buffered for the consumer.
+// When a buffer is full, the oldest event is dropped
+const (
+	controlEventBuffer = 64
+	streamEventBuffer  = 16
+)
+
+// Kind of a stream event
+type StreamEventType int
+
+const (
+	// Source has changed, e.g. resolution of an HDMI input. Streaming has
+	// been restarted with the new format
+	SourceChange StreamEventType = iota
+	// Last frame of the stream has been captured
+	EndOfStream
+)
+
+// Event of the stream reported by the driver
+type StreamEvent struct {
+	Type StreamEventType
+	// What has changed on a source change, see V4L2_EVENT_SRC_CH_* constants
+	Changes uint32
+	// Image format streaming was restarted with after a source change
+	Format PixelFormat
+	Width  uint32
+	Height uint32
+	// Error restarting the stream after a source change, streaming is
+	// stopped if set. ErrBufferTooSmall if user or DMABUF buffers
+	// cannot hold frames of the new format
+	Err error
+}
+
+// Change of a control reported by the driver
+type ControlEvent struct {
+	ID ControlID
+	// What has changed, see V4L2_EVENT_CTRL_CH_* constants
+	Changes uint32
+	// Control type, see V4L2_CTRL_TYPE_* constants
+	Type  uint32
+	Value int64
+	// Control flags, see V4L2_CTRL_FLAG_* constants
+	Flags   uint32
+	Min     int64
+	Max     int64
+	Step    int64
+	Default int64
+	// Sequence number of the event, gaps indicate events lost by the driver
+	Sequence uint32
+	// Time the event was raised, on the monotonic clock
+	Timestamp time.Duration
+}
+
+// Subscribe to changes of the given controls, or of all controls if none
+// are given. Events are delivered on the channel returned by ControlEvents
+// while frames are waited for with WaitForFrame, Stream or StreamFunc.
+// The current state of each control is sent right away, controls already
+// subscribed to are skipped. Changes made through this Camera are not reported
+func (w *Camera) SubscribeControlEvents(ids ...ControlID) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	if len(ids) == 0 {
+		for _, c := range w.dev.queryControls() {
+			ids = append(ids, ControlID(c.id))
+		}
+	}
+
+	for _, id := range ids {
+		if _, ok := w.ctrlSubs[uint32(id)]; ok {
+			continue
+		}
+
+		err := w.dev.subscribeEvent(V4L2_EVENT_CTRL, uint32(id), V4L2_EVENT_SUB_FL_SEND_INITIAL)
+
+		if err != nil {
+			return fmt.Errorf("Failed to subscribe to control events: %w", err)
+		}
+
+		w.ctrlSubs[uint32(id)] = struct{}{}
+	}
+
+	return nil
+}
+
+// Unsubscribe from all control events
+func (w *Camera) UnsubscribeControlEvents() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	var err error
+
+	for id := range w.ctrlSubs {
+		if e := w.dev.unsubscribeEvent(V4L2_EVENT_CTRL, id); e != nil && err == nil {
+			err = e
+		}
+	}
+	w.ctrlSubs = make(map[uint32]struct{})
+
+	return err
+}
+
+// Returns channel delivering control events, see SubscribeControlEvents
+func (w *Camera) ControlEvents() <-chan ControlEvent {
+	return w.ctrlEvents
+}
+
+// Returns channel delivering source change and end of stream events.
+// Camera subscribes to these events when streaming starts, if the driver
+// supports them. After a source change, streaming is restarted by
+// WaitForFrame, or when the last frame held by the consumer is released
+func (w *Camera) StreamEvents() <-chan StreamEvent {
+	return w.streamEvents
+}
+
+// Subscribe to source change and end of stream events,
+// most drivers don't support them, so failures are ignored
+func (w *Camera) subscribeStreamEvents() {
+	if w.streamSubs {
+		return
+	}
+	w.streamSubs = true
+
+	w.dev.subscribeEvent(V4L2_EVENT_SOURCE_CHANGE, 0, 0)
+	w.dev.subscribeEvent(V4L2_EVENT_EOS, 0, 0)
+}
+
+// Dequeue all pending events and deliver them to the consumer.
+// Streaming is restarted if the source has changed
+func (w *Camera) dispatchEvents() error {
+	for pending := true; pending; {
+		event, err := w.dev.dequeueEvent()
+
+		if errors.Is(err, unix.ENOENT) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch event._type {
+		case V4L2_EVENT_CTRL:
+			ctrl, err := newControlEvent(&event)
+
+			if err != nil {
+				return err
+			}
+
+			w.deliverControlEvent(ctrl)
+
+		case V4L2_EVENT_SOURCE_CHANGE:
+			w.sourceChanged = true
+			w.sourceChanges |= NativeByteOrder.Uint32(event.union.data[:])
+
+		case V4L2_EVENT_EOS:
+			w.endOfStream = true
+			w.deliverStreamEvent(StreamEvent{Type: EndOfStream})
+		}
+
+		pending = event.pending > 0
+	}
+
+	return w.restartOnSourceChange()
+}
+
+// Renegotiate after a source change, once no frame refers to the buffers
+func (w *Camera) restartOnSourceChange() error {
+	if !w.sourceChanged || !w.streaming || w.heldFrames() > 0 {
+		return nil
+	}
+
+	changes := w.sourceChanges
+	w.sourceChanged = false
+	w.sourceChanges = 0
+	return w.renegotiate(changes)
+}
+
+// Restart streaming with buffers reallocated for the new format of the source
+func (w *Camera) renegotiate(changes uint32) error {
+	event := StreamEvent{Type: SourceChange, Changes: changes}
+
+	event.Err = w.stopStreaming()
+
+	if event.Err == nil {
+		event.Format, event.Width, event.Height, event.Err = w.imageFormat()
+	}
+
+	if event.Err == nil {
+		event.Err = w.startStreaming()
+	}
+
+	w.deliverStreamEvent(event)
+	return event.Err
+}
+
+func (w *Camera) deliverStreamEvent(event StreamEvent) {
+	for {
+		select {
+		case w.streamEvents <- event:
+			return
+		default:
+		}
+
+		select {
+		case <-w.streamEvents:
+		default:
+		}
+	}
+}
+
+func (w *Camera) deliverControlEvent(event ControlEvent) {
+	for {
+		select {
+		case w.ctrlEvents <- event:
+			return
+		default:
+		}
+
+		select {
+		case <-w.ctrlEvents:
+		default:
+		}
+	}
+}
+
+func newControlEvent(event *v4l2_event) (ControlEvent, error) {
+	ctrl := &v4l2_event_ctrl{}
+	err := binary.Read(bytes.NewBuffer(event.union.data[:]), NativeByteOrder, ctrl)
+
+	if err != nil {
+		return ControlEvent{}, err
+	}
+
+	var value int64
+	if ctrl.Type == V4L2_CTRL_TYPE_INTEGER64 {
+		value = int64(NativeByteOrder.Uint64(ctrl.Value[:]))
+	} else {
+		value = controlValue32(ctrl.Type, NativeByteOrder.Uint32(ctrl.Value[:]))
+	}
+
+	return ControlEvent{
+		ID:        ControlID(event.id),
+		Changes:   ctrl.Changes,
+		Type:      ctrl.Type,
+		Value:     value,
+		Flags:     ctrl.Flags,
+		Min:       controlValue32(ctrl.Type, uint32(ctrl.Minimum)),
+		Max:       controlValue32(ctrl.Type, uint32(ctrl.Maximum)),
+		Step:      int64(ctrl.Step),
+		Default:   controlValue32(ctrl.Type, uint32(ctrl.Default_value)),
+		Sequence:  event.sequence,
+		Timestamp: time.Duration(event.timestamp.Nano()),
+	}, nil
+}
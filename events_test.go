@@ -0,0 +1,263 @@
+package webcam
+
+import (
+	"errors"
+	"testing"
+)
+
+// Source of the fake changes from 320x240 to 640x480 after a few frames
+func sourceChangeTestCamera(t *testing.T) *Camera {
+	t.Helper()
+
+	config := DefaultFakeConfig()
+	config.SourceChangeAfter = 3
+	cam := openTestFake(t, config)
+
+	if _, _, _, err := cam.SetImageFormat(EncodeFormat("YUYV"), 320, 240); err != nil {
+		t.Fatal(err)
+	}
+	return cam
+}
+
+// Dequeues and holds frames until the source change is noticed
+func holdFramesUntilSourceChange(t *testing.T, cam *Camera) []*Frame {
+	t.Helper()
+
+	var held []*Frame
+	for {
+		err := cam.WaitForFrame(1)
+		if _, ok := err.(*Timeout); ok {
+			return held
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		frame, err := cam.GetFrameWithMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, frame)
+	}
+}
+
+func TestSourceChangeAfterRelease(t *testing.T) {
+	const size = 640 * 480 * 2
+
+	tests := []struct {
+		name  string
+		setup func(cam *Camera) error
+	}{
+		{"mmap", func(cam *Camera) error {
+			return cam.SetBufferCount(4)
+		}},
+		{"user buffers", func(cam *Camera) error {
+			buffers := make([][]byte, 4)
+			for i := range buffers {
+				buffers[i] = make([]byte, size)
+			}
+			return cam.SetUserBuffers(buffers)
+		}},
+		{"DMABUF buffers", func(cam *Camera) error {
+			return cam.SetDmabufBuffers(newTestDmabufs(t, 4, size))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cam := sourceChangeTestCamera(t)
+
+			if err := tt.setup(cam); err != nil {
+				t.Fatal(err)
+			}
+			if err := cam.StartStreaming(); err != nil {
+				t.Fatal(err)
+			}
+
+			held := holdFramesUntilSourceChange(t, cam)
+			if len(held) != 3 {
+				t.Fatalf("got %d frames before the source change, want 3", len(held))
+			}
+			if len(cam.StreamEvents()) != 0 {
+				t.Fatal("streaming restarted while frames are held")
+			}
+
+			for _, frame := range held {
+				if err := frame.Release(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			select {
+			case e := <-cam.StreamEvents():
+				if e.Type != SourceChange || e.Err != nil || e.Width != 640 || e.Height != 480 {
+					t.Errorf("got event %+v, want restart at 640x480", e)
+				}
+			default:
+				t.Fatal("streaming not restarted once frames are released")
+			}
+
+			captureTestFrames(t, cam, 2, size)
+		})
+	}
+}
+
+func TestSourceChangeBuffersTooSmall(t *testing.T) {
+	const size = 320 * 240 * 2
+
+	tests := []struct {
+		name  string
+		setup func(cam *Camera) error
+	}{
+		{"user buffers", func(cam *Camera) error {
+			return cam.SetUserBuffers([][]byte{make([]byte, size), make([]byte, size)})
+		}},
+		{"DMABUF buffers", func(cam *Camera) error {
+			return cam.SetDmabufBuffers(newTestDmabufs(t, 2, size))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cam := sourceChangeTestCamera(t)
+
+			if err := tt.setup(cam); err != nil {
+				t.Fatal(err)
+			}
+			if err := cam.StartStreaming(); err != nil {
+				t.Fatal(err)
+			}
+
+			var err error
+			for err == nil {
+				if err = cam.WaitForFrame(1); err == nil {
+					var frame *Frame
+					if frame, err = cam.GetFrameWithMetadata(); err == nil {
+						err = frame.Release()
+					}
+				}
+			}
+			if !errors.Is(err, ErrBufferTooSmall) {
+				t.Errorf("got %v, want ErrBufferTooSmall", err)
+			}
+
+			e := <-cam.StreamEvents()
+			if e.Type != SourceChange || !errors.Is(e.Err, ErrBufferTooSmall) {
+				t.Errorf("got event %+v, want failed restart", e)
+			}
+			if err = cam.WaitForFrame(1); !errors.Is(err, ErrNotStreaming) {
+				t.Errorf("WaitForFrame after failed restart = %v, want ErrNotStreaming", err)
+			}
+		})
+	}
+}
+
+// Returns control events delivered so far
+func receivedControlEvents(cam *Camera) []ControlEvent {
+	var events []ControlEvent
+	for {
+		select {
+		case e := <-cam.ControlEvents():
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestControlEvents(t *testing.T) {
+	brightness, exposure := ControlID(V4L2_CID_BASE), ControlID(V4L2_CID_EXPOSURE_ABSOLUTE)
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	if err := cam.SubscribeControlEvents(brightness, exposure); err != nil {
+		t.Fatal(err)
+	}
+	if events := receivedControlEvents(cam); len(events) != 0 {
+		t.Fatalf("%d events delivered before waiting for a frame", len(events))
+	}
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Initial state of each control arrives with the first wait
+	if err := cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	events := receivedControlEvents(cam)
+	if len(events) != 2 {
+		t.Fatalf("got %d initial events, want 2", len(events))
+	}
+	for i, want := range []struct {
+		id    ControlID
+		value int64
+	}{{brightness, 128}, {exposure, 250}} {
+		e := events[i]
+		if e.ID != want.id || e.Value != want.value || e.Changes != V4L2_EVENT_CTRL_CH_VALUE|V4L2_EVENT_CTRL_CH_FLAGS {
+			t.Errorf("initial event %d is %#x = %d with changes %#x, want %#x = %d with value and flags",
+				i, e.ID, e.Value, e.Changes, want.id, want.value)
+		}
+	}
+
+	// Repeated subscription neither subscribes twice nor resends the state
+	if err := cam.SubscribeControlEvents(brightness); err != nil {
+		t.Fatal(err)
+	}
+	if len(cam.ctrlSubs) != 2 {
+		t.Errorf("%d controls subscribed to, want 2", len(cam.ctrlSubs))
+	}
+
+	// Own changes are not reported, the drifting auto exposure is
+	if err := cam.SetControl(brightness, 10); err != nil {
+		t.Fatal(err)
+	}
+	captureTestFrames(t, cam, 16, 0)
+	if err := cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	events = receivedControlEvents(cam)
+	if len(events) == 0 {
+		t.Fatal("no event of the auto exposure")
+	}
+	for _, e := range events {
+		if e.ID != exposure || e.Changes != V4L2_EVENT_CTRL_CH_VALUE {
+			t.Errorf("event of %#x with changes %#x, want value changes of exposure only", e.ID, e.Changes)
+		}
+	}
+
+	if err := cam.UnsubscribeControlEvents(); err != nil {
+		t.Fatal(err)
+	}
+	captureTestFrames(t, cam, 16, 0)
+	if err := cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	if events = receivedControlEvents(cam); len(events) != 0 {
+		t.Errorf("%d events delivered after unsubscribing", len(events))
+	}
+}
+
+func TestControlEventsAllControls(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	if err := cam.SubscribeControlEvents(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	if events := receivedControlEvents(cam); len(events) != len(DefaultFakeConfig().Controls) {
+		t.Errorf("got %d initial events, want one per control", len(events))
+	}
+
+	if err := cam.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.SubscribeControlEvents(); !errors.Is(err, ErrClosed) {
+		t.Errorf("SubscribeControlEvents after Close = %v, want ErrClosed", err)
+	}
+	if err := cam.UnsubscribeControlEvents(); !errors.Is(err, ErrClosed) {
+		t.Errorf("UnsubscribeControlEvents after Close = %v, want ErrClosed", err)
+	}
+}
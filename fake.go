@@ -0,0 +1,1676 @@
+package webcam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Image format offered by a fake camera
+type FakeFormat struct {
+	Format      PixelFormat
+	Description string
+	// Frame sizes available for the format
+	Sizes []FrameSize
+	// Frame intervals available for every frame size of the format
+	Intervals []FrameInterval
+}
+
+// Control offered by a fake camera
+type FakeControl struct {
+	ID    ControlID
+	Name  string
+	Min   int64
+	Max   int64
+	Value int64
+	// One of V4L2_CTRL_TYPE_INTEGER, _INTEGER64, _BOOLEAN, _MENU, _BUTTON,
+	// _BITMASK or _STRING. Controls without a type are booleans for
+	// the range 0..1 and integers otherwise. Max of bitmasks holds
+	// the bits that may be set
+	Type uint32
+	// Step between valid values, 1 if not set
+	Step int64
+	// Control flags, see V4L2_CTRL_FLAG_* constants
+	Flags uint32
+	// Names of menu items starting at Min, empty names mark items
+	// the device skips
+	Menu []string
+	// Value of a string control, Min and Max limit its length
+	Text string
+	// Number of times setting the control fails with EIO after the
+	// controls before it were set, like a write the hardware rejects
+	FailSets int
+}
+
+// Configuration of a fake camera
+// Formats are listed in the order they are enumerated, the first
+// format, size and interval are the initial settings of the camera
+type FakeConfig struct {
+	Card     string
+	Formats  []FakeFormat
+	Controls []FakeControl
+	// Device supports only the read() I/O method and no streaming
+	ReadWriteOnly bool
+	// Device supports only the multiplanar API. Formats NM12, NM21, YM12
+	// and YM21 are delivered in separate planes
+	Multiplanar bool
+	// Number of frames after which the source switches to the next frame
+	// size of the current format and stops delivering frames until streaming
+	// is restarted, raising a source change event. With the read I/O method
+	// the next frame comes in the new size instead. 0 disables source changes
+	SourceChangeAfter uint32
+	// Number of frames after which the stream ends, raising an end
+	// of stream event. 0 disables the end of stream
+	EndOfStreamAfter uint32
+	// Number of frames after which the device disappears like an unplugged
+	// USB camera, failing with ENODEV. 0 keeps the device connected
+	DisconnectAfter uint32
+	// Every how many frames a frame is delivered flagged with
+	// V4L2_BUF_FLAG_ERROR, like one corrupted in transfer. 0 delivers
+	// no corrupted frames
+	ErrorEvery uint32
+	// Bytes of padding the driver adds to every line of packed formats like
+	// YUYV and RGB3 with the single-planar API, like drivers aligning lines
+	// for DMA. Planar and compressed formats are not padded
+	LinePadding uint32
+}
+
+// Returns configuration of a fake camera that offers YUYV, RGB3 and MJPG
+// formats at 640x480 and 320x240, with 5, 15 and 30 fps and a handful of
+// common image, exposure and focus controls
+func DefaultFakeConfig() FakeConfig {
+	sizes := []FrameSize{
+		{MinWidth: 640, MaxWidth: 640, MinHeight: 480, MaxHeight: 480},
+		{MinWidth: 320, MaxWidth: 320, MinHeight: 240, MaxHeight: 240},
+	}
+	intervals := []FrameInterval{
+		{MinInterval: Fraction{1, 30}, MaxInterval: Fraction{1, 30}},
+		{MinInterval: Fraction{1, 15}, MaxInterval: Fraction{1, 15}},
+		{MinInterval: Fraction{1, 5}, MaxInterval: Fraction{1, 5}},
+	}
+	return FakeConfig{
+		Card: "Fake Camera",
+		Formats: []FakeFormat{
+			{EncodeFormat("YUYV"), "YUYV 4:2:2", sizes, intervals},
+			{EncodeFormat("RGB3"), "RGB3", sizes, intervals},
+			{EncodeFormat("MJPG"), "Motion-JPEG", sizes, intervals},
+		},
+		Controls: []FakeControl{
+			{ID: ControlID(V4L2_CID_BASE), Name: "Brightness", Min: 0, Max: 255, Value: 128},
+			{ID: ControlID(V4L2_CID_BASE + 1), Name: "Contrast", Min: 0, Max: 255, Value: 128},
+			{ID: ControlID(V4L2_CID_BASE + 2), Name: "Saturation", Min: 0, Max: 255, Value: 128},
+			{ID: ControlID(V4L2_CID_AUTO_WHITE_BALANCE), Name: "White Balance Temperature, Auto", Min: 0, Max: 1, Value: 1},
+			{ID: ControlID(V4L2_CID_EXPOSURE_AUTO), Name: "Exposure, Auto", Min: 0, Max: 3, Value: 3,
+				Type: V4L2_CTRL_TYPE_MENU, Menu: []string{"", "Manual Mode", "", "Aperture Priority Mode"}},
+			{ID: ControlID(V4L2_CID_EXPOSURE_ABSOLUTE), Name: "Exposure (Absolute)", Min: 3, Max: 2047, Value: 250},
+			{ID: ControlID(V4L2_CID_FOCUS_ABSOLUTE), Name: "Focus (absolute)", Min: 0, Max: 250, Step: 5, Value: 0},
+			{ID: ControlID(V4L2_CID_FOCUS_AUTO), Name: "Focus, Auto", Min: 0, Max: 1, Value: 1},
+		},
+	}
+}
+
+// Open a fake camera that produces synthetic frames according to config.
+// Fake camera does not need any hardware and may be used to test
+// capture pipelines
+func OpenFake(config FakeConfig) (*Camera, error) {
+	return newCamera(newFakeDevice(config))
+}
+
+// In-memory device backend producing moving color bars
+type fakeDevice struct {
+	mutex  sync.Mutex
+	config FakeConfig
+
+	format   uint32
+	width    uint32
+	height   uint32
+	interval Fraction
+	controls map[uint32]int64
+	texts    map[uint32]string
+	// Failures of setting a control still to come, see FakeControl.FailSets
+	failSets map[uint32]int
+
+	// Event subscriptions keyed by type and id, with subscription flags
+	subscriptions map[[2]uint32]uint32
+	events        []v4l2_event
+	eventSequence uint32
+
+	bufType uint32
+	memory  uint32
+	buffers [][]byte
+	planes  [][][]byte
+	fds     []int
+	// Size of frames of the format buffers were requested for
+	frameSize int
+	planeFds  [][]int
+	queue     []uint32
+	streaming bool
+	reading   bool
+	sequence  uint32
+	nextFrame time.Time
+	closed    bool
+
+	// Frames delivered since streaming started, no more frames are
+	// delivered once halted by a source change or end of stream
+	produced     uint32
+	halted       bool
+	gone         bool
+	sourceChange bool
+}
+
+func newFakeDevice(config FakeConfig) *fakeDevice {
+	d := &fakeDevice{config: config}
+	d.controls = make(map[uint32]int64)
+	d.texts = make(map[uint32]string)
+	d.failSets = make(map[uint32]int)
+	d.subscriptions = make(map[[2]uint32]uint32)
+	for _, c := range config.Controls {
+		d.controls[uint32(c.ID)] = c.Value
+		d.texts[uint32(c.ID)] = c.Text
+		d.failSets[uint32(c.ID)] = c.FailSets
+	}
+	d.interval = Fraction{1, 30}
+	if len(config.Formats) > 0 {
+		f := config.Formats[0]
+		d.format = uint32(f.Format)
+		if len(f.Sizes) > 0 {
+			d.width = f.Sizes[0].MaxWidth
+			d.height = f.Sizes[0].MaxHeight
+		}
+		if len(f.Intervals) > 0 {
+			d.interval = f.Intervals[0].MinInterval
+		}
+	}
+	return d
+}
+
+func (d *fakeDevice) findFormat(code uint32) *FakeFormat {
+	for i := range d.config.Formats {
+		if uint32(d.config.Formats[i].Format) == code {
+			return &d.config.Formats[i]
+		}
+	}
+	return nil
+}
+
+func (d *fakeDevice) checkCapabilities() (uint32, string, error) {
+	if d.closed {
+		return 0, "", ioctlError(VIDIOC_QUERYCAP, unix.EBADF)
+	}
+	if d.config.Multiplanar {
+		return V4L2_CAP_VIDEO_CAPTURE_MPLANE | V4L2_CAP_STREAMING, d.config.Card, nil
+	}
+	capabilities := V4L2_CAP_VIDEO_CAPTURE | V4L2_CAP_READWRITE
+	if !d.config.ReadWriteOnly {
+		capabilities |= V4L2_CAP_STREAMING
+	}
+	return capabilities, d.config.Card, nil
+}
+
+func (d *fakeDevice) setBufferType(bufType uint32) {
+	d.bufType = bufType
+}
+
+func (d *fakeDevice) multiplanar() bool {
+	return d.bufType == V4L2_BUF_TYPE_VIDEO_CAPTURE_MPLANE
+}
+
+func (d *fakeDevice) getPixelFormat(index uint32) (uint32, string, error) {
+	if int(index) >= len(d.config.Formats) {
+		return 0, "", ioctlError(VIDIOC_ENUM_FMT, unix.EINVAL)
+	}
+	f := d.config.Formats[index]
+	return uint32(f.Format), f.Description, nil
+}
+
+func (d *fakeDevice) getFrameSize(index uint32, code uint32) (FrameSize, error) {
+	f := d.findFormat(code)
+	if f == nil || int(index) >= len(f.Sizes) {
+		return FrameSize{}, ioctlError(VIDIOC_ENUM_FRAMESIZES, unix.EINVAL)
+	}
+	return f.Sizes[index], nil
+}
+
+func (d *fakeDevice) getFrameInterval(index uint32, code uint32, width uint32, height uint32) (FrameInterval, error) {
+	f := d.findFormat(code)
+	if f == nil || int(index) >= len(f.Intervals) {
+		return FrameInterval{}, ioctlError(VIDIOC_ENUM_FRAMEINTERVALS, unix.EINVAL)
+	}
+	for _, s := range f.Sizes {
+		if fitsFrameSize(s, width, height) {
+			return f.Intervals[index], nil
+		}
+	}
+	return FrameInterval{}, ioctlError(VIDIOC_ENUM_FRAMEINTERVALS, unix.EINVAL)
+}
+
+func fitsFrameSize(s FrameSize, width uint32, height uint32) bool {
+	return width >= s.MinWidth && width <= s.MaxWidth &&
+		height >= s.MinHeight && height <= s.MaxHeight
+}
+
+func (d *fakeDevice) getImageFormat() (v4l2_pix_format, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.multiplanar() {
+		return v4l2_pix_format{}, ioctlError(VIDIOC_G_FMT, unix.EINVAL)
+	}
+	return d.pixFormat(d.format, d.width, d.height), nil
+}
+
+func (d *fakeDevice) setImageFormat(pix *v4l2_pix_format) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.multiplanar() {
+		return ioctlError(VIDIOC_S_FMT, unix.EINVAL)
+	}
+	if err := d.selectFormat(pix.Pixelformat, pix.Width, pix.Height); err != nil {
+		return err
+	}
+	*pix = d.pixFormat(d.format, d.width, d.height)
+	return nil
+}
+
+func (d *fakeDevice) tryImageFormat(pix *v4l2_pix_format) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.multiplanar() {
+		return ioctlError(VIDIOC_TRY_FMT, unix.EINVAL)
+	}
+	code, width, height, err := d.fitFormat(VIDIOC_TRY_FMT, pix.Pixelformat, pix.Width, pix.Height)
+	if err != nil {
+		return err
+	}
+	*pix = d.pixFormat(code, width, height)
+	return nil
+}
+
+func (d *fakeDevice) getImageFormatMplane() (v4l2_pix_format_mplane, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.multiplanar() {
+		return v4l2_pix_format_mplane{}, ioctlError(VIDIOC_G_FMT, unix.EINVAL)
+	}
+	return fakePixFormatMplane(d.format, d.width, d.height), nil
+}
+
+func (d *fakeDevice) setImageFormatMplane(pix *v4l2_pix_format_mplane) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.multiplanar() {
+		return ioctlError(VIDIOC_S_FMT, unix.EINVAL)
+	}
+	if err := d.selectFormat(pix.Pixelformat, pix.Width, pix.Height); err != nil {
+		return err
+	}
+	*pix = fakePixFormatMplane(d.format, d.width, d.height)
+	return nil
+}
+
+func (d *fakeDevice) tryImageFormatMplane(pix *v4l2_pix_format_mplane) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.multiplanar() {
+		return ioctlError(VIDIOC_TRY_FMT, unix.EINVAL)
+	}
+	code, width, height, err := d.fitFormat(VIDIOC_TRY_FMT, pix.Pixelformat, pix.Width, pix.Height)
+	if err != nil {
+		return err
+	}
+	*pix = fakePixFormatMplane(code, width, height)
+	return nil
+}
+
+// Switches to the closest supported format and size
+func (d *fakeDevice) selectFormat(formatcode uint32, width uint32, height uint32) error {
+	if d.streaming {
+		return ioctlError(VIDIOC_S_FMT, unix.EBUSY)
+	}
+
+	code, width, height, err := d.fitFormat(VIDIOC_S_FMT, formatcode, width, height)
+	if err != nil {
+		return err
+	}
+
+	d.format = code
+	d.width = width
+	d.height = height
+	return nil
+}
+
+// Picks the closest supported format and size, the way drivers do
+func (d *fakeDevice) fitFormat(request uintptr, formatcode uint32, width uint32, height uint32) (uint32, uint32, uint32, error) {
+	f := d.findFormat(formatcode)
+	if f == nil {
+		if len(d.config.Formats) == 0 {
+			return 0, 0, 0, ioctlError(request, unix.EINVAL)
+		}
+		f = &d.config.Formats[0]
+	}
+
+	var best FrameSize
+	bestDistance := int64(math.MaxInt64)
+	for _, s := range f.Sizes {
+		w := clampStep(width, s.MinWidth, s.MaxWidth, s.StepWidth)
+		h := clampStep(height, s.MinHeight, s.MaxHeight, s.StepHeight)
+		distance := abs64(int64(w)-int64(width)) + abs64(int64(h)-int64(height))
+		if distance < bestDistance {
+			bestDistance = distance
+			best = FrameSize{MinWidth: w, MaxWidth: w, MinHeight: h, MaxHeight: h}
+		}
+	}
+	if bestDistance == math.MaxInt64 {
+		return 0, 0, 0, ioctlError(request, unix.EINVAL)
+	}
+
+	return uint32(f.Format), best.MaxWidth, best.MaxHeight, nil
+}
+
+func clampStep(value, min, max, step uint32) uint32 {
+	if value < min {
+		value = min
+	}
+	if value > max {
+		value = max
+	}
+	if step > 0 {
+		value = min + (value-min)/step*step
+	}
+	return value
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func (d *fakeDevice) getStreamParm() (v4l2_captureparm, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	parm := v4l2_captureparm{}
+	parm.Capability = V4L2_CAP_TIMEPERFRAME
+	parm.Timeperframe = v4l2_fract{d.interval.Numerator, d.interval.Denominator}
+	return parm, nil
+}
+
+// Picks the supported frame interval closest to the requested one
+func (d *fakeDevice) setStreamParm(parm *v4l2_captureparm) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	requested := Fraction{parm.Timeperframe.Numerator, parm.Timeperframe.Denominator}.FPS()
+	if requested <= 0 {
+		return ioctlError(VIDIOC_S_PARM, unix.EINVAL)
+	}
+
+	f := d.findFormat(d.format)
+	if f != nil && len(f.Intervals) > 0 {
+		best := f.Intervals[0].MinInterval
+		for _, i := range f.Intervals {
+			candidate := i.MinInterval
+			if i.StepInterval.Denominator != 0 {
+				// Stepwise range, the requested interval is accepted as is if it fits
+				fps := requested
+				if fps <= i.MinInterval.FPS() && fps >= i.MaxInterval.FPS() {
+					candidate = Fraction{parm.Timeperframe.Numerator, parm.Timeperframe.Denominator}
+				}
+			}
+			if math.Abs(float64(candidate.FPS()-requested)) < math.Abs(float64(best.FPS()-requested)) {
+				best = candidate
+			}
+		}
+		d.interval = best
+	} else {
+		d.interval = Fraction{parm.Timeperframe.Numerator, parm.Timeperframe.Denominator}
+	}
+
+	parm.Capability = V4L2_CAP_TIMEPERFRAME
+	parm.Timeperframe = v4l2_fract{d.interval.Numerator, d.interval.Denominator}
+	return nil
+}
+
+func (d *fakeDevice) requestBuffers(memory uint32, buf_count *uint32) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.streaming {
+		return ioctlError(VIDIOC_REQBUFS, unix.EBUSY)
+	}
+	if d.config.ReadWriteOnly {
+		return ioctlError(VIDIOC_REQBUFS, unix.EINVAL)
+	}
+	if memory != V4L2_MEMORY_MMAP && memory != V4L2_MEMORY_USERPTR && memory != V4L2_MEMORY_DMABUF {
+		return ioctlError(VIDIOC_REQBUFS, unix.EINVAL)
+	}
+	d.freeBuffers()
+	d.memory = memory
+	// Real drivers cap the number of buffers as well
+	if *buf_count > 32 {
+		*buf_count = 32
+	}
+	if d.multiplanar() {
+		if memory != V4L2_MEMORY_MMAP {
+			return ioctlError(VIDIOC_REQBUFS, unix.EINVAL)
+		}
+		d.planes = make([][][]byte, *buf_count)
+		d.planeFds = make([][]int, *buf_count)
+	}
+	d.buffers = make([][]byte, *buf_count)
+	d.fds = make([]int, *buf_count)
+	for i := range d.fds {
+		d.fds[i] = -1
+	}
+	d.frameSize = d.bufferSize()
+	d.queue = nil
+	return nil
+}
+
+// Frees memory backing the buffers. Mappings of mmap buffers are
+// released by Camera through releaseBuffer, like with a real device
+func (d *fakeDevice) freeBuffers() {
+	for i, fd := range d.fds {
+		if fd < 0 {
+			continue
+		}
+		switch d.memory {
+		case V4L2_MEMORY_MMAP:
+			unix.Munmap(d.buffers[i])
+			unix.Close(fd)
+		case V4L2_MEMORY_DMABUF:
+			unix.Munmap(d.buffers[i])
+		}
+	}
+	for i, fds := range d.planeFds {
+		for p, fd := range fds {
+			unix.Munmap(d.planes[i][p])
+			unix.Close(fd)
+		}
+	}
+	d.buffers = nil
+	d.planes = nil
+	d.fds = nil
+	d.planeFds = nil
+}
+
+// Allocates memory of a buffer, backed by memfd, so that it can be exported
+// as DMABUF. The fake renders into the returned mapping, like a driver
+// through the kernel mapping, while Camera maps the buffer on its own
+func newFakeBuffer(size int) (int, []byte, error) {
+	fd, err := unix.MemfdCreate("webcam-fake", unix.MFD_CLOEXEC)
+	if err != nil {
+		return -1, nil, err
+	}
+	if err = unix.Ftruncate(fd, int64(size)); err != nil {
+		unix.Close(fd)
+		return -1, nil, err
+	}
+	buffer, err := mapFakeBuffer(fd, size)
+	if err != nil {
+		unix.Close(fd)
+		return -1, nil, err
+	}
+	return fd, buffer, nil
+}
+
+func mapFakeBuffer(fd int, size int) ([]byte, error) {
+	return unix.Mmap(fd, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+}
+
+func (d *fakeDevice) queryBuffer(index uint32, length *uint32) ([]byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if int(index) >= len(d.buffers) || d.memory != V4L2_MEMORY_MMAP || d.multiplanar() {
+		return nil, ioctlError(VIDIOC_QUERYBUF, unix.EINVAL)
+	}
+	if d.fds[index] < 0 {
+		fd, buffer, err := newFakeBuffer(d.bufferSize())
+		if err != nil {
+			return nil, err
+		}
+		d.buffers[index] = buffer
+		d.fds[index] = fd
+	}
+
+	*length = uint32(len(d.buffers[index]))
+	return mapFakeBuffer(d.fds[index], len(d.buffers[index]))
+}
+
+func (d *fakeDevice) dequeueBuffer(memory uint32) (v4l2_buffer, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	buffer := v4l2_buffer{}
+
+	if d.gone {
+		return buffer, ioctlError(VIDIOC_DQBUF, unix.ENODEV)
+	}
+	if !d.streaming || d.reading || memory != d.memory || d.multiplanar() {
+		return buffer, ioctlError(VIDIOC_DQBUF, unix.EINVAL)
+	}
+	if len(d.queue) == 0 || d.halted || time.Now().Before(d.nextFrame) {
+		return buffer, ioctlError(VIDIOC_DQBUF, unix.EAGAIN)
+	}
+
+	i := d.queue[0]
+	if len(d.buffers[i]) < d.bufferSize() {
+		return buffer, ioctlError(VIDIOC_DQBUF, unix.EFAULT)
+	}
+	d.queue = d.queue[1:]
+
+	buffer.length = uint32(len(d.buffers[i]))
+	d.dropLateFrames()
+	d.fillBuffer(&buffer, i)
+	buffer.bytesused = uint32(d.renderFrame(d.buffers[i]))
+	d.frameDelivered()
+
+	return buffer, nil
+}
+
+// Counts a delivered frame and simulates source changes and
+// the end of stream
+func (d *fakeDevice) frameDelivered() {
+	d.produced++
+
+	if d.config.DisconnectAfter > 0 && d.produced == d.config.DisconnectAfter {
+		d.gone = true
+		return
+	}
+
+	if d.config.EndOfStreamAfter > 0 && d.produced == d.config.EndOfStreamAfter {
+		d.halted = true
+		d.notifyStream(V4L2_EVENT_EOS, 0)
+		return
+	}
+
+	if d.config.SourceChangeAfter > 0 && d.produced == d.config.SourceChangeAfter {
+		// Readers get the new size with the next frame
+		if d.reading {
+			d.sourceChange = true
+			return
+		}
+		d.halted = true
+		d.changeSource()
+	}
+}
+
+// Switches the source to the next frame size of the current format
+func (d *fakeDevice) changeSource() {
+	for _, f := range d.config.Formats {
+		if uint32(f.Format) != d.format || len(f.Sizes) == 0 {
+			continue
+		}
+		next := f.Sizes[0]
+		for i, size := range f.Sizes {
+			if size.MaxWidth == d.width && size.MaxHeight == d.height {
+				next = f.Sizes[(i+1)%len(f.Sizes)]
+			}
+		}
+		d.width = next.MaxWidth
+		d.height = next.MaxHeight
+	}
+	d.notifyStream(V4L2_EVENT_SOURCE_CHANGE, V4L2_EVENT_SRC_CH_RESOLUTION)
+}
+
+// Queues a source change or end of stream event if subscribed to
+func (d *fakeDevice) notifyStream(eventType uint32, changes uint32) {
+	if _, ok := d.subscriptions[[2]uint32{eventType, 0}]; !ok {
+		return
+	}
+
+	event := v4l2_event{_type: eventType}
+	NativeByteOrder.PutUint32(event.union.data[:], changes)
+	d.queueEvent(event)
+}
+
+// Fills in metadata of a dequeued buffer, sequence refers to the frame
+// about to be rendered
+func (d *fakeDevice) fillBuffer(buffer *v4l2_buffer, index uint32) {
+	buffer._type = d.bufType
+	buffer.memory = d.memory
+	buffer.index = index
+	buffer.field = V4L2_FIELD_NONE
+	buffer.flags = V4L2_BUF_FLAG_TIMESTAMP_MONOTONIC | V4L2_BUF_FLAG_TSTAMP_SRC_EOF
+	if f := DecodeFormat(PixelFormat(d.format)); f == "MJPG" || f == "JPEG" {
+		buffer.flags |= V4L2_BUF_FLAG_KEYFRAME
+	}
+	if d.config.ErrorEvery > 0 && (d.produced+1)%d.config.ErrorEvery == 0 {
+		buffer.flags |= V4L2_BUF_FLAG_ERROR
+	}
+	buffer.sequence = d.sequence
+	buffer.timestamp = monotonicTimeval()
+}
+
+func (d *fakeDevice) queryPlanes(index uint32) ([][]byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.multiplanar() || int(index) >= len(d.planes) {
+		return nil, ioctlError(VIDIOC_QUERYBUF, unix.EINVAL)
+	}
+	if d.planes[index] == nil {
+		sizes := fakePlaneSizes(d.format, d.width, d.height)
+		for _, size := range sizes {
+			fd, plane, err := newFakeBuffer(size)
+			if err != nil {
+				return nil, err
+			}
+			d.planes[index] = append(d.planes[index], plane)
+			d.planeFds[index] = append(d.planeFds[index], fd)
+		}
+	}
+
+	planes := make([][]byte, len(d.planes[index]))
+	for p, plane := range d.planes[index] {
+		mapping, err := mapFakeBuffer(d.planeFds[index][p], len(plane))
+		if err != nil {
+			for _, mapped := range planes[:p] {
+				unix.Munmap(mapped)
+			}
+			return nil, err
+		}
+		planes[p] = mapping
+	}
+	return planes, nil
+}
+
+func (d *fakeDevice) dequeuePlanes(memory uint32) (v4l2_buffer, []v4l2_plane, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	buffer := v4l2_buffer{}
+
+	if d.gone {
+		return buffer, nil, ioctlError(VIDIOC_DQBUF, unix.ENODEV)
+	}
+	if !d.streaming || !d.multiplanar() || memory != d.memory {
+		return buffer, nil, ioctlError(VIDIOC_DQBUF, unix.EINVAL)
+	}
+	if len(d.queue) == 0 || d.halted || time.Now().Before(d.nextFrame) {
+		return buffer, nil, ioctlError(VIDIOC_DQBUF, unix.EAGAIN)
+	}
+
+	i := d.queue[0]
+	d.queue = d.queue[1:]
+
+	d.dropLateFrames()
+	d.fillBuffer(&buffer, i)
+
+	// Render contiguous frame, then split it into planes
+	frame := make([]byte, d.bufferSize())
+	n := d.renderFrame(frame)
+
+	planes := make([]v4l2_plane, len(d.planes[i]))
+	for p, plane := range d.planes[i] {
+		used := copy(plane, frame[:n])
+		frame = frame[used:]
+		n -= used
+		planes[p].bytesused = uint32(used)
+		planes[p].length = uint32(len(plane))
+	}
+	buffer.length = uint32(len(planes))
+	d.frameDelivered()
+
+	return buffer, planes, nil
+}
+
+func (d *fakeDevice) enqueuePlanes(index uint32, numPlanes uint32) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.multiplanar() || int(index) >= len(d.planes) || d.planes[index] == nil {
+		return ioctlError(VIDIOC_QBUF, unix.EINVAL)
+	}
+	if int(numPlanes) != len(d.planes[index]) {
+		return ioctlError(VIDIOC_QBUF, unix.EINVAL)
+	}
+	return d.queueBuffer(index)
+}
+
+func monotonicTimeval() unix.Timeval {
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	return unix.NsecToTimeval(ts.Nano())
+}
+
+// Renders next frame into buffer and schedules the one after it
+// Skips the sequence numbers of frames the consumer was too slow to take
+func (d *fakeDevice) dropLateFrames() {
+	duration := d.frameDuration()
+	if late := time.Since(d.nextFrame); duration > 0 && late >= duration {
+		dropped := late / duration
+		d.sequence += uint32(dropped)
+		d.nextFrame = d.nextFrame.Add(dropped * duration)
+	}
+}
+
+func (d *fakeDevice) renderFrame(buffer []byte) int {
+	d.autoExposure()
+
+	img := fakePattern(int(d.width), int(d.height), d.sequence)
+	n := renderFakeFrame(buffer, img, d.format)
+	if padding := int(d.linePadding(d.format)); padding > 0 {
+		n = padFakeLines(buffer[:n], int(d.height), padding)
+	}
+
+	d.sequence++
+	d.nextFrame = d.nextFrame.Add(d.frameDuration())
+	return n
+}
+
+// Unless exposure is manual, exposure time drifts every half a second
+// at 30 fps, raising control events like a driver running auto exposure
+func (d *fakeDevice) autoExposure() {
+	mode, ok := d.findControl(V4L2_CID_EXPOSURE_AUTO)
+	if !ok || d.controls[uint32(mode.ID)] == V4L2_EXPOSURE_MANUAL || d.sequence%15 != 0 {
+		return
+	}
+	c, ok := d.findControl(V4L2_CID_EXPOSURE_ABSOLUTE)
+	if !ok || c.Max <= c.Min {
+		return
+	}
+
+	id := uint32(c.ID)
+	value := c.Min + (int64(d.sequence/15)*c.Step*10)%(c.Max-c.Min+1)
+	if value != d.controls[id] {
+		d.controls[id] = value
+		d.notifyControl(c, V4L2_EVENT_CTRL_CH_VALUE, false)
+	}
+}
+
+// Queues a control event if the control is subscribed to. Changes made
+// through the device itself are reported only with ALLOW_FEEDBACK
+func (d *fakeDevice) notifyControl(c FakeControl, changes uint32, feedback bool) {
+	flags, ok := d.subscriptions[[2]uint32{V4L2_EVENT_CTRL, uint32(c.ID)}]
+	if !ok || (feedback && (flags&V4L2_EVENT_SUB_FL_ALLOW_FEEDBACK) == 0) {
+		return
+	}
+
+	ctrl := v4l2_event_ctrl{
+		Changes:       changes,
+		Type:          c.Type,
+		Flags:         c.Flags,
+		Minimum:       int32(c.Min),
+		Maximum:       int32(c.Max),
+		Step:          int32(c.Step),
+		Default_value: int32(c.Value),
+	}
+	if c.Type == V4L2_CTRL_TYPE_INTEGER64 {
+		NativeByteOrder.PutUint64(ctrl.Value[:], uint64(d.controls[uint32(c.ID)]))
+	} else {
+		NativeByteOrder.PutUint32(ctrl.Value[:], uint32(int32(d.controls[uint32(c.ID)])))
+	}
+
+	event := v4l2_event{_type: V4L2_EVENT_CTRL, id: uint32(c.ID)}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, NativeByteOrder, &ctrl)
+	copy(event.union.data[:], buf.Bytes())
+	d.queueEvent(event)
+}
+
+func (d *fakeDevice) queueEvent(event v4l2_event) {
+	event.sequence = d.eventSequence
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &event.timestamp)
+	d.eventSequence++
+	d.events = append(d.events, event)
+}
+
+func (d *fakeDevice) subscribeEvent(eventType uint32, id uint32, flags uint32) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	switch eventType {
+	case V4L2_EVENT_SOURCE_CHANGE, V4L2_EVENT_EOS:
+		if id != 0 {
+			return ioctlError(VIDIOC_SUBSCRIBE_EVENT, unix.EINVAL)
+		}
+		d.subscriptions[[2]uint32{eventType, id}] = flags
+		return nil
+	case V4L2_EVENT_CTRL:
+	default:
+		return ioctlError(VIDIOC_SUBSCRIBE_EVENT, unix.EINVAL)
+	}
+
+	c, ok := d.findControl(id)
+	if !ok {
+		return ioctlError(VIDIOC_SUBSCRIBE_EVENT, unix.EINVAL)
+	}
+
+	// Like drivers, a repeated subscription changes nothing
+	if _, ok := d.subscriptions[[2]uint32{eventType, id}]; ok {
+		return nil
+	}
+	d.subscriptions[[2]uint32{eventType, id}] = flags
+	if (flags & V4L2_EVENT_SUB_FL_SEND_INITIAL) != 0 {
+		d.notifyControl(c, V4L2_EVENT_CTRL_CH_VALUE|V4L2_EVENT_CTRL_CH_FLAGS, false)
+	}
+	return nil
+}
+
+func (d *fakeDevice) unsubscribeEvent(eventType uint32, id uint32) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if eventType == V4L2_EVENT_ALL {
+		d.subscriptions = make(map[[2]uint32]uint32)
+		d.events = nil
+		return nil
+	}
+
+	delete(d.subscriptions, [2]uint32{eventType, id})
+
+	// Pending events of the subscription are dropped
+	events := d.events[:0]
+	for _, event := range d.events {
+		if event._type != eventType || event.id != id {
+			events = append(events, event)
+		}
+	}
+	d.events = events
+	return nil
+}
+
+func (d *fakeDevice) dequeueEvent() (v4l2_event, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(d.events) == 0 {
+		return v4l2_event{}, ioctlError(VIDIOC_DQEVENT, unix.ENOENT)
+	}
+	event := d.events[0]
+	d.events = d.events[1:]
+	event.pending = uint32(len(d.events))
+	return event, nil
+}
+
+// Like with a real device, first read() or select() starts
+// capturing if streaming I/O is not in use
+func (d *fakeDevice) startReading() bool {
+	if d.streaming || d.buffers != nil {
+		return d.reading
+	}
+	d.streaming = true
+	d.reading = true
+	d.nextFrame = time.Now().Add(d.frameDuration())
+	return true
+}
+
+func (d *fakeDevice) read(buffer []byte) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.gone {
+		return 0, syscallError("read", unix.ENODEV)
+	}
+	if !d.startReading() {
+		return 0, syscallError("read", unix.EBUSY)
+	}
+	if d.halted || time.Now().Before(d.nextFrame) {
+		return 0, syscallError("read", unix.EAGAIN)
+	}
+
+	if d.sourceChange {
+		d.sourceChange = false
+		d.changeSource()
+	}
+
+	// Frames that do not fit are truncated
+	frame := make([]byte, d.bufferSize())
+	d.dropLateFrames()
+	n := d.renderFrame(frame)
+	d.frameDelivered()
+	return copy(buffer, frame[:n]), nil
+}
+
+func (d *fakeDevice) enqueueBuffer(index uint32) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.memory != V4L2_MEMORY_MMAP || d.multiplanar() || int(index) >= len(d.buffers) || d.buffers[index] == nil {
+		return ioctlError(VIDIOC_QBUF, unix.EINVAL)
+	}
+	return d.queueBuffer(index)
+}
+
+func (d *fakeDevice) enqueueUserBuffer(index uint32, buffer []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.memory != V4L2_MEMORY_USERPTR || int(index) >= len(d.buffers) || len(buffer) == 0 {
+		return ioctlError(VIDIOC_QBUF, unix.EINVAL)
+	}
+	if err := d.checkQueue(index); err != nil {
+		return err
+	}
+	// Drivers refuse to pin user memory that cannot hold a frame
+	// of the format the buffers were requested for
+	if len(buffer) < d.frameSize {
+		return ioctlError(VIDIOC_QBUF, unix.EFAULT)
+	}
+	d.buffers[index] = buffer
+	return d.queueBuffer(index)
+}
+
+func (d *fakeDevice) enqueueDmabuf(index uint32, dmafd int, length uint32) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.memory != V4L2_MEMORY_DMABUF || int(index) >= len(d.buffers) {
+		return ioctlError(VIDIOC_QBUF, unix.EINVAL)
+	}
+	if err := d.checkQueue(index); err != nil {
+		return err
+	}
+	if d.fds[index] != dmafd {
+		if d.fds[index] >= 0 {
+			unix.Munmap(d.buffers[index])
+			d.buffers[index] = nil
+			d.fds[index] = -1
+		}
+		buffer, err := unix.Mmap(dmafd, 0, int(length), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			return err
+		}
+		d.buffers[index] = buffer
+		d.fds[index] = dmafd
+	}
+	return d.queueBuffer(index)
+}
+
+func (d *fakeDevice) exportBuffer(index uint32, plane uint32) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.memory != V4L2_MEMORY_MMAP {
+		return -1, ioctlError(VIDIOC_EXPBUF, unix.EINVAL)
+	}
+	if d.multiplanar() {
+		if int(index) >= len(d.planeFds) || int(plane) >= len(d.planeFds[index]) {
+			return -1, ioctlError(VIDIOC_EXPBUF, unix.EINVAL)
+		}
+		return unix.Dup(d.planeFds[index][plane])
+	}
+	if plane != 0 || int(index) >= len(d.fds) || d.fds[index] < 0 {
+		return -1, ioctlError(VIDIOC_EXPBUF, unix.EINVAL)
+	}
+	return unix.Dup(d.fds[index])
+}
+
+// DMABUF file descriptors given to the fake are ordinary shared memory,
+// e.g. memfds or buffers exported by another fake, mapped like real ones
+func (d *fakeDevice) mapDmabuf(dmafd int) ([]byte, error) {
+	return dmabufMap(dmafd)
+}
+
+// Fails the way VIDIOC_QBUF does if a buffer cannot be queued,
+// so that callers can check before they change the buffer
+func (d *fakeDevice) checkQueue(index uint32) error {
+	if d.gone {
+		return ioctlError(VIDIOC_QBUF, unix.ENODEV)
+	}
+	for _, i := range d.queue {
+		if i == index {
+			return ioctlError(VIDIOC_QBUF, unix.EINVAL)
+		}
+	}
+	return nil
+}
+
+func (d *fakeDevice) queueBuffer(index uint32) error {
+	if err := d.checkQueue(index); err != nil {
+		return err
+	}
+	d.queue = append(d.queue, index)
+	return nil
+}
+
+func (d *fakeDevice) releaseBuffer(buffer []byte) error {
+	return unix.Munmap(buffer)
+}
+
+func (d *fakeDevice) startStreaming() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(d.buffers) == 0 || d.config.ReadWriteOnly {
+		return ioctlError(VIDIOC_STREAMON, unix.EINVAL)
+	}
+	d.streaming = true
+	d.produced = 0
+	d.halted = false
+	d.nextFrame = time.Now().Add(d.frameDuration())
+	return nil
+}
+
+func (d *fakeDevice) stopStreaming() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.streaming = false
+	d.queue = nil
+	if d.gone {
+		return ioctlError(VIDIOC_STREAMOFF, unix.ENODEV)
+	}
+	return nil
+}
+
+func (d *fakeDevice) frameDuration() time.Duration {
+	if d.interval.Denominator == 0 {
+		return 0
+	}
+	return time.Duration(d.interval.Numerator) * time.Second / time.Duration(d.interval.Denominator)
+}
+
+// Sleeps until the next frame is due, returns number of ready frames
+func (d *fakeDevice) waitForFrame(timeout time.Duration) (bool, bool, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		d.mutex.Lock()
+		closed := d.closed
+		reading := d.startReading()
+		streaming := d.streaming
+		queued := len(d.queue)
+		wait := time.Until(d.nextFrame)
+		event := len(d.events) > 0
+		halted := d.halted
+		gone := d.gone
+		d.mutex.Unlock()
+
+		// Like select() on a disconnected device, report it readable,
+		// so that dequeueing fails
+		if gone {
+			return true, false, nil
+		}
+
+		if closed {
+			return false, false, syscallError("select", unix.EBADF)
+		}
+		if !streaming {
+			return false, false, syscallError("select", unix.EINVAL)
+		}
+
+		frame := (queued > 0 || reading) && !halted && wait <= 0
+		if frame || event {
+			return frame, event, nil
+		}
+
+		if (queued == 0 && !reading) || halted {
+			// Wait for the consumer to queue a buffer or restart streaming
+			wait = 5 * time.Millisecond
+		}
+
+		if left := time.Until(deadline); wait > left {
+			time.Sleep(left)
+			return false, false, nil
+		}
+		time.Sleep(wait)
+	}
+}
+
+func (d *fakeDevice) getControl(id uint32) (int32, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	c, ok := d.findControl(id)
+	if !ok || c.Type == V4L2_CTRL_TYPE_INTEGER64 || c.Type == V4L2_CTRL_TYPE_STRING {
+		return 0, ioctlError(VIDIOC_G_CTRL, unix.EINVAL)
+	}
+	if (c.Flags & V4L2_CTRL_FLAG_WRITE_ONLY) != 0 {
+		return 0, ioctlError(VIDIOC_G_CTRL, unix.EACCES)
+	}
+	return int32(d.controls[id]), nil
+}
+
+func (d *fakeDevice) setControl(id uint32, val int32) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	c, ok := d.findControl(id)
+	if !ok || c.Type == V4L2_CTRL_TYPE_INTEGER64 || c.Type == V4L2_CTRL_TYPE_STRING {
+		return ioctlError(VIDIOC_S_CTRL, unix.EINVAL)
+	}
+	if int64(val) < c.Min || int64(val) > c.Max {
+		return ioctlError(VIDIOC_S_CTRL, unix.ERANGE)
+	}
+	ctrl := extControl{id: id, c_type: c.Type, value: int64(val)}
+	if err := d.validateControl(c, &ctrl); err != nil {
+		return ioctlError(VIDIOC_S_CTRL, err)
+	}
+	if (c.Flags & V4L2_CTRL_FLAG_GRABBED) != 0 {
+		return ioctlError(VIDIOC_S_CTRL, unix.EBUSY)
+	}
+	if d.failSets[id] > 0 {
+		d.failSets[id]--
+		return ioctlError(VIDIOC_S_CTRL, unix.EIO)
+	}
+	d.setValue(c, ctrl)
+	return nil
+}
+
+// Returns configured control with type and step filled in
+func (d *fakeDevice) findControl(id uint32) (FakeControl, bool) {
+	for _, c := range d.config.Controls {
+		if uint32(c.ID) == id {
+			if c.Type == 0 {
+				c.Type = V4L2_CTRL_TYPE_INTEGER
+				if c.Min == 0 && c.Max == 1 {
+					c.Type = V4L2_CTRL_TYPE_BOOLEAN
+				}
+			}
+			if c.Step == 0 {
+				c.Step = 1
+			}
+			return c, true
+		}
+	}
+	return FakeControl{}, false
+}
+
+func (d *fakeDevice) describeControl(c FakeControl) control {
+	return control{
+		id:     uint32(c.ID),
+		name:   c.Name,
+		c_type: c.Type,
+		min:    c.Min,
+		max:    c.Max,
+		step:   c.Step,
+		def:    c.Value,
+		flags:  c.Flags,
+	}
+}
+
+// Enumerates controls the way queryControls of the real device does,
+// skipping disabled controls and class entries
+func (d *fakeDevice) queryControls() []control {
+	controls := []control{}
+	var id uint32
+	for {
+		c, err := d.queryControl(id | V4L2_CTRL_FLAG_NEXT_CTRL | V4L2_CTRL_FLAG_NEXT_COMPOUND)
+		if err != nil {
+			return controls
+		}
+		id = c.id
+		if (c.flags&V4L2_CTRL_FLAG_DISABLED) != 0 || c.c_type == V4L2_CTRL_TYPE_CTRL_CLASS {
+			continue
+		}
+		controls = append(controls, c)
+	}
+}
+
+func (d *fakeDevice) queryControl(id uint32) (control, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if (id & V4L2_CTRL_FLAG_NEXT_CTRL) == 0 {
+		c, ok := d.findControl(id &^ V4L2_CTRL_FLAG_NEXT_COMPOUND)
+		if !ok {
+			return control{}, ioctlError(VIDIOC_QUERY_EXT_CTRL, unix.EINVAL)
+		}
+		return d.describeControl(c), nil
+	}
+
+	// Enumerate in the order of control IDs, like drivers do
+	id &= V4L2_CTRL_ID_MASK
+	found := false
+	var next uint32
+	for _, c := range d.config.Controls {
+		if uint32(c.ID) > id && (!found || uint32(c.ID) < next) {
+			next = uint32(c.ID)
+			found = true
+		}
+	}
+	if !found {
+		return control{}, ioctlError(VIDIOC_QUERY_EXT_CTRL, unix.EINVAL)
+	}
+	c, _ := d.findControl(next)
+	return d.describeControl(c), nil
+}
+
+func (d *fakeDevice) queryMenu(id uint32, index uint32) (string, int64, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	c, ok := d.findControl(id)
+	if !ok || c.Type != V4L2_CTRL_TYPE_MENU {
+		return "", 0, ioctlError(VIDIOC_QUERYMENU, unix.EINVAL)
+	}
+	item := int64(index) - c.Min
+	if item < 0 || item >= int64(len(c.Menu)) || int64(index) > c.Max || c.Menu[item] == "" {
+		return "", 0, ioctlError(VIDIOC_QUERYMENU, unix.EINVAL)
+	}
+	return c.Menu[item], 0, nil
+}
+
+// Checks a new value of a control and adjusts it the way drivers do,
+// integers are clamped to the range and rounded to the step
+func (d *fakeDevice) validateControl(c FakeControl, ctrl *extControl) error {
+	if (c.Flags & V4L2_CTRL_FLAG_READ_ONLY) != 0 {
+		return unix.EACCES
+	}
+
+	switch c.Type {
+	case V4L2_CTRL_TYPE_INTEGER, V4L2_CTRL_TYPE_INTEGER64, V4L2_CTRL_TYPE_BOOLEAN:
+		v := ctrl.value
+		if v < c.Min {
+			v = c.Min
+		}
+		if v > c.Max {
+			v = c.Max
+		}
+		v = c.Min + (v-c.Min+c.Step/2)/c.Step*c.Step
+		if v > c.Max {
+			v -= c.Step
+		}
+		ctrl.value = v
+	case V4L2_CTRL_TYPE_MENU:
+		if ctrl.value < c.Min || ctrl.value > c.Max {
+			return unix.ERANGE
+		}
+		item := ctrl.value - c.Min
+		if item >= int64(len(c.Menu)) || c.Menu[item] == "" {
+			return unix.EINVAL
+		}
+	case V4L2_CTRL_TYPE_BITMASK:
+		if ctrl.value&^c.Max != 0 {
+			return unix.ERANGE
+		}
+	case V4L2_CTRL_TYPE_BUTTON:
+		ctrl.value = 0
+	case V4L2_CTRL_TYPE_STRING:
+		if ctrl.payload == nil {
+			return unix.EINVAL
+		}
+		length := int64(len(CToGoString(ctrl.payload)))
+		if length < c.Min || length > c.Max {
+			return unix.ERANGE
+		}
+	default:
+		return unix.EINVAL
+	}
+	return nil
+}
+
+func (d *fakeDevice) getExtControls(controls []extControl) (uint32, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	count := uint32(len(controls))
+	for i := range controls {
+		c, ok := d.findControl(controls[i].id)
+		if !ok {
+			return count, ioctlError(VIDIOC_G_EXT_CTRLS, unix.EINVAL)
+		}
+		if (c.Flags & V4L2_CTRL_FLAG_WRITE_ONLY) != 0 {
+			return count, ioctlError(VIDIOC_G_EXT_CTRLS, unix.EACCES)
+		}
+		if c.Type == V4L2_CTRL_TYPE_STRING {
+			text := d.texts[controls[i].id]
+			if len(controls[i].payload) < len(text)+1 {
+				return uint32(i), ioctlError(VIDIOC_G_EXT_CTRLS, unix.ENOSPC)
+			}
+			copy(controls[i].payload, text)
+			controls[i].payload[len(text)] = 0
+			continue
+		}
+		controls[i].value = d.controls[controls[i].id]
+	}
+	return 0, nil
+}
+
+// Validates all controls before anything is changed. Like drivers,
+// reports the failed control for TRY, but not for SET, which fails
+// before any control is set
+func (d *fakeDevice) checkExtControls(controls []extControl, try bool) (uint32, error) {
+	request := VIDIOC_S_EXT_CTRLS
+	if try {
+		request = VIDIOC_TRY_EXT_CTRLS
+	}
+
+	for i := range controls {
+		idx := uint32(i)
+		if !try {
+			idx = uint32(len(controls))
+		}
+		c, ok := d.findControl(controls[i].id)
+		if !ok {
+			return idx, ioctlError(request, unix.EINVAL)
+		}
+		if err := d.validateControl(c, &controls[i]); err != nil {
+			return idx, ioctlError(request, err)
+		}
+		// Controls grabbed while streaming can be tried, but not set
+		if !try && (c.Flags&V4L2_CTRL_FLAG_GRABBED) != 0 {
+			return idx, ioctlError(request, unix.EBUSY)
+		}
+	}
+	return 0, nil
+}
+
+func (d *fakeDevice) setExtControls(controls []extControl) (uint32, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if errorIdx, err := d.checkExtControls(controls, false); err != nil {
+		return errorIdx, err
+	}
+	for i, ctrl := range controls {
+		if d.failSets[ctrl.id] > 0 {
+			d.failSets[ctrl.id]--
+			return uint32(i), ioctlError(VIDIOC_S_EXT_CTRLS, unix.EIO)
+		}
+		c, _ := d.findControl(ctrl.id)
+		d.setValue(c, ctrl)
+	}
+	return 0, nil
+}
+
+func (d *fakeDevice) setValue(c FakeControl, ctrl extControl) {
+	if ctrl.payload != nil {
+		d.texts[ctrl.id] = CToGoString(ctrl.payload)
+	} else if c.Type != V4L2_CTRL_TYPE_BUTTON {
+		d.controls[ctrl.id] = ctrl.value
+	}
+	d.notifyControl(c, V4L2_EVENT_CTRL_CH_VALUE, true)
+}
+
+func (d *fakeDevice) tryExtControls(controls []extControl) (uint32, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.checkExtControls(controls, true)
+}
+
+func (d *fakeDevice) close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return unix.EBADF
+	}
+	d.closed = true
+	d.streaming = false
+	d.reading = false
+	d.freeBuffers()
+	return nil
+}
+
+// Color bars moving one step to the left with each frame
+func fakePattern(width int, height int, sequence uint32) *image.RGBA {
+	bars := []color.RGBA{
+		{255, 255, 255, 255}, {255, 255, 0, 255}, {0, 255, 255, 255}, {0, 255, 0, 255},
+		{255, 0, 255, 255}, {255, 0, 0, 255}, {0, 0, 255, 255}, {0, 0, 0, 255},
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		bar := bars[((x+int(sequence)*4)*len(bars)/width)%len(bars)]
+		for y := 0; y < height; y++ {
+			img.SetRGBA(x, y, bar)
+		}
+	}
+	return img
+}
+
+// Single-planar format reported by the fake driver. Frames are rendered
+// with full range BT.601 Y'CbCr, which is what V4L2_COLORSPACE_JPEG describes
+func fakePixFormat(format uint32, width uint32, height uint32) v4l2_pix_format {
+	return v4l2_pix_format{
+		Width:        width,
+		Height:       height,
+		Pixelformat:  format,
+		Field:        V4L2_FIELD_NONE,
+		Bytesperline: fakeLineSizes(format, width)[0],
+		Sizeimage:    uint32(fakeFrameSize(format, width, height)),
+		Colorspace:   V4L2_COLORSPACE_JPEG,
+		Priv:         V4L2_PIX_FMT_PRIV_MAGIC,
+		Ycbcr_enc:    V4L2_YCBCR_ENC_601,
+		Quantization: V4L2_QUANTIZATION_FULL_RANGE,
+		Xfer_func:    V4L2_XFER_FUNC_SRGB,
+	}
+}
+
+// Single-planar format of the fake camera, with its line padding
+func (d *fakeDevice) pixFormat(format uint32, width uint32, height uint32) v4l2_pix_format {
+	pix := fakePixFormat(format, width, height)
+	if padding := d.linePadding(format); padding > 0 {
+		pix.Bytesperline += padding
+		pix.Sizeimage = pix.Bytesperline * height
+	}
+	return pix
+}
+
+// Returns bytes of padding at the end of lines of a format
+func (d *fakeDevice) linePadding(format uint32) uint32 {
+	switch DecodeFormat(PixelFormat(format)) {
+	case "YU12", "YV12", "NV12", "NV21", "MJPG", "JPEG":
+		return 0
+	}
+	if d.multiplanar() {
+		return 0
+	}
+	return d.config.LinePadding
+}
+
+// Size of a frame buffer of the current format
+func (d *fakeDevice) bufferSize() int {
+	if d.linePadding(d.format) > 0 {
+		return int(d.pixFormat(d.format, d.width, d.height).Sizeimage)
+	}
+	return fakeFrameSize(d.format, d.width, d.height)
+}
+
+// Moves lines of a frame rendered into the start of buffer apart,
+// filling the gaps with padding bytes. Returns number of bytes used
+func padFakeLines(buffer []byte, height int, padding int) int {
+	line := len(buffer) / height
+	stride := line + padding
+	buffer = buffer[:cap(buffer)]
+	for y := height - 1; y >= 0; y-- {
+		copy(buffer[y*stride:], buffer[y*line:(y+1)*line])
+		for i := y*stride + line; i < (y+1)*stride; i++ {
+			buffer[i] = 0xff
+		}
+	}
+	return stride * height
+}
+
+// Multiplanar format reported by the fake driver
+func fakePixFormatMplane(format uint32, width uint32, height uint32) v4l2_pix_format_mplane {
+	pix := v4l2_pix_format_mplane{
+		Width:        width,
+		Height:       height,
+		Pixelformat:  format,
+		Field:        V4L2_FIELD_NONE,
+		Colorspace:   V4L2_COLORSPACE_JPEG,
+		Ycbcr_enc:    uint8(V4L2_YCBCR_ENC_601),
+		Quantization: uint8(V4L2_QUANTIZATION_FULL_RANGE),
+		Xfer_func:    uint8(V4L2_XFER_FUNC_SRGB),
+	}
+	sizes := fakePlaneSizes(format, width, height)
+	lines := fakeLineSizes(format, width)
+	pix.Num_planes = uint8(len(sizes))
+	for p, size := range sizes {
+		pix.Plane_fmt[p].Sizeimage = uint32(size)
+		pix.Plane_fmt[p].Bytesperline = lines[p]
+	}
+	return pix
+}
+
+// Bytes per line of each plane of a synthetic frame, 0 for compressed formats
+func fakeLineSizes(format uint32, width uint32) []uint32 {
+	switch DecodeFormat(PixelFormat(format)) {
+	case "YU12", "YV12", "NV12", "NV21":
+		return []uint32{width}
+	case "NM12", "NM21":
+		return []uint32{width, width}
+	case "YM12", "YM21":
+		return []uint32{width, width / 2, width / 2}
+	case "RGB3", "BGR3":
+		return []uint32{width * 3}
+	case "RGB4", "BGR4":
+		return []uint32{width * 4}
+	case "MJPG", "JPEG":
+		return []uint32{0}
+	default:
+		return []uint32{width * 2}
+	}
+}
+
+// Sizes of planes of a synthetic frame for a given format
+func fakePlaneSizes(format uint32, width uint32, height uint32) []int {
+	pixels := int(width) * int(height)
+	switch DecodeFormat(PixelFormat(format)) {
+	case "NM12", "NM21":
+		return []int{pixels, pixels / 2}
+	case "YM12", "YM21":
+		return []int{pixels, pixels / 4, pixels / 4}
+	default:
+		return []int{fakeFrameSize(format, width, height)}
+	}
+}
+
+// Size of a synthetic frame buffer for a given format
+func fakeFrameSize(format uint32, width uint32, height uint32) int {
+	pixels := int(width) * int(height)
+	switch DecodeFormat(PixelFormat(format)) {
+	case "YU12", "YV12", "NV12", "NV21", "NM12", "NM21", "YM12", "YM21":
+		return pixels * 3 / 2
+	case "RGB3", "BGR3":
+		return pixels * 3
+	case "RGB4", "BGR4":
+		return pixels * 4
+	case "MJPG", "JPEG":
+		// Compressed frames must fit into uncompressed size
+		return pixels*3 + 1024
+	default:
+		return pixels * 2
+	}
+}
+
+// Encodes an image into buffer using given pixel format,
+// returns number of bytes used
+func renderFakeFrame(buffer []byte, img *image.RGBA, format uint32) int {
+	width := img.Rect.Dx()
+	height := img.Rect.Dy()
+	f := DecodeFormat(PixelFormat(format))
+
+	// Multiplanar formats are rendered contiguously and split afterwards
+	switch f {
+	case "NM12":
+		f = "NV12"
+	case "NM21":
+		f = "NV21"
+	case "YM12":
+		f = "YU12"
+	case "YM21":
+		f = "YV12"
+	}
+
+	yuv := func(x, y int) (uint8, uint8, uint8) {
+		c := img.RGBAAt(x, y)
+		return color.RGBToYCbCr(c.R, c.G, c.B)
+	}
+
+	switch f {
+	case "YUYV", "YVYU", "UYVY", "VYUY":
+		for y := 0; y < height; y++ {
+			for x := 0; x+1 < width; x += 2 {
+				i := (y*width + x) * 2
+				y0, cb, cr := yuv(x, y)
+				y1, _, _ := yuv(x+1, y)
+				switch f {
+				case "YUYV":
+					buffer[i], buffer[i+1], buffer[i+2], buffer[i+3] = y0, cb, y1, cr
+				case "YVYU":
+					buffer[i], buffer[i+1], buffer[i+2], buffer[i+3] = y0, cr, y1, cb
+				case "UYVY":
+					buffer[i], buffer[i+1], buffer[i+2], buffer[i+3] = cb, y0, cr, y1
+				case "VYUY":
+					buffer[i], buffer[i+1], buffer[i+2], buffer[i+3] = cr, y0, cb, y1
+				}
+			}
+		}
+		return width * height * 2
+
+	case "YU12", "YV12", "NV12", "NV21":
+		lumaSize := width * height
+		chromaWidth := width / 2
+		chromaSize := chromaWidth * (height / 2)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				l, cb, cr := yuv(x, y)
+				buffer[y*width+x] = l
+				if x%2 != 0 || y%2 != 0 || x/2 >= chromaWidth || y/2 >= height/2 {
+					continue
+				}
+				ci := (y/2)*chromaWidth + x/2
+				switch f {
+				case "YU12":
+					buffer[lumaSize+ci] = cb
+					buffer[lumaSize+chromaSize+ci] = cr
+				case "YV12":
+					buffer[lumaSize+ci] = cr
+					buffer[lumaSize+chromaSize+ci] = cb
+				case "NV12":
+					buffer[lumaSize+2*ci] = cb
+					buffer[lumaSize+2*ci+1] = cr
+				case "NV21":
+					buffer[lumaSize+2*ci] = cr
+					buffer[lumaSize+2*ci+1] = cb
+				}
+			}
+		}
+		return lumaSize + 2*chromaSize
+
+	case "RGB3", "BGR3", "RGB4", "BGR4":
+		// Byte order matches the decoders in image.go
+		bpp := 3
+		if f == "RGB4" || f == "BGR4" {
+			bpp = 4
+		}
+		for p := 0; p < width*height; p++ {
+			r, g, b := img.Pix[p*4], img.Pix[p*4+1], img.Pix[p*4+2]
+			i := p * bpp
+			switch f {
+			case "RGB3", "BGR4":
+				buffer[i], buffer[i+1], buffer[i+2] = r, g, b
+			case "BGR3", "RGB4":
+				buffer[i], buffer[i+1], buffer[i+2] = b, g, r
+			}
+			if bpp == 4 {
+				buffer[i+3] = 255
+			}
+		}
+		return width * height * bpp
+
+	case "MJPG", "JPEG":
+		buf := &bytes.Buffer{}
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 75}); err != nil {
+			return 0
+		}
+		return copy(buffer, buf.Bytes())
+
+	default:
+		// Unknown format, fill buffer with a byte ramp
+		for i := range buffer {
+			buffer[i] = byte(i) + byte(img.Pix[0])
+		}
+		return len(buffer)
+	}
+}
@@ -0,0 +1,633 @@
+package webcam
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func openTestFake(t *testing.T, config FakeConfig) *Camera {
+	t.Helper()
+
+	cam, err := OpenFake(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cam.Close() })
+	return cam
+}
+
+// Waits for, gets and releases count frames, checking that each
+// one fills size bytes and that sequence numbers grow
+func captureTestFrames(t *testing.T, cam *Camera, count int, size int) {
+	t.Helper()
+
+	var last uint32
+	for i := 0; i < count; i++ {
+		if err := cam.WaitForFrame(1); err != nil {
+			t.Fatal(err)
+		}
+		frame, err := cam.GetFrameWithMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size > 0 && len(frame.Bytes()) != size {
+			t.Errorf("frame %d has %d bytes, want %d", i, len(frame.Bytes()), size)
+		}
+		if len(frame.Bytes()) == 0 {
+			t.Errorf("frame %d is empty", i)
+		}
+		if i > 0 && frame.Sequence <= last {
+			t.Errorf("frame %d has sequence %d after %d", i, frame.Sequence, last)
+		}
+		last = frame.Sequence
+		if err = frame.Release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFakeSupportedFormats(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	formats := cam.GetSupportedFormats()
+	for _, name := range []string{"YUYV", "RGB3", "MJPG"} {
+		if _, ok := formats[EncodeFormat(name)]; !ok {
+			t.Errorf("format %s is not supported", name)
+		}
+	}
+	if len(formats) != 3 {
+		t.Errorf("got %d formats, want 3", len(formats))
+	}
+
+	sizes := cam.GetSupportedFrameSizes(EncodeFormat("YUYV"))
+	if len(sizes) != 2 {
+		t.Errorf("got %d frame sizes, want 2", len(sizes))
+	}
+	if sizes := cam.GetSupportedFrameSizes(EncodeFormat("XXXX")); len(sizes) != 0 {
+		t.Errorf("got %d frame sizes of an unknown format, want 0", len(sizes))
+	}
+
+	intervals := cam.GetSupportedFrameIntervals(EncodeFormat("YUYV"), 640, 480)
+	if len(intervals) != 3 {
+		t.Errorf("got %d frame intervals, want 3", len(intervals))
+	}
+}
+
+func TestFakeSetImageFormat(t *testing.T) {
+	tests := []struct {
+		name          string
+		format        string
+		width, height uint32
+		wantFormat    string
+		wantWidth     uint32
+		wantHeight    uint32
+	}{
+		{"exact size", "RGB3", 320, 240, "RGB3", 320, 240},
+		{"closest size", "YUYV", 600, 400, "YUYV", 640, 480},
+		{"too large", "MJPG", 4096, 4096, "MJPG", 640, 480},
+		{"too small", "YUYV", 16, 16, "YUYV", 320, 240},
+		{"unknown format", "XXXX", 320, 240, "YUYV", 320, 240},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cam := openTestFake(t, DefaultFakeConfig())
+
+			f, w, h, err := cam.SetImageFormat(EncodeFormat(tt.format), tt.width, tt.height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if DecodeFormat(f) != tt.wantFormat || w != tt.wantWidth || h != tt.wantHeight {
+				t.Errorf("SetImageFormat = %s %dx%d, want %s %dx%d", DecodeFormat(f), w, h, tt.wantFormat, tt.wantWidth, tt.wantHeight)
+			}
+
+			got, err := cam.GetImageFormat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.PixelFormat != f || got.Width != w || got.Height != h {
+				t.Errorf("GetImageFormat = %s %dx%d, want %s %dx%d", DecodeFormat(got.PixelFormat), got.Width, got.Height, DecodeFormat(f), w, h)
+			}
+		})
+	}
+}
+
+func TestFakeMmapStreaming(t *testing.T) {
+	tests := []struct {
+		format   string
+		bufcount uint32
+		// Size of frames, 0 for compressed formats
+		size int
+	}{
+		{"YUYV", 2, 640 * 480 * 2},
+		{"RGB3", 4, 640 * 480 * 3},
+		{"MJPG", 3, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			cam := openTestFake(t, DefaultFakeConfig())
+
+			if _, _, _, err := cam.SetImageFormat(EncodeFormat(tt.format), 640, 480); err != nil {
+				t.Fatal(err)
+			}
+			if err := cam.SetBufferCount(tt.bufcount); err != nil {
+				t.Fatal(err)
+			}
+			if err := cam.StartStreaming(); err != nil {
+				t.Fatal(err)
+			}
+			if err := cam.StartStreaming(); !errors.Is(err, ErrAlreadyStreaming) {
+				t.Errorf("second StartStreaming = %v, want ErrAlreadyStreaming", err)
+			}
+
+			captureTestFrames(t, cam, 2*int(tt.bufcount), tt.size)
+
+			if err := cam.StopStreaming(); err != nil {
+				t.Fatal(err)
+			}
+			if err := cam.StopStreaming(); !errors.Is(err, ErrNotStreaming) {
+				t.Errorf("second StopStreaming = %v, want ErrNotStreaming", err)
+			}
+		})
+	}
+}
+
+func TestFakeUserptrStreaming(t *testing.T) {
+	const size = 640 * 480 * 2
+
+	tests := []struct {
+		name  string
+		count int
+	}{
+		{"single buffer", 1},
+		{"three buffers", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cam := openTestFake(t, DefaultFakeConfig())
+
+			buffers := make([][]byte, tt.count)
+			for i := range buffers {
+				buffers[i] = make([]byte, size)
+			}
+			if err := cam.SetUserBuffers(buffers); err != nil {
+				t.Fatal(err)
+			}
+			if err := cam.StartStreaming(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2*tt.count; i++ {
+				if err := cam.WaitForFrame(1); err != nil {
+					t.Fatal(err)
+				}
+				frame, index, err := cam.GetFrame()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Frames alias the user buffers the driver filled
+				if &frame[0] != &buffers[index][0] || !bytes.Equal(frame, buffers[index][:len(frame)]) {
+					t.Errorf("frame %d does not alias its user buffer", index)
+				}
+				if err = cam.ReleaseFrame(index); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := cam.StopStreaming(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFakeSetUserBuffersInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		buffers [][]byte
+	}{
+		{"no buffers", [][]byte{}},
+		{"empty buffer", [][]byte{make([]byte, 16), {}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cam := openTestFake(t, DefaultFakeConfig())
+
+			if err := cam.SetUserBuffers(tt.buffers); err == nil {
+				t.Error("SetUserBuffers succeeded")
+			}
+		})
+	}
+}
+
+func TestFakeUserptrShortBuffer(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	if err := cam.SetUserBuffers([][]byte{make([]byte, 1024)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.StartStreaming(); !errors.Is(err, ErrBufferTooSmall) {
+		t.Errorf("StartStreaming with a short buffer = %v, want ErrBufferTooSmall", err)
+	}
+
+	// Drivers check on their own as well
+	d := newFakeDevice(DefaultFakeConfig())
+	d.setBufferType(V4L2_BUF_TYPE_VIDEO_CAPTURE)
+	defer d.close()
+
+	count := uint32(1)
+	if err := d.requestBuffers(V4L2_MEMORY_USERPTR, &count); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.enqueueUserBuffer(0, make([]byte, 1024)); !errors.Is(err, unix.EFAULT) {
+		t.Errorf("VIDIOC_QBUF of a short buffer = %v, want EFAULT", err)
+	}
+}
+
+// Queueing a buffer that is already queued must not replace it
+func TestFakeUserptrRequeue(t *testing.T) {
+	d := newFakeDevice(DefaultFakeConfig())
+	d.setBufferType(V4L2_BUF_TYPE_VIDEO_CAPTURE)
+	defer d.close()
+
+	count := uint32(1)
+	if err := d.requestBuffers(V4L2_MEMORY_USERPTR, &count); err != nil {
+		t.Fatal(err)
+	}
+	queued := make([]byte, 640*480*2)
+	if err := d.enqueueUserBuffer(0, queued); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		buffer []byte
+	}{
+		{"same size", make([]byte, 640*480*2)},
+		{"too short", make([]byte, 1024)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := d.enqueueUserBuffer(0, tt.buffer); err == nil {
+				t.Fatal("queueing a queued buffer succeeded")
+			}
+			if &d.buffers[0][0] != &queued[0] || len(d.queue) != 1 {
+				t.Error("failed VIDIOC_QBUF changed the queued buffer")
+			}
+		})
+	}
+}
+
+func TestFakeBufferCountRestored(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(cam *Camera) error
+		restore func(cam *Camera) error
+	}{
+		{"user buffers",
+			func(cam *Camera) error { return cam.SetUserBuffers([][]byte{make([]byte, 640*480*2)}) },
+			func(cam *Camera) error { return cam.SetUserBuffers(nil) }},
+		{"DMABUF buffers",
+			func(cam *Camera) error { return cam.SetDmabufBuffers(newTestDmabufs(t, 1, 640*480*2)) },
+			func(cam *Camera) error { return cam.SetDmabufBuffers(nil) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cam := openTestFake(t, DefaultFakeConfig())
+
+			if err := cam.SetBufferCount(3); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.set(cam); err != nil {
+				t.Fatal(err)
+			}
+			// Applies once the mmap method is back
+			if err := cam.SetBufferCount(4); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.restore(cam); err != nil {
+				t.Fatal(err)
+			}
+			if err := cam.StartStreaming(); err != nil {
+				t.Fatal(err)
+			}
+			if len(cam.buffers) != 4 {
+				t.Errorf("streaming with %d buffers, want 4", len(cam.buffers))
+			}
+			captureTestFrames(t, cam, 5, 640*480*2)
+		})
+	}
+}
+
+func TestFakeStreamingErrors(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	if err := cam.WaitForFrame(1); !errors.Is(err, ErrNotStreaming) {
+		t.Errorf("WaitForFrame before streaming = %v, want ErrNotStreaming", err)
+	}
+	if _, _, err := cam.GetFrame(); !errors.Is(err, ErrNotStreaming) {
+		t.Errorf("GetFrame before streaming = %v, want ErrNotStreaming", err)
+	}
+
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := cam.SetImageFormat(EncodeFormat("RGB3"), 320, 240); !errors.Is(err, ErrBusy) {
+		t.Errorf("SetImageFormat while streaming = %v, want ErrBusy", err)
+	}
+	if err := cam.SetBufferCount(2); !errors.Is(err, ErrAlreadyStreaming) {
+		t.Errorf("SetBufferCount while streaming = %v, want ErrAlreadyStreaming", err)
+	}
+	if err := cam.ReleaseFrame(0); err == nil {
+		t.Error("ReleaseFrame of a frame not held succeeded")
+	}
+
+	if err := cam.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("second Close = %v, want ErrClosed", err)
+	}
+}
+
+// Like drivers, the fake lists neither disabled controls nor class entries
+func TestFakeQueryControls(t *testing.T) {
+	const disabled = V4L2_CID_BASE + 3
+
+	config := DefaultFakeConfig()
+	config.Controls = append(config.Controls,
+		FakeControl{ID: ControlID(V4L2_CTRL_CLASS_USER | 1), Name: "User Controls", Type: V4L2_CTRL_TYPE_CTRL_CLASS},
+		FakeControl{ID: ControlID(disabled), Name: "Hue", Min: -180, Max: 180, Flags: V4L2_CTRL_FLAG_DISABLED},
+	)
+	cam := openTestFake(t, config)
+
+	controls := cam.GetControls()
+	if len(controls) != len(DefaultFakeConfig().Controls) {
+		t.Errorf("got %d controls, want %d", len(controls), len(DefaultFakeConfig().Controls))
+	}
+	for _, id := range []uint32{V4L2_CTRL_CLASS_USER | 1, disabled} {
+		if c, ok := controls[ControlID(id)]; ok {
+			t.Errorf("control %q is listed", c.Name)
+		}
+	}
+
+	// Disabled controls can still be queried directly
+	c, err := cam.QueryControl(ControlID(disabled))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (c.Flags & V4L2_CTRL_FLAG_DISABLED) == 0 {
+		t.Errorf("control flags are %#x, want disabled", c.Flags)
+	}
+}
+
+// Ioctls the fake rejects with EINVAL, like drivers do
+func TestFakeDeviceInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(d *fakeDevice) error
+	}{
+		{"format index out of range", func(d *fakeDevice) error {
+			_, _, err := d.getPixelFormat(3)
+			return err
+		}},
+		{"frame size index out of range", func(d *fakeDevice) error {
+			_, err := d.getFrameSize(2, uint32(EncodeFormat("YUYV")))
+			return err
+		}},
+		{"frame interval of unsupported size", func(d *fakeDevice) error {
+			_, err := d.getFrameInterval(0, uint32(EncodeFormat("YUYV")), 100, 100)
+			return err
+		}},
+		{"unknown memory type", func(d *fakeDevice) error {
+			count := uint32(2)
+			return d.requestBuffers(42, &count)
+		}},
+		{"query buffer out of range", func(d *fakeDevice) error {
+			count := uint32(2)
+			d.requestBuffers(V4L2_MEMORY_MMAP, &count)
+			var length uint32
+			_, err := d.queryBuffer(2, &length)
+			return err
+		}},
+		{"query user buffer", func(d *fakeDevice) error {
+			count := uint32(2)
+			d.requestBuffers(V4L2_MEMORY_USERPTR, &count)
+			var length uint32
+			_, err := d.queryBuffer(0, &length)
+			return err
+		}},
+		{"queue buffer twice", func(d *fakeDevice) error {
+			count := uint32(2)
+			d.requestBuffers(V4L2_MEMORY_MMAP, &count)
+			var length uint32
+			d.queryBuffer(0, &length)
+			d.enqueueBuffer(0)
+			return d.enqueueBuffer(0)
+		}},
+		{"queue mmap buffer as user buffer", func(d *fakeDevice) error {
+			count := uint32(2)
+			d.requestBuffers(V4L2_MEMORY_MMAP, &count)
+			return d.enqueueUserBuffer(0, make([]byte, 1024))
+		}},
+		{"export user buffer", func(d *fakeDevice) error {
+			count := uint32(2)
+			d.requestBuffers(V4L2_MEMORY_USERPTR, &count)
+			_, err := d.exportBuffer(0, 0)
+			return err
+		}},
+		{"start streaming without buffers", func(d *fakeDevice) error {
+			return d.startStreaming()
+		}},
+		{"dequeue without streaming", func(d *fakeDevice) error {
+			_, err := d.dequeueBuffer(V4L2_MEMORY_MMAP)
+			return err
+		}},
+		{"multiplanar format of single-planar device", func(d *fakeDevice) error {
+			_, err := d.getImageFormatMplane()
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDevice(DefaultFakeConfig())
+			d.setBufferType(V4L2_BUF_TYPE_VIDEO_CAPTURE)
+			defer d.close()
+
+			err := tt.call(d)
+			if !errors.Is(err, unix.EINVAL) {
+				t.Errorf("got %v, want EINVAL", err)
+			}
+			var ioctlErr *IoctlError
+			if !errors.As(err, &ioctlErr) {
+				t.Errorf("%v is not an IoctlError", err)
+			}
+		})
+	}
+}
+
+func TestFakeEmptyConfig(t *testing.T) {
+	cam := openTestFake(t, FakeConfig{Card: "Empty"})
+
+	if formats := cam.GetSupportedFormats(); len(formats) != 0 {
+		t.Errorf("got %d formats, want 0", len(formats))
+	}
+	if _, _, _, err := cam.SetImageFormat(EncodeFormat("YUYV"), 640, 480); !errors.Is(err, unix.EINVAL) {
+		t.Errorf("SetImageFormat = %v, want EINVAL", err)
+	}
+}
+
+func TestFakeStopWithHeldFrame(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+	cam.releaseTimeout = 50 * time.Millisecond
+
+	if err := cam.SetBufferCount(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := cam.GetFrameWithMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The calling goroutine holds the frame, so waiting would never end
+	if err = cam.StopStreaming(); !errors.Is(err, ErrFramesHeld) {
+		t.Errorf("StopStreaming with a held frame = %v, want ErrFramesHeld", err)
+	}
+
+	// Streaming goes on with the frame queued again once released
+	if err = frame.Release(); err != nil {
+		t.Fatal(err)
+	}
+	captureTestFrames(t, cam, 4, 640*480*2)
+
+	// Frames released by another goroutine let stopping proceed
+	cam.releaseTimeout = 5 * time.Second
+	if err = cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err = cam.GetFrameWithMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		frame.Release()
+	}()
+	if err = cam.StopStreaming(); err != nil {
+		t.Errorf("StopStreaming after the frame is released = %v", err)
+	}
+	if !frame.Released() {
+		t.Error("StopStreaming returned before the frame was released")
+	}
+
+	if err = cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	captureTestFrames(t, cam, 2, 640*480*2)
+	if err = cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err = cam.GetFrameWithMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		frame.Release()
+	}()
+	if err = cam.Close(); err != nil {
+		t.Errorf("Close after the frame is released = %v", err)
+	}
+}
+
+// Close gives up waiting for held frames, but closes the device anyway
+func TestFakeCloseWithHeldFrame(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+	cam.releaseTimeout = 50 * time.Millisecond
+
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := cam.GetFrameWithMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := frame.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = cam.Close(); !errors.Is(err, ErrFramesHeld) {
+		t.Errorf("Close with a held frame = %v, want ErrFramesHeld", err)
+	}
+	if !cam.dev.(*fakeDevice).closed {
+		t.Error("device is open after Close timed out")
+	}
+	if err = cam.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("second Close = %v, want ErrClosed", err)
+	}
+	if _, err = cam.GetFrameWithMetadata(); err == nil {
+		t.Error("GetFrameWithMetadata after Close succeeded")
+	}
+
+	// Abandoned frame stays readable until it is released
+	if !bytes.Equal(frame.Bytes(), data.Bytes()) {
+		t.Error("held frame changed after Close")
+	}
+	if err = frame.Release(); err != nil {
+		t.Errorf("Release after Close = %v", err)
+	}
+}
+
+// Controls are set from other goroutines while frames are captured
+func TestFakeConcurrentControls(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for i := int32(0); ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := cam.SetControl(ControlID(V4L2_CID_BASE), i%256); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := cam.GetControl(ControlID(V4L2_CID_BASE)); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	captureTestFrames(t, cam, 10, 640*480*2)
+	close(done)
+	if err := <-errs; err != nil {
+		t.Errorf("control failed while capturing: %v", err)
+	}
+}
@@ -29,6 +29,162 @@ func (s FrameSize) GetString() string {
 	}
 }
 
+// Image format negotiated with the driver, including the memory layout
+// of frames. Lines may be padded by the driver, so BytesPerLine
+// is not necessarily width times bytes per pixel
+type ImageFormat struct {
+	PixelFormat PixelFormat
+	Width       uint32
+	Height      uint32
+	// Field order, see V4L2_FIELD_* constants
+	Field uint32
+	// Length of a line of the first plane in bytes, including padding.
+	// 0 for compressed formats
+	BytesPerLine uint32
+	// Size of a frame in bytes, of all planes for single-planar devices
+	SizeImage uint32
+	// Colorimetry, see V4L2_COLORSPACE_*, V4L2_YCBCR_ENC_*,
+	// V4L2_QUANTIZATION_* and V4L2_XFER_FUNC_* constants.
+	// 0 means the default for the colorspace
+	Colorspace    uint32
+	YCbCrEncoding uint32
+	Quantization  uint32
+	XferFunc      uint32
+	// Format flags, see V4L2_PIX_FMT_FLAG_* constants
+	Flags uint32
+	// Layout of memory planes. Formats of single-planar devices have
+	// a single plane with the same BytesPerLine and SizeImage
+	Planes []PlaneFormat
+}
+
+// Layout of a memory plane of a frame
+type PlaneFormat struct {
+	BytesPerLine uint32
+	SizeImage    uint32
+}
+
+func newImageFormat(pix *v4l2_pix_format) ImageFormat {
+	f := ImageFormat{
+		PixelFormat:  PixelFormat(pix.Pixelformat),
+		Width:        pix.Width,
+		Height:       pix.Height,
+		Field:        pix.Field,
+		BytesPerLine: pix.Bytesperline,
+		SizeImage:    pix.Sizeimage,
+		Colorspace:   pix.Colorspace,
+		Planes:       []PlaneFormat{{pix.Bytesperline, pix.Sizeimage}},
+	}
+
+	// Extended fields are only valid if the driver set the magic value
+	if pix.Priv == V4L2_PIX_FMT_PRIV_MAGIC {
+		f.YCbCrEncoding = pix.Ycbcr_enc
+		f.Quantization = pix.Quantization
+		f.XferFunc = pix.Xfer_func
+		f.Flags = pix.Flags
+	}
+	return f
+}
+
+func newImageFormatMplane(pix *v4l2_pix_format_mplane) ImageFormat {
+	f := ImageFormat{
+		PixelFormat:   PixelFormat(pix.Pixelformat),
+		Width:         pix.Width,
+		Height:        pix.Height,
+		Field:         pix.Field,
+		Colorspace:    pix.Colorspace,
+		YCbCrEncoding: uint32(pix.Ycbcr_enc),
+		Quantization:  uint32(pix.Quantization),
+		XferFunc:      uint32(pix.Xfer_func),
+		Flags:         uint32(pix.Flags),
+	}
+
+	for p := 0; p < int(pix.Num_planes) && p < len(pix.Plane_fmt); p++ {
+		plane := pix.Plane_fmt[p]
+		f.Planes = append(f.Planes, PlaneFormat{plane.Bytesperline, plane.Sizeimage})
+		f.SizeImage += plane.Sizeimage
+	}
+	if len(f.Planes) > 0 {
+		f.BytesPerLine = f.Planes[0].BytesPerLine
+	}
+	return f
+}
+
+func (f ImageFormat) pix() v4l2_pix_format {
+	return v4l2_pix_format{
+		Width:        f.Width,
+		Height:       f.Height,
+		Pixelformat:  uint32(f.PixelFormat),
+		Field:        f.Field,
+		Bytesperline: f.BytesPerLine,
+		Sizeimage:    f.SizeImage,
+		Colorspace:   f.Colorspace,
+		Priv:         V4L2_PIX_FMT_PRIV_MAGIC,
+		Flags:        f.Flags,
+		Ycbcr_enc:    f.YCbCrEncoding,
+		Quantization: f.Quantization,
+		Xfer_func:    f.XferFunc,
+	}
+}
+
+func (f ImageFormat) pixMplane() v4l2_pix_format_mplane {
+	pix := v4l2_pix_format_mplane{
+		Width:        f.Width,
+		Height:       f.Height,
+		Pixelformat:  uint32(f.PixelFormat),
+		Field:        f.Field,
+		Colorspace:   f.Colorspace,
+		Flags:        uint8(f.Flags),
+		Ycbcr_enc:    uint8(f.YCbCrEncoding),
+		Quantization: uint8(f.Quantization),
+		Xfer_func:    uint8(f.XferFunc),
+	}
+
+	for p, plane := range f.Planes {
+		if p == len(pix.Plane_fmt) {
+			break
+		}
+		pix.Plane_fmt[p] = v4l2_plane_pix_format{Sizeimage: plane.SizeImage, Bytesperline: plane.BytesPerLine}
+		pix.Num_planes++
+	}
+	return pix
+}
+
+// Fraction of a second, as used by V4L2 to express frame intervals
+type Fraction struct {
+	Numerator   uint32
+	Denominator uint32
+}
+
+// Returns number of frames per second for a frame interval
+// Returns '0' if the fraction is not valid
+func (f Fraction) FPS() float32 {
+	if f.Numerator == 0 {
+		return 0
+	}
+	return float32(f.Denominator) / float32(f.Numerator)
+}
+
+// Struct that describes frame interval supported by a webcam
+// for a given image format and frame size.
+// For discrete intervals min and max values will be the same and
+// step value will be equal to '0/0'
+type FrameInterval struct {
+	MinInterval  Fraction
+	MaxInterval  Fraction
+	StepInterval Fraction
+}
+
+// Returns string representation of frame interval, e.g.
+// 1/30 for discrete intervals and
+// Max: 1/5   Min: 1/60   Step: 1/1 for stepwise/continuous intervals
+func (i FrameInterval) GetString() string {
+	if i.StepInterval.Numerator == 0 && i.StepInterval.Denominator == 0 {
+		return fmt.Sprintf("%d/%d", i.MinInterval.Numerator, i.MinInterval.Denominator)
+	} else {
+		return fmt.Sprintf("Max: %d/%d   Min: %d/%d   Step: %d/%d", i.MaxInterval.Numerator, i.MaxInterval.Denominator, i.MinInterval.Numerator, i.MinInterval.Denominator, i.StepInterval.Numerator, i.StepInterval.Denominator)
+	}
+}
+
 // Functions allow the conversion of PixelFormats to and from human readable 4CC strings
 // ie; "YUYV" to 0x55595659 and vice versa
 func EncodeFormat(value string) PixelFormat {
@@ -0,0 +1,102 @@
+package webcam
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Driver padding lines of packed formats to a multiple of 64 bytes at 320x240
+func paddingTestConfig() FakeConfig {
+	config := DefaultFakeConfig()
+	config.LinePadding = 64
+	return config
+}
+
+func TestTryImageFormat(t *testing.T) {
+	cam := openTestFake(t, paddingTestConfig())
+
+	current, err := cam.GetImageFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tried, err := cam.TryImageFormat(ImageFormat{PixelFormat: EncodeFormat("RGB3"), Width: 320, Height: 240})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tried.PixelFormat != EncodeFormat("RGB3") || tried.Width != 320 || tried.Height != 240 {
+		t.Errorf("tried format is %s %dx%d, want RGB3 320x240", DecodeFormat(tried.PixelFormat), tried.Width, tried.Height)
+	}
+	if tried.BytesPerLine != 320*3+64 || tried.SizeImage != (320*3+64)*240 {
+		t.Errorf("tried format has %d bytes per line and %d per frame, want padded lines", tried.BytesPerLine, tried.SizeImage)
+	}
+
+	// Trying a size the camera does not offer adjusts it to the closest one
+	tried, err = cam.TryImageFormat(ImageFormat{PixelFormat: EncodeFormat("YUYV"), Width: 300, Height: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tried.Width != 320 || tried.Height != 240 {
+		t.Errorf("tried 300x200 is adjusted to %dx%d, want 320x240", tried.Width, tried.Height)
+	}
+
+	after, err := cam.GetImageFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.PixelFormat != current.PixelFormat || after.Width != current.Width || after.Height != current.Height ||
+		after.BytesPerLine != current.BytesPerLine || after.SizeImage != current.SizeImage {
+		t.Errorf("format changed from %s %dx%d to %s %dx%d by trying formats",
+			DecodeFormat(current.PixelFormat), current.Width, current.Height,
+			DecodeFormat(after.PixelFormat), after.Width, after.Height)
+	}
+}
+
+// Frames with padded lines decode like tightly packed ones given the layout
+// of the current format
+func TestImageFormatLayout(t *testing.T) {
+	for _, format := range []string{"YUYV", "RGB3"} {
+		t.Run(format, func(t *testing.T) {
+			cam := openTestFake(t, paddingTestConfig())
+			if _, _, _, err := cam.SetImageFormat(EncodeFormat(format), 320, 240); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := cam.GetImageFormat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			line := fakeLineSizes(uint32(f.PixelFormat), 320)[0]
+			if f.BytesPerLine != line+64 {
+				t.Fatalf("format has %d bytes per line, want %d", f.BytesPerLine, line+64)
+			}
+
+			frame := getTestFrame(t, cam)
+			defer frame.Release()
+			if len(frame.Bytes()) != int(f.SizeImage) {
+				t.Fatalf("frame has %d bytes, want %d", len(frame.Bytes()), f.SizeImage)
+			}
+
+			packed := make([]byte, fakeFrameSize(uint32(f.PixelFormat), 320, 240))
+			renderFakeFrame(packed, fakePattern(320, 240, frame.Sequence), uint32(f.PixelFormat))
+			want, _, err := Compress(packed, format, 320, 240, 90, "", 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, _, err := CompressLayout(frame.Bytes(), format, 320, 240, f.Layout(), 90, "", 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Error("padded frame compresses differently from the packed frame")
+			}
+
+			// Without the layout, padding shifts every line but the first
+			skewed, _, err := Compress(frame.Bytes(), format, 320, 240, 90, "", 0, 0)
+			if err == nil && bytes.Equal(skewed, want) {
+				t.Error("padded frame compressed as packed matches the packed frame")
+			}
+		})
+	}
+}
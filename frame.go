@@ -0,0 +1,177 @@
+package webcam
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Frame captured by a Camera alongside with the metadata reported by the driver.
+// Data of the frame is driver memory, which is reused for another frame once
+// the frame is released, so it must not be accessed after Release.
+// Builds with the webcamdebug tag detect such access, see frame_debug.go
+type Frame struct {
+	// Index of the buffer holding the frame, to be passed to ReleaseFrame
+	Index uint32
+	// Sequence number of the frame, gaps indicate dropped frames
+	Sequence uint32
+	// Time the frame was captured, on the clock given by TimestampType
+	Timestamp time.Duration
+	// Buffer flags, see V4L2_BUF_FLAG_* constants
+	Flags uint32
+	// Field order of the frame, see V4L2_FIELD_* constants
+	Field uint32
+	// SMPTE timecode, nil if the driver did not provide one
+	Timecode *Timecode
+
+	data   []byte
+	planes [][]byte
+
+	// Camera the buffer is returned to, nil for clones
+	owner *Camera
+	// Accessed atomically, set once the frame is released
+	released int32
+}
+
+// SMPTE timecode of a frame
+type Timecode struct {
+	Type     uint32
+	Flags    uint32
+	Frames   uint8
+	Seconds  uint8
+	Minutes  uint8
+	Hours    uint8
+	Userbits [4]uint8
+}
+
+// Returns frame data
+func (f *Frame) Bytes() []byte {
+	f.checkAccess()
+	return f.data
+}
+
+// Returns frame data split into planes. Frames of single-planar devices
+// and formats consist of a single plane holding the whole frame
+func (f *Frame) Planes() [][]byte {
+	f.checkAccess()
+	if f.planes == nil {
+		return [][]byte{f.data}
+	}
+	return f.planes
+}
+
+// Return the buffer of the frame to the driver. Fails with ErrFrameReleased
+// if the frame has already been released, by Release or by ReleaseFrame
+func (f *Frame) Release() error {
+	if f.owner != nil {
+		return f.owner.release(f)
+	}
+
+	if !atomic.CompareAndSwapInt32(&f.released, 0, 1) {
+		return ErrFrameReleased
+	}
+	return nil
+}
+
+// Returns true once the frame has been released
+func (f *Frame) Released() bool {
+	return atomic.LoadInt32(&f.released) != 0
+}
+
+// Returns a copy of the frame with its data copied out of driver memory.
+// The copy stays valid after the frame is released, releasing
+// the copy has no effect on the frame
+func (f *Frame) Clone() (*Frame, error) {
+	if f.Released() {
+		return nil, ErrFrameReleased
+	}
+
+	c := &Frame{
+		Index:     f.Index,
+		Sequence:  f.Sequence,
+		Timestamp: f.Timestamp,
+		Flags:     f.Flags,
+		Field:     f.Field,
+	}
+
+	if f.Timecode != nil {
+		timecode := *f.Timecode
+		c.Timecode = &timecode
+	}
+
+	if f.planes == nil {
+		c.data = append([]byte(nil), f.data...)
+		return c, nil
+	}
+
+	c.planes = make([][]byte, len(f.planes))
+	for p, plane := range f.planes {
+		c.planes[p] = append([]byte(nil), plane...)
+	}
+	if len(c.planes) > 0 {
+		c.data = c.planes[0]
+	}
+	return c, nil
+}
+
+func (f *Frame) checkAccess() {
+	if debugFrames && f.Released() {
+		panic("webcam: frame accessed after release")
+	}
+}
+
+// Returns the clock of the timestamp,
+// one of V4L2_BUF_FLAG_TIMESTAMP_UNKNOWN, _MONOTONIC or _COPY
+func (f *Frame) TimestampType() uint32 {
+	return f.Flags & V4L2_BUF_FLAG_TIMESTAMP_MASK
+}
+
+// Returns true if the timestamp was taken at the start of exposure
+// rather than at the end of frame
+func (f *Frame) TimestampStartOfExposure() bool {
+	return (f.Flags & V4L2_BUF_FLAG_TSTAMP_SRC_MASK) == V4L2_BUF_FLAG_TSTAMP_SRC_SOE
+}
+
+// Returns true if the driver flagged the frame data as possibly corrupted
+func (f *Frame) HasError() bool {
+	return (f.Flags & V4L2_BUF_FLAG_ERROR) != 0
+}
+
+// Returns true for key frames of compressed streams
+func (f *Frame) IsKeyFrame() bool {
+	return (f.Flags & V4L2_BUF_FLAG_KEYFRAME) != 0
+}
+
+// Returns true for predicted frames of compressed streams
+func (f *Frame) IsPFrame() bool {
+	return (f.Flags & V4L2_BUF_FLAG_PFRAME) != 0
+}
+
+// Returns true for bi-directionally predicted frames of compressed streams
+func (f *Frame) IsBFrame() bool {
+	return (f.Flags & V4L2_BUF_FLAG_BFRAME) != 0
+}
+
+func newFrame(buffer *v4l2_buffer, data []byte) *Frame {
+	f := &Frame{
+		Index:     buffer.index,
+		Sequence:  buffer.sequence,
+		Timestamp: time.Duration(buffer.timestamp.Nano()),
+		Flags:     buffer.flags,
+		Field:     buffer.field,
+		data:      data,
+	}
+
+	if (buffer.flags & V4L2_BUF_FLAG_TIMECODE) != 0 {
+		f.Timecode = &Timecode{
+			Type:     buffer.timecode._type,
+			Flags:    buffer.timecode.flags,
+			Frames:   buffer.timecode.frames,
+			Seconds:  buffer.timecode.seconds,
+			Minutes:  buffer.timecode.minutes,
+			Hours:    buffer.timecode.hours,
+			Userbits: buffer.timecode.userbits,
+		}
+	}
+
+	return f
+}
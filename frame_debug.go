@@ -0,0 +1,29 @@
+//go:build webcamdebug
+// +build webcamdebug
+
+package webcam
+
+import "golang.org/x/sys/unix"
+
+// Debug build, enabled with the webcamdebug build tag. Frames accessed
+// after release make Bytes and Planes panic, and buffers mapped by Camera
+// are made inaccessible while the driver owns them, so that reading
+// a slice kept from a released frame faults right away
+const debugFrames = true
+
+// Pattern written to buffers that can't be protected
+const poisonByte = 0xdb
+
+func protectBuffer(buffer []byte, accessible bool) {
+	prot := unix.PROT_NONE
+	if accessible {
+		prot = unix.PROT_READ | unix.PROT_WRITE
+	}
+	unix.Mprotect(buffer, prot)
+}
+
+func poisonBuffer(buffer []byte) {
+	for i := range buffer {
+		buffer[i] = poisonByte
+	}
+}
@@ -0,0 +1,108 @@
+//go:build webcamdebug
+// +build webcamdebug
+
+package webcam
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+// Runs fn and returns the value it panicked with, nil if it did not panic
+func testPanic(fn func()) (value interface{}) {
+	defer func() { value = recover() }()
+	fn()
+	return nil
+}
+
+func TestDebugFrameAccess(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	frame := getTestFrame(t, cam)
+	if v := testPanic(func() { frame.Bytes() }); v != nil {
+		t.Fatalf("Bytes of a held frame panicked: %v", v)
+	}
+	if err := frame.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := testPanic(func() { frame.Bytes() }); v == nil {
+		t.Error("Bytes of a released frame did not panic")
+	}
+	if v := testPanic(func() { frame.Planes() }); v == nil {
+		t.Error("Planes of a released frame did not panic")
+	}
+}
+
+// Slices kept from released frames fault, as mapped buffers are protected
+func TestDebugMmapBufferProtected(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	frame := getTestFrame(t, cam)
+	data := frame.Bytes()
+	if err := frame.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	var sink byte
+	if v := testPanic(func() { sink = data[0] }); v == nil {
+		t.Errorf("reading a released mapped buffer did not fault, read %#x", sink)
+	}
+}
+
+// User buffers are poisoned on release, but not before the driver fills them
+func TestDebugUserBufferPoisoned(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	buffers := [][]byte{make([]byte, 640*480*2), make([]byte, 640*480*2)}
+	if err := cam.SetUserBuffers(buffers); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := getTestFrame(t, cam)
+	data := frame.Bytes()
+	poisoned := true
+	for _, b := range data {
+		if b != poisonByte {
+			poisoned = false
+			break
+		}
+	}
+	if poisoned {
+		t.Fatal("frame captured into a poisoned buffer")
+	}
+
+	if err := frame.Release(); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range data {
+		if b != poisonByte {
+			t.Fatalf("byte %d of a released user buffer is %#x, want %#x", i, b, poisonByte)
+		}
+	}
+}
+
+func TestDebugSharedFrameAccess(t *testing.T) {
+	b := NewBroadcaster(nil)
+	first, err := b.Subscribe(DropNewest, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.Subscribe(DropNewest, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverTestFrames(b, 1)
+	f1, f2 := <-first.Frames(), <-second.Frames()
+
+	// Frame is still held by the other subscriber, access is an error anyway
+	f1.Release()
+	if v := testPanic(func() { f1.Bytes() }); v == nil {
+		t.Error("Bytes of a released shared frame did not panic")
+	}
+	if v := testPanic(func() { f2.Bytes() }); v != nil {
+		t.Errorf("Bytes of a shared frame still held panicked: %v", v)
+	}
+	f2.Release()
+}
@@ -0,0 +1,11 @@
+//go:build !webcamdebug
+// +build !webcamdebug
+
+package webcam
+
+// Release build, see frame_debug.go
+const debugFrames = false
+
+func protectBuffer(buffer []byte, accessible bool) {}
+
+func poisonBuffer(buffer []byte) {}
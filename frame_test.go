@@ -0,0 +1,248 @@
+package webcam
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Dequeues a frame after starting streaming if necessary
+func getTestFrame(t *testing.T, cam *Camera) *Frame {
+	t.Helper()
+
+	if !cam.streaming {
+		if err := cam.StartStreaming(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := cam.GetFrameWithMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestFrameMetadata(t *testing.T) {
+	config := DefaultFakeConfig()
+	config.ErrorEvery = 3
+	cam := openTestFake(t, config)
+
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	var last *Frame
+	for i := 0; i < 6; i++ {
+		if err := cam.WaitForFrame(1); err != nil {
+			t.Fatal(err)
+		}
+		frame, err := cam.GetFrameWithMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if last != nil && frame.Sequence <= last.Sequence {
+			t.Errorf("frame %d has sequence %d after %d", i, frame.Sequence, last.Sequence)
+		}
+		if last != nil && frame.Timestamp <= last.Timestamp {
+			t.Errorf("frame %d has timestamp %v after %v", i, frame.Timestamp, last.Timestamp)
+		}
+		if frame.TimestampType() != V4L2_BUF_FLAG_TIMESTAMP_MONOTONIC {
+			t.Errorf("frame %d has timestamp type %#x, want monotonic", i, frame.TimestampType())
+		}
+		if frame.TimestampStartOfExposure() {
+			t.Errorf("frame %d is timestamped at the start of exposure, want end of frame", i)
+		}
+		if frame.Field != V4L2_FIELD_NONE {
+			t.Errorf("frame %d has field %d, want progressive", i, frame.Field)
+		}
+		if want := (i+1)%3 == 0; frame.HasError() != want {
+			t.Errorf("frame %d has error %v, want %v", i, frame.HasError(), want)
+		}
+		if frame.IsKeyFrame() {
+			t.Errorf("uncompressed frame %d is a key frame", i)
+		}
+
+		last = frame
+		if err = frame.Release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A consumer falling behind finds the frames it missed as a sequence gap
+func TestFrameMetadataDropped(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	if _, err := cam.SetFrameRate(30); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	sequence := func() uint32 {
+		t.Helper()
+		if err := cam.WaitForFrame(1); err != nil {
+			t.Fatal(err)
+		}
+		frame, err := cam.GetFrameWithMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer frame.Release()
+		return frame.Sequence
+	}
+
+	first := sequence()
+	time.Sleep(200 * time.Millisecond)
+	if next := sequence(); next < first+3 {
+		t.Errorf("frame after 200ms at 30 fps has sequence %d after %d, want a gap", next, first)
+	}
+}
+
+func TestFrameMetadataCompressed(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	if _, _, _, err := cam.SetImageFormat(EncodeFormat("MJPG"), 320, 240); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := cam.GetFrameWithMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer frame.Release()
+
+	if !frame.IsKeyFrame() || frame.IsPFrame() || frame.IsBFrame() {
+		t.Errorf("JPEG frame has flags %#x, want a key frame", frame.Flags)
+	}
+	if frame.HasError() {
+		t.Error("frame has an error without errors configured")
+	}
+}
+
+func TestFrameRelease(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+	if err := cam.SetBufferCount(2); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := getTestFrame(t, cam)
+	if frame.Released() {
+		t.Fatal("frame is released before Release")
+	}
+	if err := frame.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if !frame.Released() {
+		t.Error("frame is not released after Release")
+	}
+	if err := frame.Release(); err != ErrFrameReleased {
+		t.Errorf("second Release = %v, want ErrFrameReleased", err)
+	}
+
+	// Release after ReleaseFrame, also once the buffer is held by a later frame
+	frame = getTestFrame(t, cam)
+	if err := cam.ReleaseFrame(frame.Index); err != nil {
+		t.Fatal(err)
+	}
+	if err := frame.Release(); err != ErrFrameReleased {
+		t.Errorf("Release after ReleaseFrame = %v, want ErrFrameReleased", err)
+	}
+	if err := cam.ReleaseFrame(frame.Index); err == nil {
+		t.Error("second ReleaseFrame succeeded")
+	}
+
+	var later []*Frame
+	for i := uint32(0); i < cam.bufcount; i++ {
+		later = append(later, getTestFrame(t, cam))
+	}
+	if err := frame.Release(); err != ErrFrameReleased {
+		t.Errorf("Release of a frame whose buffer is held again = %v, want ErrFrameReleased", err)
+	}
+	for _, f := range later {
+		if f.Released() {
+			t.Errorf("frame %d was released by the release of an earlier frame", f.Sequence)
+		}
+		if err := f.Release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFrameClone(t *testing.T) {
+	tests := []struct {
+		name   string
+		config FakeConfig
+		format string
+		planes int
+	}{
+		{"single plane", DefaultFakeConfig(), "YUYV", 1},
+		{"multiplanar", multiplanarTestConfig(), "NM12", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cam := openTestFake(t, tt.config)
+			if _, _, _, err := cam.SetImageFormat(EncodeFormat(tt.format), 320, 240); err != nil {
+				t.Fatal(err)
+			}
+			if err := cam.SetBufferCount(1); err != nil {
+				t.Fatal(err)
+			}
+
+			frame := getTestFrame(t, cam)
+			clone, err := frame.Clone()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if clone.Sequence != frame.Sequence || clone.Timestamp != frame.Timestamp || clone.Flags != frame.Flags {
+				t.Error("clone has other metadata than the frame")
+			}
+			if len(clone.Planes()) != tt.planes {
+				t.Fatalf("clone has %d planes, want %d", len(clone.Planes()), tt.planes)
+			}
+			planes := make([][]byte, tt.planes)
+			for p, plane := range frame.Planes() {
+				planes[p] = append([]byte(nil), plane...)
+				if !bytes.Equal(clone.Planes()[p], plane) {
+					t.Errorf("plane %d of the clone differs from the frame", p)
+				}
+			}
+			if !bytes.Equal(clone.Bytes(), frame.Bytes()) {
+				t.Error("data of the clone differs from the frame")
+			}
+
+			// Buffer is reused for the next frame, the clone stays as it was
+			if err = frame.Release(); err != nil {
+				t.Fatal(err)
+			}
+			captureTestFrames(t, cam, 2, 0)
+			for p, plane := range clone.Planes() {
+				if !bytes.Equal(plane, planes[p]) {
+					t.Errorf("plane %d of the clone changed with the buffer", p)
+				}
+			}
+
+			if _, err = frame.Clone(); err != ErrFrameReleased {
+				t.Errorf("Clone of a released frame = %v, want ErrFrameReleased", err)
+			}
+			if err = clone.Release(); err != nil {
+				t.Errorf("Release of a clone = %v", err)
+			}
+			if err = clone.Release(); err != ErrFrameReleased {
+				t.Errorf("second Release of a clone = %v, want ErrFrameReleased", err)
+			}
+		})
+	}
+}
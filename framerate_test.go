@@ -0,0 +1,153 @@
+package webcam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// Frame interval enumeration as drivers fill it in
+func testFrmivalenum(t *testing.T, _type uint32, union interface{}) *v4l2_frmivalenum {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, NativeByteOrder, union); err != nil {
+		t.Fatal(err)
+	}
+	frmivalenum := &v4l2_frmivalenum{_type: _type}
+	copy(frmivalenum.union[:], buf.Bytes())
+	return frmivalenum
+}
+
+func TestFrameIntervalOf(t *testing.T) {
+	tests := []struct {
+		name  string
+		_type uint32
+		union interface{}
+		want  FrameInterval
+	}{
+		{"discrete", V4L2_FRMIVAL_TYPE_DISCRETE, v4l2_fract{1, 30},
+			FrameInterval{MinInterval: Fraction{1, 30}, MaxInterval: Fraction{1, 30}}},
+		{"stepwise", V4L2_FRMIVAL_TYPE_STEPWISE, v4l2_frmival_stepwise{v4l2_fract{1, 60}, v4l2_fract{1, 5}, v4l2_fract{1, 60}},
+			FrameInterval{MinInterval: Fraction{1, 60}, MaxInterval: Fraction{1, 5}, StepInterval: Fraction{1, 60}}},
+		{"continuous", V4L2_FRMIVAL_TYPE_CONTINUOUS, v4l2_frmival_stepwise{v4l2_fract{1, 120}, v4l2_fract{1, 1}, v4l2_fract{1, 1}},
+			FrameInterval{MinInterval: Fraction{1, 120}, MaxInterval: Fraction{1, 1}, StepInterval: Fraction{1, 1}}},
+		{"unknown type", 42, v4l2_fract{1, 30}, FrameInterval{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := frameIntervalOf(testFrmivalenum(t, tt._type, tt.union))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got.GetString(), tt.want.GetString())
+			}
+		})
+	}
+}
+
+// Returns configuration of a fake camera offering YUYV with the given intervals
+func frameRateTestConfig(intervals ...FrameInterval) FakeConfig {
+	config := DefaultFakeConfig()
+	config.Formats = config.Formats[:1]
+	config.Formats[0].Intervals = intervals
+	return config
+}
+
+var (
+	testDiscreteIntervals = []FrameInterval{
+		{MinInterval: Fraction{1, 30}, MaxInterval: Fraction{1, 30}},
+		{MinInterval: Fraction{1, 15}, MaxInterval: Fraction{1, 15}},
+		{MinInterval: Fraction{1, 5}, MaxInterval: Fraction{1, 5}},
+	}
+	testStepwiseInterval   = FrameInterval{MinInterval: Fraction{1, 60}, MaxInterval: Fraction{1, 5}, StepInterval: Fraction{1, 60}}
+	testContinuousInterval = FrameInterval{MinInterval: Fraction{1, 120}, MaxInterval: Fraction{1, 1}, StepInterval: Fraction{1, 1}}
+)
+
+func TestGetSupportedFrameIntervals(t *testing.T) {
+	tests := []struct {
+		name      string
+		intervals []FrameInterval
+	}{
+		{"discrete", testDiscreteIntervals},
+		{"stepwise", []FrameInterval{testStepwiseInterval}},
+		{"continuous", []FrameInterval{testContinuousInterval}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cam := openTestFake(t, frameRateTestConfig(tt.intervals...))
+
+			got := cam.GetSupportedFrameIntervals(EncodeFormat("YUYV"), 320, 240)
+			if len(got) != len(tt.intervals) {
+				t.Fatalf("got %d intervals, want %d", len(got), len(tt.intervals))
+			}
+			for i := range got {
+				if got[i] != tt.intervals[i] {
+					t.Errorf("interval %d is %s, want %s", i, got[i].GetString(), tt.intervals[i].GetString())
+				}
+			}
+
+			if got := cam.GetSupportedFrameIntervals(EncodeFormat("YUYV"), 100, 100); len(got) != 0 {
+				t.Errorf("got %d intervals of an unsupported size, want 0", len(got))
+			}
+			if got := cam.GetSupportedFrameIntervals(EncodeFormat("RGB3"), 320, 240); len(got) != 0 {
+				t.Errorf("got %d intervals of an unsupported format, want 0", len(got))
+			}
+		})
+	}
+}
+
+// SetFrameRate returns the rate the driver settled on, not the requested one
+func TestSetFrameRateAccepted(t *testing.T) {
+	tests := []struct {
+		name      string
+		intervals []FrameInterval
+		fps       float32
+		want      float32
+	}{
+		{"discrete exact", testDiscreteIntervals, 15, 15},
+		{"discrete closest", testDiscreteIntervals, 20, 15},
+		{"discrete closest above", testDiscreteIntervals, 12, 15},
+		{"discrete above range", testDiscreteIntervals, 60, 30},
+		{"discrete below range", testDiscreteIntervals, 1, 5},
+		{"stepwise within range", []FrameInterval{testStepwiseInterval}, 12, 12},
+		{"stepwise out of range", []FrameInterval{testStepwiseInterval}, 100, 60},
+		{"continuous fractional", []FrameInterval{testContinuousInterval}, 29.97, 29.97},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cam := openTestFake(t, frameRateTestConfig(tt.intervals...))
+
+			got, err := cam.SetFrameRate(tt.fps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(float64(got-tt.want)) > 0.001 {
+				t.Errorf("SetFrameRate(%v) = %v, want %v", tt.fps, got, tt.want)
+			}
+
+			current, err := cam.GetFrameRate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if current != got {
+				t.Errorf("GetFrameRate = %v, want %v", current, got)
+			}
+		})
+	}
+}
+
+func TestSetFrameRateInvalid(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	for _, fps := range []float32{0, -30} {
+		if _, err := cam.SetFrameRate(fps); err == nil {
+			t.Errorf("SetFrameRate(%v) succeeded", fps)
+		}
+	}
+}
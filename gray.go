@@ -0,0 +1,139 @@
+package webcam
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+)
+
+// Greyscale format with samples of the given bit depth
+type grayFormat struct {
+	bits    uint
+	packing rawPacking
+}
+
+var grayFormats = map[string]grayFormat{
+	"GREY": {8, raw8},
+	"Y10 ": {10, rawUnpacked16},
+	"Y12 ": {12, rawUnpacked16},
+	"Y14 ": {14, rawUnpacked16},
+	"Y16 ": {16, rawUnpacked16},
+	"Y10P": {10, rawMIPI10},
+	"Y12P": {12, rawMIPI12},
+}
+
+// Range of luma values stretched over the 8-bit output of greyscale
+// decoders. Useful for sensors whose signal occupies a small part of
+// their range, like IR cameras. The zero value leaves the range as is
+type GrayWindow struct {
+	// Samples at or below Low become black, at or above High white.
+	// Given in the bit depth of the format, e.g. 0-1023 for Y10
+	Low  uint16
+	High uint16
+	// Use the range of each frame instead of Low and High
+	Normalize bool
+	// Fraction of the darkest and of the brightest samples ignored when
+	// normalising, so that a few hot or dead pixels do not set the range.
+	// Ignored unless Normalize is set
+	Clip float64
+}
+
+// Returns a decoder of greyscale formats GREY, Y10, Y12, Y14, Y16, Y10P
+// and Y12P that maps luma through the window. Without a window, 8-bit
+// formats are decoded to *image.Gray and deeper ones to *image.Gray16.
+// Greyscale formats are registered without a window, the window is
+// changed by registering them again with another decoder
+func GrayDecoder(window GrayWindow) Decoder {
+	return func(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout) (image.Image, error) {
+		return decodeGray(frame, format, width, height, layout, window)
+	}
+}
+
+func decodeGray(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout, window GrayWindow) (image.Image, error) {
+	f, ok := grayFormats[DecodeFormat(format)]
+	if !ok {
+		return nil, fmt.Errorf("format %v is not a greyscale format: %w", DecodeFormat(format), ErrUnsupportedFormat)
+	}
+
+	samples, err := readRawSamples(frame, layout, 0, int(width), int(height), f.packing, f.bits)
+	if err != nil {
+		return nil, err
+	}
+
+	if !window.Normalize {
+		window.Clip = 0
+	}
+
+	rect := image.Rect(0, 0, int(width), int(height))
+	if window == (GrayWindow{}) {
+		if f.bits == 8 {
+			img := image.NewGray(rect)
+			for i, v := range samples {
+				img.Pix[i] = uint8(v)
+			}
+			return img, nil
+		}
+
+		img := image.NewGray16(rect)
+		for i, v := range samples {
+			// Pixels of Gray16 are stored big endian
+			binary.BigEndian.PutUint16(img.Pix[2*i:], scaleSample(int32(v), f.bits))
+		}
+		return img, nil
+	}
+
+	low, high := window.bounds(samples, f.bits)
+	if high <= low {
+		return nil, fmt.Errorf("Invalid greyscale window %d-%d", low, high)
+	}
+
+	img := image.NewGray(rect)
+	for i, v := range samples {
+		switch {
+		case v <= low:
+			img.Pix[i] = 0
+		case v >= high:
+			img.Pix[i] = 0xff
+		default:
+			img.Pix[i] = uint8((uint32(v-low)*0xff + uint32(high-low)/2) / uint32(high-low))
+		}
+	}
+	return img, nil
+}
+
+// Returns the range of samples mapped to the output range
+func (w GrayWindow) bounds(samples []uint16, bits uint) (uint16, uint16) {
+	if !w.Normalize {
+		return w.Low, w.High
+	}
+
+	histogram := make([]int, 1<<bits)
+	for _, v := range samples {
+		histogram[v]++
+	}
+
+	clip := int(w.Clip * float64(len(samples)))
+	low := 0
+	for count := 0; low < len(histogram)-1; low++ {
+		count += histogram[low]
+		if count > clip {
+			break
+		}
+	}
+	high := len(histogram) - 1
+	for count := 0; high > 0; high-- {
+		count += histogram[high]
+		if count > clip {
+			break
+		}
+	}
+
+	// Flat frames are shown at their level rather than rejected
+	if high <= low {
+		if low == len(histogram)-1 {
+			low--
+		}
+		high = low + 1
+	}
+	return uint16(low), uint16(high)
+}
@@ -0,0 +1,126 @@
+package webcam
+
+import (
+	"errors"
+	"image"
+	"testing"
+)
+
+// Stores samples as unpacked little endian 16-bit words
+func grayTestFrame(samples ...uint16) []byte {
+	frame := make([]byte, 0, 2*len(samples))
+	for _, v := range samples {
+		frame = append(frame, byte(v), byte(v>>8))
+	}
+	return frame
+}
+
+// Decodes a single line of samples with a window
+func decodeTestGrayLine(t *testing.T, format string, frame []byte, width uint32, window GrayWindow) image.Image {
+	t.Helper()
+
+	img, err := GrayDecoder(window)(frame, EncodeFormat(format), width, 1, PackedLayout(format, width, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestGrayDepths(t *testing.T) {
+	tests := []struct {
+		format string
+		frame  []byte
+		want   []uint16
+	}{
+		{"Y10 ", grayTestFrame(0, 512, 1023), []uint16{0, 0x801f, 0xffff}},
+		{"Y12 ", grayTestFrame(0, 2048, 4095), []uint16{0, 0x8007, 0xffff}},
+		{"Y16 ", grayTestFrame(0, 0x1234, 0xffff), []uint16{0, 0x1234, 0xffff}},
+		// Lines from TestUnpackLine, samples 0x3ff, 0x001, 0x2aa and 0x155
+		{"Y10P", []byte{0xff, 0x00, 0xaa, 0x55, 0x67}, []uint16{0xffff, 0x0040, 0xaaaa, 0x5555}},
+		// Samples 0xabc and 0x123
+		{"Y12P", []byte{0xab, 0x12, 0x3c}, []uint16{0xabca, 0x1231}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			img := decodeTestGrayLine(t, tt.format, tt.frame, uint32(len(tt.want)), GrayWindow{})
+			gray, ok := img.(*image.Gray16)
+			if !ok {
+				t.Fatalf("decoded to %T, want *image.Gray16", img)
+			}
+			for x, want := range tt.want {
+				if got := gray.Gray16At(x, 0).Y; got != want {
+					t.Errorf("pixel %d is %#x, want %#x", x, got, want)
+				}
+			}
+		})
+	}
+
+	img := decodeTestGrayLine(t, "GREY", []byte{0, 128, 255}, 3, GrayWindow{})
+	if gray, ok := img.(*image.Gray); !ok || gray.Pix[1] != 128 {
+		t.Errorf("GREY decoded to %T, want *image.Gray with samples as they are", img)
+	}
+}
+
+func TestGrayWindow(t *testing.T) {
+	frame := grayTestFrame(0, 100, 200, 300, 1023)
+
+	img := decodeTestGrayLine(t, "Y10 ", frame, 5, GrayWindow{Low: 100, High: 300})
+	want := []uint8{0, 0, 128, 255, 255}
+	for x := range want {
+		if got := img.(*image.Gray).Pix[x]; got != want[x] {
+			t.Errorf("pixel %d is %d, want %d", x, got, want[x])
+		}
+	}
+
+	for _, window := range []GrayWindow{{Low: 300, High: 300}, {Low: 300, High: 100}} {
+		_, err := GrayDecoder(window)(frame, EncodeFormat("Y10 "), 5, 1, PackedLayout("Y10 ", 5, 1))
+		if err == nil {
+			t.Errorf("window %d-%d was accepted", window.Low, window.High)
+		}
+	}
+
+	_, err := GrayDecoder(GrayWindow{})(frame, EncodeFormat("YUYV"), 2, 1, PackedLayout("YUYV", 2, 1))
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("greyscale decoding of YUYV = %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+// A dead and a hot pixel stretch the range of a normalised frame,
+// unless clipped
+func TestGrayNormalize(t *testing.T) {
+	samples := []uint16{0, 1023}
+	for v := uint16(200); v < 298; v++ {
+		samples = append(samples, v)
+	}
+	frame := grayTestFrame(samples...)
+	width := uint32(len(samples))
+
+	tests := []struct {
+		name   string
+		window GrayWindow
+		want   []uint8
+	}{
+		{"full range", GrayWindow{Normalize: true}, []uint8{0, 255, 50, 74}},
+		{"clipped", GrayWindow{Normalize: true, Clip: 0.01}, []uint8{0, 255, 0, 255}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := decodeTestGrayLine(t, "Y10 ", frame, width, tt.window).(*image.Gray)
+			// Dead and hot pixel, then the darkest and brightest of the rest
+			got := []uint8{img.Pix[0], img.Pix[1], img.Pix[2], img.Pix[width-1]}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("pixels %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+
+	// Flat frames are decoded rather than rejected for an empty range
+	if _, err := GrayDecoder(GrayWindow{Normalize: true})(grayTestFrame(500, 500, 500), EncodeFormat("Y10 "), 3, 1, PackedLayout("Y10 ", 3, 1)); err != nil {
+		t.Errorf("normalising a flat frame = %v", err)
+	}
+}
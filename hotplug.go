@@ -0,0 +1,389 @@
+package webcam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Multicast group of uevents sent by the kernel
+const ueventKernelGroup = 1
+
+// What happened to a device
+type HotplugAction int
+
+const (
+	DeviceAdded HotplugAction = iota
+	DeviceRemoved
+)
+
+// Video device added or removed
+type HotplugEvent struct {
+	Action HotplugAction
+	// Device the event refers to. For removed devices, this is the
+	// information gathered when the device was seen last, if any
+	Device DeviceInfo
+	// Raw uevent properties, e.g. DEVPATH, MAJOR and MINOR
+	Properties map[string]string
+}
+
+// Opens and closes cameras as they are plugged and unplugged,
+// see HotplugWatcher.AutoOpen
+type HotplugHandler struct {
+	// Selects devices to open, all capture devices are opened if nil
+	Match func(DeviceInfo) bool
+	// Opens a device, Open if nil
+	Open func(path string) (*Camera, error)
+	// Called with the camera of an added device
+	Opened func(*Camera, DeviceInfo)
+	// Called before the camera of a removed device is closed
+	Closing func(*Camera, DeviceInfo)
+	// Called when an added device could not be opened
+	Failed func(DeviceInfo, error)
+}
+
+// Watches the kernel uevent netlink socket for video4linux devices
+// being added and removed
+type HotplugWatcher struct {
+	events chan HotplugEvent
+
+	mutex sync.Mutex
+	// Uevent socket, -1 once closed. While Run is running, it owns
+	// the socket and closes it when it returns
+	fd      int
+	closed  bool
+	running bool
+	devices map[string]DeviceInfo
+	handler *HotplugHandler
+	cameras map[string]*Camera
+	started bool
+
+	// Guards sending on events against closing it
+	sendMutex sync.RWMutex
+	finished  bool
+}
+
+// Create a watcher listening for uevents. Events are delivered once Run
+// is called. Devices present at this time are not reported
+func NewHotplugWatcher() (*HotplugWatcher, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open uevent socket: %w", err)
+	}
+
+	err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: ueventKernelGroup})
+
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Failed to bind uevent socket: %w", err)
+	}
+
+	return newHotplugWatcher(fd), nil
+}
+
+func newHotplugWatcher(fd int) *HotplugWatcher {
+	h := new(HotplugWatcher)
+	h.fd = fd
+	h.events = make(chan HotplugEvent, 16)
+	h.devices = make(map[string]DeviceInfo)
+	h.cameras = make(map[string]*Camera)
+	return h
+}
+
+// Returns channel delivering hotplug events
+// Channel is closed when Run returns. If it is not drained,
+// the oldest events are dropped to make room for new ones
+func (h *HotplugWatcher) Events() <-chan HotplugEvent {
+	return h.events
+}
+
+// Open cameras for devices that are added and close them when they are
+// removed, according to handler. Devices already present are opened
+// when Run starts. Must be called before Run
+func (h *HotplugWatcher) AutoOpen(handler HotplugHandler) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.started {
+		return errors.New("Hotplug watcher is already running")
+	}
+	h.handler = &handler
+	return nil
+}
+
+// Receive uevents until ctx is cancelled, the watcher is closed or the
+// socket fails. Events are delivered on the Events channel. Cameras opened
+// by AutoOpen are closed when they are removed and when Run returns,
+// without waiting for frames to be released, see Camera.Close
+func (h *HotplugWatcher) Run(ctx context.Context) error {
+	h.mutex.Lock()
+	if h.closed {
+		h.mutex.Unlock()
+		return ErrClosed
+	}
+	if h.started {
+		h.mutex.Unlock()
+		return errors.New("Hotplug watcher is already running")
+	}
+	h.started = true
+	h.running = true
+	fd := h.fd
+	handler := h.handler
+	h.mutex.Unlock()
+
+	defer h.finish()
+
+	if handler != nil {
+		devices, err := ListDevices()
+
+		if err != nil {
+			return err
+		}
+
+		for _, device := range devices {
+			h.added(device)
+		}
+	}
+
+	buf := make([]byte, 64*1024)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		h.mutex.Lock()
+		closed := h.closed
+		h.mutex.Unlock()
+
+		if closed {
+			return ErrClosed
+		}
+
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		count, err := unix.Poll(fds, streamWaitTimeout*1000)
+
+		if err == unix.EINTR || count == 0 {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		n, from, err := unix.Recvfrom(fd, buf, unix.MSG_DONTWAIT)
+
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// Only trust messages sent by the kernel
+		if sa, ok := from.(*unix.SockaddrNetlink); !ok || sa.Pid != 0 {
+			continue
+		}
+
+		h.handle(buf[:n])
+	}
+}
+
+// Close the watcher, Run fails afterwards. A running Run returns
+// ErrClosed within a second and closes the uevent socket itself,
+// so that the socket is not closed while it is being read
+func (h *HotplugWatcher) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.closed {
+		return ErrClosed
+	}
+	h.closed = true
+
+	if h.running {
+		return nil
+	}
+	return h.closeSocket()
+}
+
+// Close the uevent socket unless it is closed already, the mutex must be held
+func (h *HotplugWatcher) closeSocket() error {
+	if h.fd < 0 {
+		return nil
+	}
+	err := unix.Close(h.fd)
+	h.fd = -1
+	return err
+}
+
+// Process a raw uevent message, e.g.
+// "add@/devices/...\x00ACTION=add\x00SUBSYSTEM=video4linux\x00DEVNAME=video0\x00"
+func (h *HotplugWatcher) handle(msg []byte) {
+	props := parseUevent(msg)
+
+	if props["SUBSYSTEM"] != "video4linux" || props["DEVNAME"] == "" {
+		return
+	}
+
+	path := props["DEVNAME"]
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(devicePath, path)
+	}
+
+	var event HotplugEvent
+
+	switch props["ACTION"] {
+	case "add":
+		event = HotplugEvent{Action: DeviceAdded, Device: GetDeviceInfo(path), Properties: props}
+		h.added(event.Device)
+
+	case "remove":
+		h.mutex.Lock()
+		device, ok := h.devices[path]
+		h.mutex.Unlock()
+
+		if !ok {
+			device = DeviceInfo{Path: path, Name: filepath.Base(path)}
+		}
+		event = HotplugEvent{Action: DeviceRemoved, Device: device, Properties: props}
+		h.removed(device)
+
+	default:
+		return
+	}
+
+	h.sendMutex.RLock()
+	defer h.sendMutex.RUnlock()
+
+	if h.finished {
+		return
+	}
+
+	// Events are sent by the Run goroutine only, so that dropping
+	// the oldest one always makes room
+	for {
+		select {
+		case h.events <- event:
+			return
+		default:
+		}
+
+		select {
+		case <-h.events:
+		default:
+		}
+	}
+}
+
+func (h *HotplugWatcher) added(device DeviceInfo) {
+	h.mutex.Lock()
+	h.devices[device.Path] = device
+	handler := h.handler
+	_, open := h.cameras[device.Path]
+	h.mutex.Unlock()
+
+	if handler == nil || open {
+		return
+	}
+
+	if handler.Match != nil {
+		if !handler.Match(device) {
+			return
+		}
+	} else if !device.IsCapture() {
+		return
+	}
+
+	opener := handler.Open
+	if opener == nil {
+		opener = Open
+	}
+
+	cam, err := opener(device.Path)
+
+	if err != nil {
+		if handler.Failed != nil {
+			handler.Failed(device, err)
+		}
+		return
+	}
+
+	h.mutex.Lock()
+	h.cameras[device.Path] = cam
+	h.mutex.Unlock()
+
+	if handler.Opened != nil {
+		handler.Opened(cam, device)
+	}
+}
+
+func (h *HotplugWatcher) removed(device DeviceInfo) {
+	h.mutex.Lock()
+	delete(h.devices, device.Path)
+	cam, ok := h.cameras[device.Path]
+	delete(h.cameras, device.Path)
+	handler := h.handler
+	h.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if handler.Closing != nil {
+		handler.Closing(cam, device)
+	}
+	// Consumers may hold frames of a device that is gone for good
+	cam.abandon()
+}
+
+// Close cameras opened by AutoOpen, the events channel and the socket
+func (h *HotplugWatcher) finish() {
+	h.mutex.Lock()
+	h.running = false
+	h.closeSocket()
+	devices := make([]DeviceInfo, 0, len(h.cameras))
+	for path := range h.cameras {
+		device, ok := h.devices[path]
+		if !ok {
+			device = DeviceInfo{Path: path, Name: filepath.Base(path)}
+		}
+		devices = append(devices, device)
+	}
+	h.mutex.Unlock()
+
+	for _, device := range devices {
+		h.removed(device)
+	}
+
+	h.sendMutex.Lock()
+	h.finished = true
+	close(h.events)
+	h.sendMutex.Unlock()
+}
+
+// Parse a kernel uevent message, a header like add@/devices/... followed
+// by zero terminated KEY=VALUE properties
+func parseUevent(msg []byte) map[string]string {
+	props := make(map[string]string)
+
+	fields := bytes.Split(msg, []byte{0})
+	if len(fields) == 0 || !bytes.Contains(fields[0], []byte("@")) {
+		return props
+	}
+
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(string(field), "=", 2)
+		if len(kv) == 2 {
+			props[kv[0]] = kv[1]
+		}
+	}
+
+	return props
+}
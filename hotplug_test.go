@@ -0,0 +1,293 @@
+package webcam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Builds a uevent message of a video4linux device like the kernel sends
+func testUevent(action string, devname string) []byte {
+	return []byte(fmt.Sprintf("%s@/devices/virtual/video4linux/%s\x00ACTION=%s\x00SUBSYSTEM=video4linux\x00DEVNAME=%s\x00",
+		action, filepath.Base(devname), action, devname))
+}
+
+func TestParseUevent(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want map[string]string
+	}{
+		{"kernel message", "add@/devices/video0\x00ACTION=add\x00DEVNAME=video0\x00",
+			map[string]string{"ACTION": "add", "DEVNAME": "video0"}},
+		{"value with equal sign", "change@/devices/video0\x00KEY=a=b\x00",
+			map[string]string{"KEY": "a=b"}},
+		{"field without value", "add@/devices/video0\x00BROKEN\x00ACTION=add",
+			map[string]string{"ACTION": "add"}},
+		{"no header", "ACTION=add\x00DEVNAME=video0\x00", map[string]string{}},
+		{"udev message", "libudev\x00\xfe\xed\xca\xfe", map[string]string{}},
+		{"empty", "", map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseUevent([]byte(tt.msg))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for key, value := range tt.want {
+				if got[key] != value {
+					t.Errorf("%s = %q, want %q", key, got[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestHotplugEvents(t *testing.T) {
+	h := newHotplugWatcher(-1)
+	path := filepath.Join(testTempDir(t), "video42")
+
+	h.handle(testUevent("add", path))
+	h.handle(testUevent("change", path))
+	h.handle([]byte("add@/devices/input0\x00ACTION=add\x00SUBSYSTEM=input\x00DEVNAME=input/event0\x00"))
+	h.handle(testUevent("remove", path))
+	h.handle(testUevent("add", "video43"))
+
+	tests := []struct {
+		action HotplugAction
+		path   string
+	}{
+		{DeviceAdded, path},
+		{DeviceRemoved, path},
+		{DeviceAdded, filepath.Join(devicePath, "video43")},
+	}
+
+	for i, tt := range tests {
+		select {
+		case event := <-h.Events():
+			if event.Action != tt.action || event.Device.Path != tt.path {
+				t.Errorf("event %d is %v of %s, want %v of %s", i, event.Action, event.Device.Path, tt.action, tt.path)
+			}
+			if event.Properties["SUBSYSTEM"] != "video4linux" {
+				t.Errorf("event %d has properties %v", i, event.Properties)
+			}
+		default:
+			t.Fatalf("got %d events, want %d", i, len(tests))
+		}
+	}
+	select {
+	case event := <-h.Events():
+		t.Errorf("unexpected event %v of %s", event.Action, event.Device.Path)
+	default:
+	}
+
+	h.finish()
+	if _, ok := <-h.Events(); ok {
+		t.Error("events channel is open after finish")
+	}
+}
+
+// Events not drained must not hold up the watcher
+func TestHotplugEventsNotDrained(t *testing.T) {
+	h := newHotplugWatcher(-1)
+	dir := testTempDir(t)
+	count := 2 * cap(h.events)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < count; i++ {
+			h.handle(testUevent("add", filepath.Join(dir, fmt.Sprintf("video%d", i))))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handling events blocked on the full channel")
+	}
+
+	// Oldest events are dropped
+	first := <-h.Events()
+	if want := filepath.Join(dir, fmt.Sprintf("video%d", count-cap(h.events))); first.Device.Path != want {
+		t.Errorf("oldest event kept is of %s, want %s", first.Device.Path, want)
+	}
+	if len(h.Events()) != cap(h.events)-1 {
+		t.Errorf("%d events left, want %d", len(h.Events()), cap(h.events)-1)
+	}
+}
+
+// Removing a device must not wait for frames its consumer holds
+func TestHotplugAutoOpen(t *testing.T) {
+	h := newHotplugWatcher(-1)
+	path := filepath.Join(testTempDir(t), "video0")
+
+	var opened, closing *Camera
+	err := h.AutoOpen(HotplugHandler{
+		Match:   func(d DeviceInfo) bool { return d.Path == path },
+		Open:    func(string) (*Camera, error) { return OpenFake(DefaultFakeConfig()) },
+		Opened:  func(cam *Camera, d DeviceInfo) { opened = cam },
+		Closing: func(cam *Camera, d DeviceInfo) { closing = cam },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.handle(testUevent("add", path))
+	if opened == nil {
+		t.Fatal("camera of the added device was not opened")
+	}
+
+	if err = opened.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	if err = opened.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := opened.GetFrameWithMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := frame.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.handle(testUevent("remove", path))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("removing the device waits for the held frame")
+	}
+
+	if closing != opened {
+		t.Error("Closing was not called with the camera")
+	}
+	if err = opened.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Close of the removed camera = %v, want ErrClosed", err)
+	}
+
+	// Frame stays readable until it is released
+	if !bytes.Equal(frame.Bytes(), data.Bytes()) {
+		t.Error("held frame changed after the device was removed")
+	}
+	if err = frame.Release(); err != nil {
+		t.Errorf("Release after the device was removed = %v", err)
+	}
+}
+
+// Watcher reading a datagram socket standing in for the uevent socket
+func socketTestWatcher(t *testing.T) *HotplugWatcher {
+	t.Helper()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fds[1]) })
+	return newHotplugWatcher(fds[0])
+}
+
+func TestHotplugCloseWhileRunning(t *testing.T) {
+	h := socketTestWatcher(t)
+
+	result := make(chan error, 1)
+	go func() { result <- h.Run(context.Background()) }()
+
+	// Wait for Run to take over the socket
+	for {
+		h.mutex.Lock()
+		running := h.running
+		h.mutex.Unlock()
+		if running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h.mutex.Lock()
+	fd := h.fd
+	h.mutex.Unlock()
+	if fd < 0 {
+		t.Error("Close closed the socket Run is reading")
+	}
+
+	select {
+	case err := <-result:
+		if err != ErrClosed {
+			t.Errorf("Run = %v, want ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+	if h.fd != -1 {
+		t.Error("socket is open after Run returned")
+	}
+	if _, ok := <-h.Events(); ok {
+		t.Error("events channel is open after Run returned")
+	}
+	if err := h.Close(); err != ErrClosed {
+		t.Errorf("second Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestHotplugClose(t *testing.T) {
+	h := socketTestWatcher(t)
+	fd := h.fd
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Fstat(fd, &unix.Stat_t{}); err != unix.EBADF {
+		t.Errorf("socket of a watcher that never ran is open after Close: %v", err)
+	}
+
+	// A descriptor reusing the number must survive a second Close
+	other, err := unix.Dup(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(other)
+	if err = h.Close(); err != ErrClosed {
+		t.Errorf("second Close = %v, want ErrClosed", err)
+	}
+	if err = unix.Fstat(other, &unix.Stat_t{}); err != nil {
+		t.Errorf("second Close closed another descriptor: %v", err)
+	}
+
+	if err = h.Run(context.Background()); err != ErrClosed {
+		t.Errorf("Run after Close = %v, want ErrClosed", err)
+	}
+}
+
+// Run closes the socket when it returns, Close must not close it again
+func TestHotplugCloseAfterRun(t *testing.T) {
+	h := socketTestWatcher(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := h.Run(ctx); err != context.Canceled {
+		t.Errorf("Run = %v, want context.Canceled", err)
+	}
+	if h.fd != -1 {
+		t.Error("socket is open after Run returned")
+	}
+	if err := h.Close(); err != nil {
+		t.Errorf("Close after Run = %v", err)
+	}
+}
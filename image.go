@@ -13,23 +13,147 @@ import (
 	"github.com/pkg/errors"
 )
 
-var formats map[string]func([]byte, string, uint32, uint32) (image.Image, error)
-
 // TODO: When more formats are supported, split by ratio ie; 4:2:2 / 4:1:1
 var packedYUV = []string{"YUYV", "YVYU", "UYVY", "VYUY"}
 var planarYUV = []string{"YU12", "YV12", "NV12", "NV21"}
 var rgb = []string{"RGB3", "BGR3"}
 var rgba = []string{"RGB4", "BGR4"}
+var compressed = []string{"MJPG", "JPEG"}
+
+// Memory layout of a frame, where each plane starts and how far apart its lines are.
+// Planes are in the order they are decoded, luma first for YUV formats
+type FrameLayout struct {
+	Planes []PlaneLayout
+}
+
+// Layout of a single plane within a frame buffer
+type PlaneLayout struct {
+	// Position of the first line of the plane in the frame, in bytes
+	Offset int
+	// Distance between the starts of two lines in bytes, including padding
+	Stride int
+}
+
+// Returns the layout of a frame without any line padding,
+// which is what Compress assumes
+func PackedLayout(format string, width uint32, height uint32) FrameLayout {
+	return formatLayout(EncodeFormat(format), width, height, 0)
+}
+
+// Returns the layout of frames of the format, taking line padding
+// chosen by the driver into account. Planes of multiplanar formats are
+// expected to be concatenated in the order of Frame.Planes
+func (f ImageFormat) Layout() FrameLayout {
+	if len(f.Planes) > 1 {
+		layout := FrameLayout{}
+		offset := 0
+		for _, plane := range f.Planes {
+			layout.Planes = append(layout.Planes, PlaneLayout{Offset: offset, Stride: int(plane.BytesPerLine)})
+			offset += int(plane.SizeImage)
+		}
+		return layout
+	}
+
+	return formatLayout(f.PixelFormat, f.Width, f.Height, f.BytesPerLine)
+}
+
+// Layout of a frame of a registered format, unknown formats
+// are assumed to have a single plane of one byte per pixel
+func formatLayout(format PixelFormat, width uint32, height uint32, bytesPerLine uint32) FrameLayout {
+	info, ok := LookupFormat(format)
+	if !ok {
+		info = FormatInfo{BitsPerPixel: 8}
+	}
+	return info.layout(width, height, bytesPerLine)
+}
+
+// Layout of packed 4:2:2 frames, lines hold whole macropixels
+func packedYUVLayout(width uint32, height uint32, bytesPerLine uint32) FrameLayout {
+	stride := int(bytesPerLine)
+	if stride == 0 {
+		stride = (int(width) + 1) / 2 * 4
+	}
+	return FrameLayout{Planes: []PlaneLayout{{Offset: 0, Stride: stride}}}
+}
+
+// Layout of contiguous 4:2:0 frames with three planes. Chroma planes follow
+// the luma plane, with lines half as long, rounded up to whole samples
+func planarYUVLayout(width uint32, height uint32, bytesPerLine uint32) FrameLayout {
+	stride := int(bytesPerLine)
+	if stride == 0 {
+		stride = int(width)
+	}
+	lumaSize := stride * int(height)
+	chromaHeight := (int(height) + 1) / 2
+	chromaStride := (stride + 1) / 2
+
+	return FrameLayout{Planes: []PlaneLayout{
+		{Offset: 0, Stride: stride},
+		{Offset: lumaSize, Stride: chromaStride},
+		{Offset: lumaSize + chromaStride*chromaHeight, Stride: chromaStride},
+	}}
+}
+
+// Layout of contiguous 4:2:0 frames with interleaved chroma. Chroma lines
+// are as long as luma lines, rounded up to whole chroma pairs
+func semiPlanarYUVLayout(width uint32, height uint32, bytesPerLine uint32) FrameLayout {
+	stride := int(bytesPerLine)
+	if stride == 0 {
+		stride = int(width)
+	}
+
+	return FrameLayout{Planes: []PlaneLayout{
+		{Offset: 0, Stride: stride},
+		{Offset: stride * int(height), Stride: (stride + 1) / 2 * 2},
+	}}
+}
+
+// Returns the layout of a plane after checking that rows lines
+// of lineBytes bytes each fit into the frame. Decoders use it to reject
+// truncated frames with ErrShortFrame instead of reading past their end
+func (layout FrameLayout) CheckPlane(frame []byte, plane int, lineBytes int, rows int) (PlaneLayout, error) {
+	if plane >= len(layout.Planes) {
+		return PlaneLayout{}, fmt.Errorf("Frame layout has %d planes, plane %d is missing", len(layout.Planes), plane)
+	}
+
+	p := layout.Planes[plane]
+	if p.Offset < 0 || p.Stride < lineBytes {
+		return PlaneLayout{}, fmt.Errorf("Invalid layout of plane %d: offset %d, stride %d for lines of %d bytes", plane, p.Offset, p.Stride, lineBytes)
+	}
+
+	if rows > 0 {
+		// Checked without multiplying, so that huge strides or rows don't overflow
+		if p.Offset > len(frame) || p.Stride > len(frame) {
+			return PlaneLayout{}, fmt.Errorf("Plane %d at offset %d with stride %d exceeds frame of %d bytes: %w", plane, p.Offset, p.Stride, len(frame), ErrShortFrame)
+		}
+		room := len(frame) - p.Offset - lineBytes
+		if room < 0 || (p.Stride > 0 && rows-1 > room/p.Stride) {
+			return PlaneLayout{}, fmt.Errorf("Plane %d needs %d lines with stride %d at offset %d, frame has %d bytes: %w", plane, rows, p.Stride, p.Offset, len(frame), ErrShortFrame)
+		}
+	}
+	return p, nil
+}
 
 // Conversion of raw image formats to compressed jpegs
-// Conversion is categorised by a string 4CC code for code readibility
+// Conversion is categorised by a string 4CC code for code readibility.
+// Frame lines are assumed to be tightly packed, see CompressLayout for padded frames
 func Compress(frame []byte, format string, width uint32, height uint32, quality uint32, rotation string, rwidth int, rheight int) ([]byte, string, error) {
+	return CompressLayout(frame, format, width, height, PackedLayout(format, width, height), quality, rotation, rwidth, rheight)
+}
+
+// Same as Compress, for frames laid out in memory as described by layout,
+// usually obtained with ImageFormat.Layout.
+// Formats are looked up in the registry, see RegisterFormat. Formats with
+// an encoder are passed to it as is, without rotation and resizing
+func CompressLayout(frame []byte, format string, width uint32, height uint32, layout FrameLayout, quality uint32, rotation string, rwidth int, rheight int) ([]byte, string, error) {
 	// Check we actually support this format
-	if _, ok := formats[format]; !ok {
-		if format == "JPEG" || format == "MJPG" {
-			return frame, fmt.Sprintf("hardware compressed %s of length %v; resolution %v x %v", format, len(frame), width, height), nil
-		}
-		return nil, "error encoding", fmt.Errorf("format %v is not supported by this encoder", format)
+	code := EncodeFormat(format)
+	info, ok := LookupFormat(code)
+	if !ok {
+		return nil, "error encoding", fmt.Errorf("format %v is not supported by this encoder: %w", format, ErrUnsupportedFormat)
+	}
+	if info.Encode != nil {
+		return encodeFrame(info, frame, format, width, height, layout, quality)
 	}
 	// Make sure the input values are sane
 	if width <= 10 || height <= 10 || len(frame) <= 10 {
@@ -37,9 +161,8 @@ func Compress(frame []byte, format string, width uint32, height uint32, quality
 	}
 	// Record time taken to encode image
 	start := time.Now()
-	// Encode our image
-	encoder := formats[format]
-	decodedImage, err := encoder(frame, format, width, height)
+	// Decode our image
+	decodedImage, err := info.Decode(frame, code, width, height, layout)
 	if err != nil {
 		return nil, "error encoding", err
 	}
@@ -61,39 +184,60 @@ func Compress(frame []byte, format string, width uint32, height uint32, quality
 	return compressedImage, encoderMsg, nil
 }
 
+// Compresses a frame with the encoder of a format
+func encodeFrame(info FormatInfo, frame []byte, format string, width uint32, height uint32, layout FrameLayout, quality uint32) ([]byte, string, error) {
+	start := time.Now()
+	compressedImage, err := info.Encode(frame, info.Format, width, height, layout, quality)
+	if err != nil {
+		return nil, "error encoding", err
+	}
+	if info.Compressed {
+		return compressedImage, fmt.Sprintf("hardware compressed %s of length %v; resolution %v x %v", format, len(frame), width, height), nil
+	}
+	encoderMsg := fmt.Sprintf("Encoded image format %s; length %v; resolution %v x %v; to jpeg of length %v in %s", format, len(frame), width, height, len(compressedImage), time.Since(start))
+	return compressedImage, encoderMsg, nil
+}
+
+// Encoder of formats compressed by the device, frames are passed through
+func passThrough(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout, quality uint32) ([]byte, error) {
+	return frame, nil
+}
+
 // YUV 4:2:2 decoder. Supports YUYV, YVYU, UYVY, VYUY, YUNV.
-func decodePackedYUV(frame []byte, f string, width uint32, height uint32) (image.Image, error) {
+func decodePackedYUV(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout) (image.Image, error) {
 
+	f := DecodeFormat(format)
 	yuyv := image.NewYCbCr(image.Rect(0, 0, int(width), int(height)), image.YCbCrSubsampleRatio422)
-	for i := range yuyv.Cb {
-		ii := i * 4
-		switch f {
-		// Copy luma and chroma planes in format specific order
-		case "YUYV":
-			yuyv.Y[i*2] = frame[ii]
-			yuyv.Y[i*2+1] = frame[ii+2]
-			yuyv.Cb[i] = frame[ii+1]
-			yuyv.Cr[i] = frame[ii+3]
-		case "YVYU":
-			yuyv.Y[i*2] = frame[ii]
-			yuyv.Y[i*2+1] = frame[ii+2]
-			yuyv.Cb[i] = frame[ii+3]
-			yuyv.Cr[i] = frame[ii+1]
-		case "YUNV":
-			yuyv.Y[i*2] = frame[ii]
-			yuyv.Y[i*2+1] = frame[ii+2]
-			yuyv.Cb[i] = frame[ii+1]
-			yuyv.Cr[i] = frame[ii+3]
-		case "VYUY":
-			yuyv.Y[i*2] = frame[ii+1]
-			yuyv.Y[i*2+1] = frame[ii+3]
-			yuyv.Cb[i] = frame[ii+2]
-			yuyv.Cr[i] = frame[ii]
-		case "UYVY":
-			yuyv.Y[i*2] = frame[ii+1]
-			yuyv.Y[i*2+1] = frame[ii+3]
-			yuyv.Cb[i] = frame[ii]
-			yuyv.Cr[i] = frame[ii+2]
+	plane, err := layout.CheckPlane(frame, 0, yuyv.CStride*4, int(height))
+	if err != nil {
+		return nil, err
+	}
+
+	// Offsets of Y0, Y1, Cb and Cr within a macropixel
+	var y0, y1, cb, cr int
+	switch f {
+	case "YUYV", "YUNV":
+		y0, y1, cb, cr = 0, 2, 1, 3
+	case "YVYU":
+		y0, y1, cb, cr = 0, 2, 3, 1
+	case "VYUY":
+		y0, y1, cb, cr = 1, 3, 2, 0
+	case "UYVY":
+		y0, y1, cb, cr = 1, 3, 0, 2
+	}
+
+	for y := 0; y < int(height); y++ {
+		line := frame[plane.Offset+y*plane.Stride:]
+		luma := yuyv.Y[y*yuyv.YStride : (y+1)*yuyv.YStride]
+		for x := 0; x < yuyv.CStride; x++ {
+			ii := x * 4
+			// Copy luma and chroma planes in format specific order
+			luma[x*2] = line[ii+y0]
+			if x*2+1 < len(luma) {
+				luma[x*2+1] = line[ii+y1]
+			}
+			yuyv.Cb[y*yuyv.CStride+x] = line[ii+cb]
+			yuyv.Cr[y*yuyv.CStride+x] = line[ii+cr]
 		}
 	}
 
@@ -101,67 +245,78 @@ func decodePackedYUV(frame []byte, f string, width uint32, height uint32) (image
 }
 
 // YUV 4:2:0 decoder. Supports YU12, YV12, I420, NV12, NV21
-func decodePlanarYUV(frame []byte, f string, width uint32, height uint32) (image.Image, error) {
+func decodePlanarYUV(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout) (image.Image, error) {
 
+	f := DecodeFormat(format)
 	yuv := image.NewYCbCr(image.Rect(0, 0, int(width), int(height)), image.YCbCrSubsampleRatio420)
+	chromaHeight := len(yuv.Cb) / yuv.CStride
+
 	// Copy luma plane
-	for i := range yuv.Y {
-		yuv.Y[i] = frame[i]
+	luma, err := layout.CheckPlane(frame, 0, yuv.YStride, int(height))
+	if err != nil {
+		return nil, err
 	}
+	for y := 0; y < int(height); y++ {
+		copy(yuv.Y[y*yuv.YStride:(y+1)*yuv.YStride], frame[luma.Offset+y*luma.Stride:])
+	}
+
 	// Copy chroma planes in format specific order
 	switch f {
-	case "YU12":
-		for i := range yuv.Cr {
-			yuv.Cb[i] = frame[i+len(yuv.Y)]
-		}
-		for i := range yuv.Cb {
-			yuv.Cr[i] = frame[i+len(yuv.Y)+len(yuv.Cr)]
+	case "YU12", "YV12", "I420":
+		first, second := yuv.Cb, yuv.Cr
+		if f == "YV12" {
+			first, second = yuv.Cr, yuv.Cb
 		}
-	case "YV12":
-		for i := range yuv.Cb {
-			yuv.Cr[i] = frame[i+len(yuv.Y)]
-		}
-		for i := range yuv.Cr {
-			yuv.Cb[i] = frame[i+len(yuv.Y)+len(yuv.Cr)]
-		}
-	case "I420":
-		for i := range yuv.Cb {
-			yuv.Cb[i] = frame[i+len(yuv.Y)]
+		for p, chroma := range [][]byte{first, second} {
+			plane, err := layout.CheckPlane(frame, p+1, yuv.CStride, chromaHeight)
+			if err != nil {
+				return nil, err
+			}
+			for y := 0; y < chromaHeight; y++ {
+				copy(chroma[y*yuv.CStride:(y+1)*yuv.CStride], frame[plane.Offset+y*plane.Stride:])
+			}
 		}
-		for i := range yuv.Cr {
-			yuv.Cr[i] = frame[i+len(yuv.Y)+len(yuv.Cr)]
+	case "NV12", "NV21":
+		plane, err := layout.CheckPlane(frame, 1, yuv.CStride*2, chromaHeight)
+		if err != nil {
+			return nil, err
 		}
-	case "NV12":
-		for i := range yuv.Cr {
-			ii := 2 * i
-			yuv.Cb[i] = frame[len(yuv.Y)+ii]
-			yuv.Cr[i] = frame[len(yuv.Y)+ii+1]
+		cb, cr := 0, 1
+		if f == "NV21" {
+			cb, cr = 1, 0
 		}
-	case "NV21":
-		for i := range yuv.Cr {
-			ii := 2 * i
-			yuv.Cb[i] = frame[len(yuv.Y)+ii+1]
-			yuv.Cr[i] = frame[len(yuv.Y)+ii]
+		for y := 0; y < chromaHeight; y++ {
+			line := frame[plane.Offset+y*plane.Stride:]
+			for x := 0; x < yuv.CStride; x++ {
+				yuv.Cb[y*yuv.CStride+x] = line[2*x+cb]
+				yuv.Cr[y*yuv.CStride+x] = line[2*x+cr]
+			}
 		}
 	}
 	return yuv, nil
 }
 
 // RGB decoder, it supports RGB3, BGR3.
-func decodeRGB(frame []byte, f string, width uint32, height uint32) (image.Image, error) {
+func decodeRGB(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout) (image.Image, error) {
 
+	f := DecodeFormat(format)
 	rgb := rgblib.NewImage(image.Rect(0, 0, int(width), int(height)))
-	for i := range frame {
-		if i%3 == 0 {
-			switch f {
-			case "RGB3":
-				rgb.Pix[i] = frame[i]
-				rgb.Pix[i+1] = frame[i+1]
-				rgb.Pix[i+2] = frame[i+2]
-			case "BGR3":
-				rgb.Pix[i] = frame[i+2]
-				rgb.Pix[i+1] = frame[i+1]
-				rgb.Pix[i+2] = frame[i]
+	plane, err := layout.CheckPlane(frame, 0, rgb.Stride, int(height))
+	if err != nil {
+		return nil, err
+	}
+
+	for y := 0; y < int(height); y++ {
+		line := frame[plane.Offset+y*plane.Stride:]
+		pix := rgb.Pix[y*rgb.Stride : (y+1)*rgb.Stride]
+		switch f {
+		case "RGB3":
+			copy(pix, line)
+		case "BGR3":
+			for i := 0; i < len(pix); i += 3 {
+				pix[i] = line[i+2]
+				pix[i+1] = line[i+1]
+				pix[i+2] = line[i]
 			}
 		}
 	}
@@ -169,28 +324,30 @@ func decodeRGB(frame []byte, f string, width uint32, height uint32) (image.Image
 }
 
 // This is our RGBA decoder, it supports RGB4 and BGR4.
-func decodeRGBA(frame []byte, f string, width uint32, height uint32) (image.Image, error) {
+func decodeRGBA(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout) (image.Image, error) {
 
+	f := DecodeFormat(format)
 	rgba := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
-	rgbabuf := make([]uint8, 4*int(width)*int(height))
-	for i := range frame {
-		if i%4 == 0 {
-			switch f {
-			case "RGB4":
-				rgbabuf[i] = frame[i+2]
-				rgbabuf[i+1] = frame[i+1]
-				rgbabuf[i+2] = frame[i]
-				rgbabuf[i+3] = frame[i+3]
-			case "BGR4":
-				rgbabuf[i] = frame[i]
-				rgbabuf[i+1] = frame[i+1]
-				rgbabuf[i+2] = frame[i+2]
-				rgbabuf[i+3] = frame[i+3]
+	plane, err := layout.CheckPlane(frame, 0, rgba.Stride, int(height))
+	if err != nil {
+		return nil, err
+	}
+
+	for y := 0; y < int(height); y++ {
+		line := frame[plane.Offset+y*plane.Stride:]
+		pix := rgba.Pix[y*rgba.Stride : (y+1)*rgba.Stride]
+		switch f {
+		case "RGB4":
+			for i := 0; i < len(pix); i += 4 {
+				pix[i] = line[i+2]
+				pix[i+1] = line[i+1]
+				pix[i+2] = line[i]
+				pix[i+3] = line[i+3]
 			}
+		case "BGR4":
+			copy(pix, line)
 		}
 	}
-	rgba.Pix = rgbabuf
-	rgba.Stride = 4 * int(width)
 	return rgba, nil
 }
 
@@ -234,25 +391,75 @@ func encodeJPEG(img image.Image, quality uint32) ([]byte, error) {
 
 // Interface to check if format is supported
 func CompressionAvailable(format string) bool {
-	if _, ok := formats[format]; ok {
-		return true
-	}
-	return false
+	_, ok := LookupFormat(EncodeFormat(format))
+	return ok
 }
 
 // Declare our library of format types upon initialization
 func init() {
-	formats = make(map[string]func([]byte, string, uint32, uint32) (image.Image, error))
 	for _, format := range packedYUV {
-		formats[format] = decodePackedYUV
+		registerBuiltin(FormatInfo{Format: EncodeFormat(format), Description: "YUV 4:2:2 " + format,
+			BitsPerPixel: 16, Planes: 1, SubsampleX: 2, SubsampleY: 1, Layout: packedYUVLayout, Decode: decodePackedYUV})
 	}
 	for _, format := range planarYUV {
-		formats[format] = decodePlanarYUV
+		info := FormatInfo{Format: EncodeFormat(format), Description: "Planar YUV 4:2:0 " + format,
+			BitsPerPixel: 12, Planes: 3, SubsampleX: 2, SubsampleY: 2, Layout: planarYUVLayout, Decode: decodePlanarYUV}
+		if format == "NV12" || format == "NV21" {
+			info.Description = "Y/CbCr 4:2:0 " + format
+			info.Planes = 2
+			info.Layout = semiPlanarYUVLayout
+		}
+		registerBuiltin(info)
 	}
 	for _, format := range rgb {
-		formats[format] = decodeRGB
+		registerBuiltin(FormatInfo{Format: EncodeFormat(format), Description: "24-bit " + format,
+			BitsPerPixel: 24, Planes: 1, Decode: decodeRGB})
 	}
 	for _, format := range rgba {
-		formats[format] = decodeRGBA
+		registerBuiltin(FormatInfo{Format: EncodeFormat(format), Description: "32-bit " + format,
+			BitsPerPixel: 32, Planes: 1, Decode: decodeRGBA})
+	}
+	for format, f := range bayerFormats {
+		info := FormatInfo{Format: EncodeFormat(format), Description: fmt.Sprintf("%d-bit Bayer %s", f.bits, f.patternName()),
+			BitsPerPixel: 16, Planes: 1, Layout: f.packing.layout, Decode: BayerDecoder(DemosaicBilinear)}
+		if f.packing != rawUnpacked16 {
+			info.BitsPerPixel = int(f.bits)
+		}
+		if f.packing.packed() {
+			info.Description += " packed"
+		}
+		registerBuiltin(info)
+	}
+	for format, f := range grayFormats {
+		info := FormatInfo{Format: EncodeFormat(format), Description: fmt.Sprintf("%d-bit greyscale", f.bits),
+			BitsPerPixel: 16, Planes: 1, Layout: f.packing.layout, Decode: GrayDecoder(GrayWindow{})}
+		if f.packing != rawUnpacked16 {
+			info.BitsPerPixel = int(f.bits)
+		}
+		if f.packing.packed() {
+			info.Description += " packed"
+		}
+		registerBuiltin(info)
+	}
+	for format, f := range depthFormats {
+		info := FormatInfo{Format: EncodeFormat(format), Description: "16-bit depth",
+			BitsPerPixel: 16, Planes: 1, Decode: DepthDecoder(DefaultDepthScale, DepthRendering{})}
+		if f.ir {
+			info.Description = "10-bit infrared and 16-bit depth"
+			info.BitsPerPixel = 32
+			info.Planes = 2
+			info.Layout = depthIRLayout
+		}
+		registerBuiltin(info)
+	}
+	for _, format := range compressed {
+		registerBuiltin(FormatInfo{Format: EncodeFormat(format), Description: "Compressed " + format,
+			Compressed: true, Encode: passThrough})
+	}
+}
+
+func registerBuiltin(info FormatInfo) {
+	if err := RegisterFormat(info); err != nil {
+		panic(err)
 	}
 }
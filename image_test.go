@@ -0,0 +1,49 @@
+package webcam
+
+import (
+	"errors"
+	"testing"
+)
+
+// Largest int of the platform
+const maxInt = int(^uint(0) >> 1)
+
+func TestCheckPlane(t *testing.T) {
+	frame := make([]byte, 64)
+
+	tests := []struct {
+		name      string
+		plane     PlaneLayout
+		lineBytes int
+		rows      int
+		wantShort bool
+	}{
+		{"exact fit", PlaneLayout{Offset: 0, Stride: 16}, 16, 4, false},
+		{"padded lines", PlaneLayout{Offset: 8, Stride: 16}, 8, 4, false},
+		{"last line without padding", PlaneLayout{Offset: 0, Stride: 20}, 4, 4, false},
+		{"no rows", PlaneLayout{Offset: 64, Stride: 16}, 16, 0, false},
+		{"one byte short", PlaneLayout{Offset: 1, Stride: 16}, 16, 4, true},
+		{"offset past the end", PlaneLayout{Offset: 65, Stride: 1}, 1, 1, true},
+		{"stride past the end", PlaneLayout{Offset: 0, Stride: 65}, 1, 2, true},
+		{"overflowing stride", PlaneLayout{Offset: 0, Stride: maxInt / 2}, 1, 3, true},
+		{"overflowing offset", PlaneLayout{Offset: maxInt - 8, Stride: 16}, 16, 1, true},
+		{"overflowing rows", PlaneLayout{Offset: 0, Stride: 16}, 16, maxInt / 8, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout := FrameLayout{Planes: []PlaneLayout{tt.plane}}
+			_, err := layout.CheckPlane(frame, 0, tt.lineBytes, tt.rows)
+			if tt.wantShort != errors.Is(err, ErrShortFrame) {
+				t.Errorf("got %v, want short frame %v", err, tt.wantShort)
+			}
+			if !tt.wantShort && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	if _, err := (FrameLayout{}).CheckPlane(frame, 0, 1, 1); err == nil {
+		t.Error("CheckPlane of a missing plane succeeded")
+	}
+}
@@ -0,0 +1,181 @@
+package webcam
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func multiplanarTestConfig() FakeConfig {
+	config := DefaultFakeConfig()
+	config.Multiplanar = true
+	sizes := config.Formats[0].Sizes
+	intervals := config.Formats[0].Intervals
+	config.Formats = append(config.Formats,
+		FakeFormat{EncodeFormat("NM12"), "Y/CbCr 4:2:0 (N-C)", sizes, intervals},
+		FakeFormat{EncodeFormat("YM12"), "Planar YUV 4:2:0 (N-C)", sizes, intervals},
+	)
+	return config
+}
+
+func TestMultiplanarStreaming(t *testing.T) {
+	const pixels = 320 * 240
+
+	tests := []struct {
+		format string
+		planes []int
+		lines  []uint32
+	}{
+		{"YUYV", []int{pixels * 2}, []uint32{640}},
+		{"NM12", []int{pixels, pixels / 2}, []uint32{320, 320}},
+		{"YM12", []int{pixels, pixels / 4, pixels / 4}, []uint32{320, 160, 160}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			cam := openTestFake(t, multiplanarTestConfig())
+			if !cam.IsMultiplanar() {
+				t.Fatal("camera is not multiplanar")
+			}
+
+			if _, _, _, err := cam.SetImageFormat(EncodeFormat(tt.format), 320, 240); err != nil {
+				t.Fatal(err)
+			}
+			f, err := cam.GetImageFormat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(f.Planes) != len(tt.planes) {
+				t.Fatalf("format has %d planes, want %d", len(f.Planes), len(tt.planes))
+			}
+			for p, plane := range f.Planes {
+				if int(plane.SizeImage) != tt.planes[p] || plane.BytesPerLine != tt.lines[p] {
+					t.Errorf("plane %d is %d bytes in lines of %d, want %d in lines of %d",
+						p, plane.SizeImage, plane.BytesPerLine, tt.planes[p], tt.lines[p])
+				}
+			}
+
+			if err = cam.SetBufferCount(3); err != nil {
+				t.Fatal(err)
+			}
+			if err = cam.StartStreaming(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 4; i++ {
+				if err = cam.WaitForFrame(1); err != nil {
+					t.Fatal(err)
+				}
+				frame, err := cam.GetFrameWithMetadata()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				planes := frame.Planes()
+				if len(planes) != len(tt.planes) {
+					t.Fatalf("frame has %d planes, want %d", len(planes), len(tt.planes))
+				}
+				if !bytes.Equal(frame.Bytes(), planes[0]) {
+					t.Error("frame data is not its first plane")
+				}
+				for p, plane := range planes {
+					if len(plane) != tt.planes[p] {
+						t.Errorf("plane %d has %d bytes, want %d", p, len(plane), tt.planes[p])
+					}
+
+					fd, err := cam.ExportPlane(frame.Index, uint32(p))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(plane, mapTestDmabuf(t, fd)[:len(plane)]) {
+						t.Errorf("plane %d differs from the exported plane", p)
+					}
+					unix.Close(fd)
+				}
+
+				if _, err = cam.ExportPlane(frame.Index, uint32(len(planes))); !errors.Is(err, unix.EINVAL) {
+					t.Errorf("ExportPlane of a missing plane = %v, want EINVAL", err)
+				}
+				if err = frame.Release(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err = cam.StopStreaming(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMultiplanarUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(cam *Camera) error
+	}{
+		{"user buffers", func(cam *Camera) error {
+			return cam.SetUserBuffers([][]byte{make([]byte, 4096)})
+		}},
+		{"DMABUF buffers", func(cam *Camera) error {
+			return cam.SetDmabufBuffers(newTestDmabufs(t, 1, 4096))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cam := openTestFake(t, multiplanarTestConfig())
+
+			if err := tt.call(cam); err == nil {
+				t.Error("succeeded on a multiplanar device")
+			}
+		})
+	}
+}
+
+func TestMultiplanarDeviceInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(d *fakeDevice) error
+	}{
+		{"single-planar format", func(d *fakeDevice) error {
+			_, err := d.getImageFormat()
+			return err
+		}},
+		{"user buffers", func(d *fakeDevice) error {
+			count := uint32(2)
+			return d.requestBuffers(V4L2_MEMORY_USERPTR, &count)
+		}},
+		{"query single-planar buffer", func(d *fakeDevice) error {
+			count := uint32(2)
+			d.requestBuffers(V4L2_MEMORY_MMAP, &count)
+			var length uint32
+			_, err := d.queryBuffer(0, &length)
+			return err
+		}},
+		{"queue wrong number of planes", func(d *fakeDevice) error {
+			count := uint32(2)
+			d.requestBuffers(V4L2_MEMORY_MMAP, &count)
+			d.queryPlanes(0)
+			return d.enqueuePlanes(0, 3)
+		}},
+		{"queue buffer not queried", func(d *fakeDevice) error {
+			count := uint32(2)
+			d.requestBuffers(V4L2_MEMORY_MMAP, &count)
+			return d.enqueuePlanes(1, 1)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDevice(multiplanarTestConfig())
+			d.setBufferType(V4L2_BUF_TYPE_VIDEO_CAPTURE_MPLANE)
+			defer d.close()
+
+			if err := tt.call(d); !errors.Is(err, unix.EINVAL) {
+				t.Errorf("got %v, want EINVAL", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package webcam
+
+// Ways samples of raw sensor formats are stored in memory
+type rawPacking int
+
+const (
+	// One byte per sample
+	raw8 rawPacking = iota
+	// Little endian 16-bit words, samples occupy the low bits
+	rawUnpacked16
+	// MIPI CSI-2 packing of 10-bit samples, 4 samples in 5 bytes.
+	// The first 4 bytes hold the high 8 bits of each sample,
+	// the last one the low 2 bits of all of them
+	rawMIPI10
+	// MIPI CSI-2 packing of 12-bit samples, 2 samples in 3 bytes.
+	// The first 2 bytes hold the high 8 bits of each sample,
+	// the last one the low 4 bits of both
+	rawMIPI12
+)
+
+// Number of bytes holding a line of width samples
+func (p rawPacking) lineBytes(width int) int {
+	switch p {
+	case rawUnpacked16:
+		return width * 2
+	case rawMIPI10:
+		return (width + 3) / 4 * 5
+	case rawMIPI12:
+		return (width + 1) / 2 * 3
+	default:
+		return width
+	}
+}
+
+// Returns the layout of a frame with lines of bytesPerLine bytes,
+// or of packed lines if bytesPerLine is 0
+func (p rawPacking) layout(width uint32, height uint32, bytesPerLine uint32) FrameLayout {
+	stride := int(bytesPerLine)
+	if stride == 0 {
+		stride = p.lineBytes(int(width))
+	}
+	return FrameLayout{Planes: []PlaneLayout{{Offset: 0, Stride: stride}}}
+}
+
+// Returns true if samples share bytes
+func (p rawPacking) packed() bool {
+	return p == rawMIPI10 || p == rawMIPI12
+}
+
+// Unpacks a line of samples, line must hold at least lineBytes(len(dst)) bytes
+func (p rawPacking) unpackLine(dst []uint16, line []byte) {
+	switch p {
+	case raw8:
+		for x := range dst {
+			dst[x] = uint16(line[x])
+		}
+	case rawUnpacked16:
+		for x := range dst {
+			dst[x] = uint16(line[2*x]) | uint16(line[2*x+1])<<8
+		}
+	case rawMIPI10:
+		for x := range dst {
+			group := line[x/4*5:]
+			i := x % 4
+			dst[x] = uint16(group[i])<<2 | uint16(group[4]>>(2*uint(i)))&0x3
+		}
+	case rawMIPI12:
+		for x := range dst {
+			group := line[x/2*3:]
+			i := x % 2
+			dst[x] = uint16(group[i])<<4 | uint16(group[2]>>(4*uint(i)))&0xf
+		}
+	}
+}
+
+// Reads samples of a plane of a raw frame into a width*height slice.
+// Unused high bits of unpacked samples are cleared, so that samples
+// never exceed the bit depth even if the driver leaves garbage there
+func readRawSamples(frame []byte, layout FrameLayout, index int, width int, height int, packing rawPacking, bits uint) ([]uint16, error) {
+	plane, err := layout.CheckPlane(frame, index, packing.lineBytes(width), height)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]uint16, width*height)
+	for y := 0; y < height; y++ {
+		packing.unpackLine(samples[y*width:(y+1)*width], frame[plane.Offset+y*plane.Stride:])
+	}
+
+	if packing == rawUnpacked16 && bits < 16 {
+		mask := uint16(1)<<bits - 1
+		for i := range samples {
+			samples[i] &= mask
+		}
+	}
+	return samples, nil
+}
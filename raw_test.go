@@ -0,0 +1,96 @@
+package webcam
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUnpackLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		packing rawPacking
+		line    []byte
+		want    []uint16
+	}{
+		{"8-bit", raw8, []byte{0x00, 0x7f, 0xff}, []uint16{0x00, 0x7f, 0xff}},
+		{"unpacked 16-bit", rawUnpacked16, []byte{0xff, 0x03, 0x01, 0x00, 0x34, 0x12}, []uint16{0x3ff, 0x001, 0x1234}},
+		// High bytes 0xff, 0x00, 0xaa and 0x55, low bits 3, 1, 2 and 1,
+		// then a group cut short after two samples
+		{"MIPI 10-bit", rawMIPI10,
+			[]byte{0xff, 0x00, 0xaa, 0x55, 0x67, 0x80, 0x00, 0x00, 0x00, 0x0c},
+			[]uint16{0x3ff, 0x001, 0x2aa, 0x155, 0x200, 0x003}},
+		{"MIPI 12-bit", rawMIPI12,
+			[]byte{0xab, 0x12, 0x3c, 0xff, 0x00, 0x0f},
+			[]uint16{0xabc, 0x123, 0xfff, 0x000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if n := tt.packing.lineBytes(len(tt.want)); n != len(tt.line) {
+				t.Errorf("line of %d samples takes %d bytes, want %d", len(tt.want), n, len(tt.line))
+			}
+			got := make([]uint16, len(tt.want))
+			tt.packing.unpackLine(got, tt.line)
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("sample %d is %#x, want %#x", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// Drivers may leave garbage in the unused high bits of unpacked samples
+func TestReadRawSamplesMasksHighBits(t *testing.T) {
+	frame := []byte{0x01, 0xfc, 0xff, 0xff}
+	layout := rawUnpacked16.layout(2, 1, 0)
+
+	tests := []struct {
+		bits uint
+		want []uint16
+	}{
+		{10, []uint16{0x001, 0x3ff}},
+		{12, []uint16{0xc01, 0xfff}},
+		{16, []uint16{0xfc01, 0xffff}},
+	}
+
+	for _, tt := range tests {
+		samples, err := readRawSamples(frame, layout, 0, 2, 1, rawUnpacked16, tt.bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range samples {
+			if samples[i] != tt.want[i] {
+				t.Errorf("%d-bit sample %d is %#x, want %#x", tt.bits, i, samples[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestReadRawSamplesShortFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		packing rawPacking
+		stride  uint32
+	}{
+		{"8-bit", raw8, 0},
+		{"unpacked 16-bit", rawUnpacked16, 0},
+		{"MIPI 10-bit", rawMIPI10, 0},
+		{"MIPI 12-bit", rawMIPI12, 0},
+		{"padded lines", rawMIPI10, 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout := tt.packing.layout(8, 4, tt.stride)
+			size := layout.Planes[0].Stride*3 + tt.packing.lineBytes(8)
+
+			if _, err := readRawSamples(make([]byte, size), layout, 0, 8, 4, tt.packing, 10); err != nil {
+				t.Errorf("frame of %d bytes = %v, want it read", size, err)
+			}
+			if _, err := readRawSamples(make([]byte, size-1), layout, 0, 8, 4, tt.packing, 10); !errors.Is(err, ErrShortFrame) {
+				t.Errorf("frame one byte short = %v, want ErrShortFrame", err)
+			}
+		})
+	}
+}
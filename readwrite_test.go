@@ -0,0 +1,139 @@
+package webcam
+
+import (
+	"bytes"
+	"errors"
+	"image/jpeg"
+	"testing"
+)
+
+func readWriteTestConfig() FakeConfig {
+	config := DefaultFakeConfig()
+	config.ReadWriteOnly = true
+	return config
+}
+
+func TestReadFallback(t *testing.T) {
+	cam := openTestFake(t, readWriteTestConfig())
+
+	if !cam.IsReadWrite() {
+		t.Fatal("device without streaming is not read with read()")
+	}
+	if err := cam.SetUserBuffers([][]byte{make([]byte, 640*480*2)}); err == nil {
+		t.Error("SetUserBuffers succeeded with the read I/O method")
+	}
+	if err := cam.SetBufferCount(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	captureTestFrames(t, cam, 3, 640*480*2)
+
+	if err := cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	data, err := cam.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 640*480*2 {
+		t.Errorf("ReadFrame returned %d bytes, want %d", len(data), 640*480*2)
+	}
+
+	// Frames are read into a pool of buffers, one per held frame
+	var indexes []uint32
+	for i := 0; i < 2; i++ {
+		if err = cam.WaitForFrame(1); err != nil {
+			t.Fatal(err)
+		}
+		frame, index, err := cam.GetFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame) != 640*480*2 {
+			t.Errorf("frame has %d bytes, want %d", len(frame), 640*480*2)
+		}
+		indexes = append(indexes, index)
+	}
+	if indexes[0] == indexes[1] {
+		t.Errorf("held frames share buffer %d", indexes[0])
+	}
+	if _, _, err = cam.GetFrame(); err == nil {
+		t.Error("GetFrame succeeded with all buffers held")
+	}
+	for _, index := range indexes {
+		if err = cam.ReleaseFrame(index); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = cam.StopStreaming(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Compressed frames come back with the length read rather than the buffer size
+func TestReadFallbackShortReads(t *testing.T) {
+	cam := openTestFake(t, readWriteTestConfig())
+
+	if _, _, _, err := cam.SetImageFormat(EncodeFormat("MJPG"), 320, 240); err != nil {
+		t.Fatal(err)
+	}
+	f, err := cam.GetImageFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = cam.WaitForFrame(1); err != nil {
+			t.Fatal(err)
+		}
+		data, err := cam.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) == 0 || len(data) >= int(f.SizeImage) {
+			t.Errorf("read %d bytes of a JPEG frame, want between 0 and %d", len(data), f.SizeImage)
+		}
+		if _, err = jpeg.Decode(bytes.NewReader(data)); err != nil {
+			t.Errorf("frame %d is not a JPEG image: %v", i, err)
+		}
+	}
+}
+
+func TestReadFallbackFormatGrows(t *testing.T) {
+	config := readWriteTestConfig()
+	config.SourceChangeAfter = 2
+	cam := openTestFake(t, config)
+
+	if _, _, _, err := cam.SetImageFormat(EncodeFormat("YUYV"), 320, 240); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	captureTestFrames(t, cam, 2, 320*240*2)
+
+	// Source switched to 640x480, frames no longer fit
+	if err := cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cam.GetFrameWithMetadata(); !errors.Is(err, ErrBufferTooSmall) {
+		t.Fatalf("GetFrameWithMetadata of a truncated frame = %v, want ErrBufferTooSmall", err)
+	}
+
+	// Restarting allocates buffers for the new format
+	if err := cam.StopStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	captureTestFrames(t, cam, 2, 640*480*2)
+}
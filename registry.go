@@ -0,0 +1,119 @@
+package webcam
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"sync"
+)
+
+// Decodes a raw frame laid out in memory as described by layout into an image
+type Decoder func(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout) (image.Image, error)
+
+// Encodes a raw frame directly into a compressed image, e.g. JPEG.
+// Used by Compress instead of decoding when a format provides it
+type Encoder func(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout, quality uint32) ([]byte, error)
+
+// Describes a pixel format known to the conversion pipeline
+type FormatInfo struct {
+	Format      PixelFormat
+	Description string
+	// Average number of bits per pixel over all planes, e.g. 12 for NV12.
+	// 0 for compressed formats
+	BitsPerPixel int
+	// Number of memory planes a frame consists of
+	Planes int
+	// Horizontal and vertical chroma subsampling factors, e.g. 2 and 1
+	// for 4:2:2. 1 and 1 for formats without subsampled chroma
+	SubsampleX int
+	SubsampleY int
+	// Frames are already compressed by the device
+	Compressed bool
+	// Returns the layout of a frame with lines of bytesPerLine bytes
+	// in the first plane, or tightly packed lines if bytesPerLine is 0.
+	// If nil, frames have a single plane with BitsPerPixel bits per pixel
+	Layout func(width uint32, height uint32, bytesPerLine uint32) FrameLayout
+	// At least one of Decode and Encode must be set
+	Decode Decoder
+	Encode Encoder
+}
+
+var registry = struct {
+	sync.RWMutex
+	formats map[PixelFormat]FormatInfo
+}{formats: make(map[PixelFormat]FormatInfo)}
+
+// Adds a format to the registry consulted by Compress, CompressionAvailable
+// and Decode, replacing any format registered with the same code.
+// Applications may register vendor specific formats or override built-in ones
+func RegisterFormat(info FormatInfo) error {
+	if info.Format == 0 {
+		return errors.New("Format code is missing")
+	}
+	if info.Decode == nil && info.Encode == nil {
+		return fmt.Errorf("Format %s has neither a decoder nor an encoder", DecodeFormat(info.Format))
+	}
+	if info.Planes == 0 {
+		info.Planes = 1
+	}
+	if info.SubsampleX == 0 {
+		info.SubsampleX = 1
+	}
+	if info.SubsampleY == 0 {
+		info.SubsampleY = 1
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.formats[info.Format] = info
+	return nil
+}
+
+// Returns the registered description of a format
+func LookupFormat(format PixelFormat) (FormatInfo, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	info, ok := registry.formats[format]
+	return info, ok
+}
+
+// Returns all registered formats, ordered by their 4CC
+func RegisteredFormats() []FormatInfo {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	infos := make([]FormatInfo, 0, len(registry.formats))
+	for _, info := range registry.formats {
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return DecodeFormat(infos[i].Format) < DecodeFormat(infos[j].Format)
+	})
+	return infos
+}
+
+// Decodes a raw frame into an image using the registered decoder of the format
+func Decode(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout) (image.Image, error) {
+	info, ok := LookupFormat(format)
+	if !ok || info.Decode == nil {
+		return nil, fmt.Errorf("format %v cannot be decoded: %w", DecodeFormat(format), ErrUnsupportedFormat)
+	}
+	return info.Decode(frame, format, width, height, layout)
+}
+
+// Returns the layout of a frame of the format, see FormatInfo.Layout
+func (info FormatInfo) layout(width uint32, height uint32, bytesPerLine uint32) FrameLayout {
+	if info.Layout != nil {
+		return info.Layout(width, height, bytesPerLine)
+	}
+
+	stride := int(bytesPerLine)
+	if stride == 0 {
+		stride = (int(width)*info.BitsPerPixel + 7) / 8
+	}
+	return FrameLayout{Planes: []PlaneLayout{{Offset: 0, Stride: stride}}}
+}
@@ -0,0 +1,204 @@
+package webcam
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"sort"
+	"testing"
+)
+
+// Registers a format for the duration of a test, restoring
+// the format registered with the same code before
+func registerTestFormat(t *testing.T, info FormatInfo) {
+	t.Helper()
+
+	old, ok := LookupFormat(info.Format)
+	if err := RegisterFormat(info); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		registry.Lock()
+		defer registry.Unlock()
+
+		if ok {
+			registry.formats[info.Format] = old
+		} else {
+			delete(registry.formats, info.Format)
+		}
+	})
+}
+
+// Decoder of frames of one byte per pixel as grey levels
+func decodeTestGray(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout) (image.Image, error) {
+	plane, err := layout.CheckPlane(frame, 0, int(width), int(height))
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewGray(image.Rect(0, 0, int(width), int(height)))
+	for y := 0; y < int(height); y++ {
+		copy(img.Pix[y*img.Stride:], frame[plane.Offset+y*plane.Stride:][:width])
+	}
+	return img, nil
+}
+
+func TestRegisterFormat(t *testing.T) {
+	code := EncodeFormat("TST1")
+	registerTestFormat(t, FormatInfo{Format: code, Description: "Test grey", BitsPerPixel: 8, Decode: decodeTestGray})
+
+	info, ok := LookupFormat(code)
+	if !ok {
+		t.Fatal("registered format is not found")
+	}
+	if info.Description != "Test grey" || info.Planes != 1 || info.SubsampleX != 1 || info.SubsampleY != 1 {
+		t.Errorf("registered format is %q with %d planes and subsampling %dx%d, want defaults filled in",
+			info.Description, info.Planes, info.SubsampleX, info.SubsampleY)
+	}
+	if !CompressionAvailable("TST1") {
+		t.Error("compression of the registered format is not available")
+	}
+
+	// Layout defaults to a single plane of BitsPerPixel
+	frame := make([]byte, 16*12)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	layout := PackedLayout("TST1", 16, 12)
+	if len(layout.Planes) != 1 || layout.Planes[0].Stride != 16 {
+		t.Fatalf("packed layout is %+v, want one plane with 16 bytes per line", layout)
+	}
+	img, err := Decode(frame, code, 16, 12, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.At(3, 2).(color.Gray).Y; got != byte(2*16+3) {
+		t.Errorf("decoded pixel is %d, want %d", got, 2*16+3)
+	}
+	if _, _, err = Compress(frame, "TST1", 16, 12, 80, "", 0, 0); err != nil {
+		t.Errorf("Compress of the registered format = %v", err)
+	}
+
+	formats := RegisteredFormats()
+	found := false
+	for _, info := range formats {
+		found = found || info.Format == code
+	}
+	if !found {
+		t.Error("registered format is not listed")
+	}
+	if !sort.SliceIsSorted(formats, func(i, j int) bool {
+		return DecodeFormat(formats[i].Format) < DecodeFormat(formats[j].Format)
+	}) {
+		t.Error("registered formats are not ordered by their 4CC")
+	}
+}
+
+func TestRegisterFormatInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		info FormatInfo
+	}{
+		{"missing code", FormatInfo{Description: "No code", Decode: decodeTestGray}},
+		{"no decoder or encoder", FormatInfo{Format: EncodeFormat("TST2"), BitsPerPixel: 8}},
+	}
+
+	for _, tt := range tests {
+		if err := RegisterFormat(tt.info); err == nil {
+			t.Errorf("%s: RegisterFormat succeeded", tt.name)
+		}
+		if _, ok := LookupFormat(tt.info.Format); ok {
+			t.Errorf("%s: rejected format is registered", tt.name)
+		}
+	}
+}
+
+// Applications may replace the decoder of a built-in format
+func TestRegisterFormatOverride(t *testing.T) {
+	code := EncodeFormat("RGB3")
+	builtin, ok := LookupFormat(code)
+	if !ok {
+		t.Fatal("RGB3 is not built in")
+	}
+
+	calls := 0
+	override := builtin
+	override.Decode = func(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout) (image.Image, error) {
+		calls++
+		return builtin.Decode(frame, format, width, height, layout)
+	}
+	registerTestFormat(t, override)
+
+	frame := make([]byte, 32*24*3)
+	if _, _, err := Compress(frame, "RGB3", 32, 24, 80, "", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decode(frame, code, 32, 24, PackedLayout("RGB3", 32, 24)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("overriding decoder called %d times, want 2", calls)
+	}
+}
+
+// Formats with an encoder get the frame and its layout as is
+func TestRegisterFormatEncoder(t *testing.T) {
+	code := EncodeFormat("TST3")
+	var gotLayout FrameLayout
+	var gotQuality uint32
+	registerTestFormat(t, FormatInfo{Format: code, Compressed: true,
+		Encode: func(frame []byte, format PixelFormat, width uint32, height uint32, layout FrameLayout, quality uint32) ([]byte, error) {
+			gotLayout, gotQuality = layout, quality
+			return append([]byte("encoded "), frame...), nil
+		}})
+
+	layout := FrameLayout{Planes: []PlaneLayout{{Offset: 4, Stride: 8}}}
+	out, _, err := CompressLayout([]byte("raw"), "TST3", 640, 480, layout, 70, "90", 320, 240)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, []byte("encoded raw")) {
+		t.Errorf("CompressLayout returned %q, want the output of the encoder", out)
+	}
+	if len(gotLayout.Planes) != 1 || gotLayout.Planes[0] != layout.Planes[0] || gotQuality != 70 {
+		t.Errorf("encoder got layout %+v and quality %d, want %+v and 70", gotLayout, gotQuality, layout)
+	}
+
+	// Formats without a decoder cannot be decoded
+	if _, err = Decode([]byte("raw"), code, 640, 480, layout); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Decode of an encoder only format = %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+func TestCompressionAvailable(t *testing.T) {
+	tests := []struct {
+		format string
+		want   bool
+	}{
+		{"YUYV", true},
+		{"NV12", true},
+		{"MJPG", true},
+		{"JPEG", true},
+		{"RGGB", true},
+		{"pRAA", true},
+		{"pBCC", true},
+		{"BYR2", true},
+		{"GREY", true},
+		{"Y10P", true},
+		{"Y16 ", true},
+		{"Z16 ", true},
+		{"INZI", true},
+		{"H264", false},
+		{"XXXX", false},
+	}
+
+	for _, tt := range tests {
+		if got := CompressionAvailable(tt.format); got != tt.want {
+			t.Errorf("CompressionAvailable(%q) = %v, want %v", tt.format, got, tt.want)
+		}
+	}
+
+	if _, _, err := Compress(make([]byte, 64), "XXXX", 8, 8, 80, "", 0, 0); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Compress of an unknown format = %v, want ErrUnsupportedFormat", err)
+	}
+}
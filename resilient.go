@@ -0,0 +1,607 @@
+package webcam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Default interval between attempts to find a lost device
+const defaultRetryInterval = time.Second
+
+// Options of a ResilientCamera
+type ReconnectConfig struct {
+	// Interval between attempts to find the lost device, 1 second if 0
+	RetryInterval time.Duration
+	// Opens a device, Open if nil
+	Open func(path string) (*Camera, error)
+	// Lists devices to search for the lost one, ListDevices if nil
+	ListDevices func() ([]DeviceInfo, error)
+}
+
+// Reported by a ResilientCamera once a lost device is back
+type ReconnectEvent struct {
+	// Device that has been reopened, its path may differ from the original one
+	Device DeviceInfo
+	// Error the device was lost with
+	Err error
+	// Time the device was unavailable
+	Downtime time.Duration
+}
+
+// Camera wrapper that survives the device dropping off the bus.
+// When an operation fails with ErrDeviceGone, the camera is closed and
+// the same physical device is waited for, matched by its USB serial number
+// or, lacking one, by its bus_info. Once it is back, image format, frame
+// rate, buffer count and controls set through the wrapper are reapplied
+// and streaming is resumed. The lost camera is closed without waiting for
+// its frames, which stay readable until they are released. Release them
+// with Frame.Release, which returns a frame to the camera it came from.
+// ResilientCamera is safe for concurrent use, like Camera
+type ResilientCamera struct {
+	device DeviceInfo
+	config ReconnectConfig
+
+	// Guards the state below. Calls to the camera run without holding it,
+	// so that waiting for frames doesn't hold up other calls
+	mutex sync.Mutex
+	path  string
+	cam   *Camera
+
+	lost      time.Time
+	lostErr   error
+	streaming bool
+	closed    bool
+
+	formatSet bool
+	format    PixelFormat
+	width     uint32
+	height    uint32
+	fps       float32
+	bufcount  uint32
+	controls  map[ControlID]int64
+
+	reconnects chan ReconnectEvent
+}
+
+// Open a camera that reconnects automatically, see ResilientCamera
+func OpenResilient(path string, config ReconnectConfig) (*ResilientCamera, error) {
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = defaultRetryInterval
+	}
+	if config.Open == nil {
+		config.Open = Open
+	}
+	if config.ListDevices == nil {
+		config.ListDevices = ListDevices
+	}
+
+	r := new(ResilientCamera)
+	r.path = path
+	r.config = config
+	r.controls = make(map[ControlID]int64)
+	r.reconnects = make(chan ReconnectEvent, 16)
+	r.device = r.findDevice()
+
+	cam, err := config.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.cam = cam
+	return r, nil
+}
+
+// Identify the device by its path, so that it can be recognized later
+func (r *ResilientCamera) findDevice() DeviceInfo {
+	name := filepath.Base(r.path)
+	if target, err := filepath.EvalSymlinks(r.path); err == nil {
+		name = filepath.Base(target)
+	}
+
+	devices, err := r.config.ListDevices()
+
+	if err == nil {
+		for _, device := range devices {
+			if device.Path == r.path || device.Name == name {
+				return device
+			}
+		}
+	}
+
+	return GetDeviceInfo(r.path)
+}
+
+// Returns the underlying camera, nil while the device is lost
+func (r *ResilientCamera) Camera() *Camera {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.cam
+}
+
+// Returns the underlying camera, or an error while the device is lost
+func (r *ResilientCamera) camera() (*Camera, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.cam == nil {
+		return nil, r.lostError()
+	}
+	return r.cam, nil
+}
+
+// Returns channel delivering an event for every reconnect.
+// When the channel is full, the oldest event is dropped
+func (r *ResilientCamera) Reconnects() <-chan ReconnectEvent {
+	return r.reconnects
+}
+
+// Sets image format and frame size, see Camera.SetImageFormat
+func (r *ResilientCamera) SetImageFormat(f PixelFormat, width, height uint32) (PixelFormat, uint32, uint32, error) {
+	cam, err := r.camera()
+
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	code, w, h, err := cam.SetImageFormat(f, width, height)
+
+	if err != nil {
+		return 0, 0, 0, r.check(cam, err)
+	}
+
+	r.mutex.Lock()
+	r.formatSet = true
+	r.format, r.width, r.height = f, width, height
+	r.mutex.Unlock()
+	return code, w, h, nil
+}
+
+// Returns image format currently set on the device, see Camera.GetImageFormat
+func (r *ResilientCamera) GetImageFormat() (ImageFormat, error) {
+	cam, err := r.camera()
+
+	if err != nil {
+		return ImageFormat{}, err
+	}
+
+	f, err := cam.GetImageFormat()
+
+	if err != nil {
+		return ImageFormat{}, r.check(cam, err)
+	}
+
+	return f, nil
+}
+
+// Returns the format the driver would choose, see Camera.TryImageFormat
+func (r *ResilientCamera) TryImageFormat(f ImageFormat) (ImageFormat, error) {
+	cam, err := r.camera()
+
+	if err != nil {
+		return ImageFormat{}, err
+	}
+
+	result, err := cam.TryImageFormat(f)
+
+	if err != nil {
+		return ImageFormat{}, r.check(cam, err)
+	}
+
+	return result, nil
+}
+
+// Sets frame rate, see Camera.SetFrameRate
+func (r *ResilientCamera) SetFrameRate(fps float32) (float32, error) {
+	cam, err := r.camera()
+
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := cam.SetFrameRate(fps)
+
+	if err != nil {
+		return 0, r.check(cam, err)
+	}
+
+	r.mutex.Lock()
+	r.fps = fps
+	r.mutex.Unlock()
+	return result, nil
+}
+
+// Set the number of frames to be buffered, see Camera.SetBufferCount
+func (r *ResilientCamera) SetBufferCount(count uint32) error {
+	cam, err := r.camera()
+
+	if err != nil {
+		return err
+	}
+
+	err = cam.SetBufferCount(count)
+
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.bufcount = count
+	r.mutex.Unlock()
+	return nil
+}
+
+// Set a control, see Camera.SetExtControl
+func (r *ResilientCamera) SetControl(id ControlID, value int64) error {
+	return r.SetControls(map[ControlID]int64{id: value})
+}
+
+// Apply several controls at once, see Camera.SetControls
+func (r *ResilientCamera) SetControls(values map[ControlID]int64) error {
+	cam, err := r.camera()
+
+	if err != nil {
+		return err
+	}
+
+	err = cam.SetControls(values)
+
+	if err != nil {
+		return r.check(cam, err)
+	}
+
+	r.mutex.Lock()
+	for id, value := range values {
+		r.controls[id] = value
+	}
+	r.mutex.Unlock()
+	return nil
+}
+
+// Start streaming, streaming is resumed after every reconnect
+func (r *ResilientCamera) StartStreaming() error {
+	cam, err := r.camera()
+
+	if err != nil {
+		return err
+	}
+
+	err = cam.StartStreaming()
+
+	if err != nil {
+		return r.check(cam, err)
+	}
+
+	r.mutex.Lock()
+	r.streaming = true
+	r.mutex.Unlock()
+	return nil
+}
+
+// Stop streaming, also while the device is lost
+func (r *ResilientCamera) StopStreaming() error {
+	r.mutex.Lock()
+	if !r.streaming {
+		r.mutex.Unlock()
+		return fmt.Errorf("Request to stop streaming: %w", ErrNotStreaming)
+	}
+	r.streaming = false
+	cam := r.cam
+	r.mutex.Unlock()
+
+	if cam == nil {
+		return nil
+	}
+
+	err := cam.StopStreaming()
+
+	// Streaming goes on if frames are held
+	if errors.Is(err, ErrFramesHeld) {
+		r.mutex.Lock()
+		r.streaming = true
+		r.mutex.Unlock()
+	}
+
+	return r.check(cam, err)
+}
+
+// Wait until frame could be read. While the device is lost, it is searched
+// for until timeout expires. Reconnecting is reported as a Timeout,
+// unless a frame arrives in time
+func (r *ResilientCamera) WaitForFrame(timeout uint32) error {
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+
+	cam, err := r.camera()
+
+	if errors.Is(err, ErrClosed) {
+		return err
+	}
+
+	for cam == nil {
+		if cam = r.reconnect(); cam != nil {
+			break
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 {
+			return new(Timeout)
+		}
+		if left > r.config.RetryInterval {
+			left = r.config.RetryInterval
+		}
+		time.Sleep(left)
+	}
+
+	err = cam.WaitForFrame(timeoutSeconds(time.Until(deadline)))
+
+	// Report lost device as a timeout, it is searched for on the next call
+	if err != nil && r.check(cam, err) == nil {
+		return new(Timeout)
+	}
+
+	return err
+}
+
+// Get a frame, see Camera.GetFrameWithMetadata
+// Fails with EAGAIN while the device is lost
+func (r *ResilientCamera) GetFrameWithMetadata() (*Frame, error) {
+	cam := r.Camera()
+
+	if cam == nil {
+		return nil, unix.EAGAIN
+	}
+
+	frame, err := cam.GetFrameWithMetadata()
+
+	if err != nil {
+		if r.check(cam, err) == nil {
+			return nil, unix.EAGAIN
+		}
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// Get a frame and its buffer index, see Camera.GetFrame
+func (r *ResilientCamera) GetFrame() ([]byte, uint32, error) {
+	frame, err := r.GetFrameWithMetadata()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return frame.Bytes(), frame.Index, nil
+}
+
+// Read a single frame, see Camera.ReadFrame
+func (r *ResilientCamera) ReadFrame() ([]byte, error) {
+	frame, err := r.GetFrameWithMetadata()
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := append([]byte(nil), frame.Bytes()...)
+	frame.Release()
+	return result, nil
+}
+
+// Release a frame buffer of the current camera, has no effect while
+// the device is lost. Frame.Release is preferred, see ResilientCamera
+func (r *ResilientCamera) ReleaseFrame(index uint32) error {
+	cam := r.Camera()
+
+	if cam == nil {
+		return nil
+	}
+
+	err := cam.ReleaseFrame(index)
+
+	if err != nil && r.check(cam, err) == nil {
+		return nil
+	}
+
+	return err
+}
+
+// Deliver frames on a channel, see Camera.Stream. The stream survives
+// reconnects, every frame must be released with Release
+func (r *ResilientCamera) Stream(ctx context.Context) (<-chan *Frame, <-chan error) {
+	return streamChannel(ctx, r)
+}
+
+// Call fn for every frame, see Camera.StreamFunc. The stream survives reconnects
+func (r *ResilientCamera) StreamFunc(ctx context.Context, fn func(*Frame) error) error {
+	return streamFunc(ctx, r, fn)
+}
+
+func (r *ResilientCamera) stream(ctx context.Context, deliver func(*Frame) bool) error {
+	r.mutex.Lock()
+	streaming := r.streaming
+	r.mutex.Unlock()
+
+	if !streaming {
+		return fmt.Errorf("Request to stream: %w", ErrNotStreaming)
+	}
+
+	return dequeueLoop(ctx, r, deliver)
+}
+
+// Close the camera, also while the device is lost. Like Camera.Close,
+// returns ErrFramesHeld if frames are not released in time, and closes
+// the camera nonetheless
+func (r *ResilientCamera) Close() error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return ErrClosed
+	}
+	cam := r.cam
+	r.streaming = false
+	r.closed = true
+	r.cam = nil
+	r.mutex.Unlock()
+
+	if cam == nil {
+		return nil
+	}
+
+	return cam.Close()
+}
+
+// Returns why there is no camera, must be called with the mutex held
+func (r *ResilientCamera) lostError() error {
+	if r.closed {
+		return ErrClosed
+	}
+	if r.lostErr == nil {
+		return ErrDeviceGone
+	}
+	return fmt.Errorf("%w: %v", ErrDeviceGone, r.lostErr)
+}
+
+// Drop the camera if err indicates the device is gone, returns nil
+// in that case and err otherwise
+func (r *ResilientCamera) check(cam *Camera, err error) error {
+	if err == nil || !errors.Is(err, ErrDeviceGone) {
+		return err
+	}
+
+	r.mutex.Lock()
+	// Another call may have dropped the camera already
+	if r.cam != cam {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.cam = nil
+	r.lost = time.Now()
+	r.lostErr = err
+	r.mutex.Unlock()
+
+	// Frames held by the consumer stay mapped until they are released,
+	// errors of the device itself don't matter anymore
+	cam.abandon()
+	return nil
+}
+
+// Try to find and reopen the lost device, returns the reopened camera,
+// or nil if the device is not back yet
+func (r *ResilientCamera) reconnect() *Camera {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Another call may have reconnected already
+	if r.cam != nil || r.closed {
+		return r.cam
+	}
+
+	devices, err := r.config.ListDevices()
+
+	if err != nil {
+		return nil
+	}
+
+	for _, device := range devices {
+		if !r.matches(device) {
+			continue
+		}
+
+		cam, err := r.config.Open(device.Path)
+
+		if err != nil {
+			continue
+		}
+
+		if err = r.restore(cam); err != nil {
+			cam.Close()
+			continue
+		}
+
+		r.cam = cam
+		r.path = device.Path
+
+		event := ReconnectEvent{Device: device, Err: r.lostErr, Downtime: time.Since(r.lost)}
+		for {
+			select {
+			case r.reconnects <- event:
+				return cam
+			default:
+			}
+
+			select {
+			case <-r.reconnects:
+			default:
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns true if device is the lost one
+func (r *ResilientCamera) matches(device DeviceInfo) bool {
+	if !device.IsCapture() {
+		return false
+	}
+
+	switch {
+	case r.device.Serial != "":
+		return device.Serial == r.device.Serial &&
+			device.VendorID == r.device.VendorID &&
+			device.ProductID == r.device.ProductID
+	case r.device.BusInfo != "":
+		return device.BusInfo == r.device.BusInfo
+	default:
+		return device.Path == r.path
+	}
+}
+
+// Reapply settings to a reopened camera and resume streaming
+func (r *ResilientCamera) restore(cam *Camera) error {
+	if r.formatSet {
+		if _, _, _, err := cam.SetImageFormat(r.format, r.width, r.height); err != nil {
+			return err
+		}
+	}
+
+	if r.fps > 0 {
+		if _, err := cam.SetFrameRate(r.fps); err != nil {
+			return err
+		}
+	}
+
+	if r.bufcount > 0 {
+		if err := cam.SetBufferCount(r.bufcount); err != nil {
+			return err
+		}
+	}
+
+	if len(r.controls) > 0 {
+		if err := cam.SetControls(r.controls); err != nil {
+			return err
+		}
+	}
+
+	if r.streaming {
+		return cam.StartStreaming()
+	}
+
+	return nil
+}
+
+// Returns timeout in whole seconds, rounded up, so that waits shorter
+// than a second don't turn into polls
+func timeoutSeconds(timeout time.Duration) uint32 {
+	if timeout <= 0 {
+		return 0
+	}
+	return uint32((timeout + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,188 @@
+package webcam
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testResilientPath = "/dev/video-test"
+
+// Opens a resilient camera on fakes that disconnect after disconnectAfter
+// frames, while devices lists the devices the lost one is searched among
+func openTestResilient(t *testing.T, disconnectAfter uint32, devices func() []DeviceInfo) *ResilientCamera {
+	t.Helper()
+
+	r, err := OpenResilient(testResilientPath, ReconnectConfig{
+		RetryInterval: 10 * time.Millisecond,
+		Open: func(path string) (*Camera, error) {
+			config := DefaultFakeConfig()
+			config.DisconnectAfter = disconnectAfter
+			return OpenFake(config)
+		},
+		ListDevices: func() ([]DeviceInfo, error) { return devices(), nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func testResilientDevices() []DeviceInfo {
+	return []DeviceInfo{{Path: testResilientPath, Name: "video-test", BusInfo: "fake:0", DeviceCaps: V4L2_CAP_VIDEO_CAPTURE}}
+}
+
+func TestTimeoutSeconds(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    uint32
+	}{
+		{-time.Second, 0},
+		{0, 0},
+		{time.Millisecond, 1},
+		{999 * time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+	}
+
+	for _, tt := range tests {
+		if got := timeoutSeconds(tt.timeout); got != tt.want {
+			t.Errorf("timeoutSeconds(%v) = %d, want %d", tt.timeout, got, tt.want)
+		}
+	}
+}
+
+func TestResilientReconnect(t *testing.T) {
+	r := openTestResilient(t, 3, testResilientDevices)
+
+	if _, _, _, err := r.SetImageFormat(EncodeFormat("RGB3"), 320, 240); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Calls from other goroutines go on while the device is lost
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			r.GetImageFormat()
+			r.Camera()
+		}
+	}()
+
+	if err := r.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	held, err := r.GetFrameWithMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The held frame must not hold up dropping the lost camera
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.Reconnects()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("device was not reconnected")
+		}
+		err := r.WaitForFrame(1)
+		if _, ok := err.(*Timeout); ok {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		frame, err := r.GetFrameWithMetadata()
+		if err != nil {
+			continue
+		}
+		frame.Release()
+	}
+
+	event := <-r.Reconnects()
+	if !errors.Is(event.Err, ErrDeviceGone) || event.Device.Path != testResilientPath {
+		t.Errorf("reconnect of %s after %v, want %s after ENODEV", event.Device.Path, event.Err, testResilientPath)
+	}
+	if held.Released() {
+		t.Error("held frame was released by the reconnect")
+	}
+	if err = held.Release(); err != nil {
+		t.Errorf("Release of a frame of the lost camera = %v", err)
+	}
+
+	// Format is reapplied and streaming resumed
+	f, err := r.GetImageFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if DecodeFormat(f.PixelFormat) != "RGB3" || f.Width != 320 || f.Height != 240 {
+		t.Errorf("format after reconnect is %s %dx%d, want RGB3 320x240", DecodeFormat(f.PixelFormat), f.Width, f.Height)
+	}
+	if err = r.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := r.GetFrameWithMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame.Bytes()) != 320*240*3 {
+		t.Errorf("frame has %d bytes after reconnect, want %d", len(frame.Bytes()), 320*240*3)
+	}
+	frame.Release()
+}
+
+func TestResilientLostErrors(t *testing.T) {
+	r := openTestResilient(t, 1, func() []DeviceInfo { return nil })
+
+	if err := r.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := r.GetFrameWithMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame.Release()
+
+	// Dequeueing fails once the device is gone
+	if err = r.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.GetFrameWithMetadata(); err == nil {
+		t.Fatal("GetFrameWithMetadata of a lost device succeeded")
+	}
+	if r.Camera() != nil {
+		t.Fatal("camera of the lost device was not dropped")
+	}
+
+	err = r.SetControl(ControlID(V4L2_CID_BASE), 1)
+	if !errors.Is(err, ErrDeviceGone) || strings.Contains(err.Error(), "<nil>") {
+		t.Errorf("SetControl while the device is lost = %v, want ErrDeviceGone", err)
+	}
+	if _, ok := r.WaitForFrame(0).(*Timeout); !ok {
+		t.Error("WaitForFrame while the device is lost is not a Timeout")
+	}
+
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.GetImageFormat(); !errors.Is(err, ErrClosed) {
+		t.Errorf("GetImageFormat after Close = %v, want ErrClosed", err)
+	}
+	if err = r.WaitForFrame(1); !errors.Is(err, ErrClosed) {
+		t.Errorf("WaitForFrame after Close = %v, want ErrClosed", err)
+	}
+
+	if err = new(ResilientCamera).lostError(); err != ErrDeviceGone {
+		t.Errorf("lostError without a recorded error = %v, want ErrDeviceGone", err)
+	}
+}
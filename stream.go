@@ -0,0 +1,124 @@
+package webcam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Timeout in seconds of a single wait for frame in streaming loops.
+// Cancellation of a context is noticed at least this often
+const streamWaitTimeout = 1
+
+// Camera or a wrapper that frames can be streamed from
+type frameSource interface {
+	WaitForFrame(timeout uint32) error
+	GetFrameWithMetadata() (*Frame, error)
+	stream(ctx context.Context, deliver func(*Frame) bool) error
+}
+
+// Deliver frames on a channel until ctx is cancelled or an error occurs.
+// The dequeue loop runs in its own goroutine, built on WaitForFrame and
+// GetFrameWithMetadata. Every received frame must be returned to the driver
+// with Release, otherwise the driver runs out of buffers.
+// Frame channel is closed when the loop ends, then the error channel
+// delivers the reason: ctx.Err() on cancellation or the device error.
+// Streaming must be started with StartStreaming beforehand, and is not
+// stopped by Stream, so that frames held by the consumer stay valid
+func (w *Camera) Stream(ctx context.Context) (<-chan *Frame, <-chan error) {
+	return streamChannel(ctx, w)
+}
+
+// Call fn for every frame until ctx is cancelled, fn returns an error
+// or the device fails. Frame is returned to the driver as soon as fn
+// returns, so fn must copy any data it wants to keep.
+// Returns ctx.Err() on cancellation, otherwise the error that ended the loop.
+// Streaming must be started with StartStreaming beforehand
+func (w *Camera) StreamFunc(ctx context.Context, fn func(*Frame) error) error {
+	return streamFunc(ctx, w, fn)
+}
+
+// Dequeue loop shared by Stream, StreamFunc and Broadcaster, deliver
+// returns false to end the loop
+func (w *Camera) stream(ctx context.Context, deliver func(*Frame) bool) error {
+	w.mutex.Lock()
+	streaming := w.streaming
+	w.mutex.Unlock()
+
+	if !streaming {
+		return fmt.Errorf("Request to stream: %w", ErrNotStreaming)
+	}
+
+	return dequeueLoop(ctx, w, deliver)
+}
+
+func streamChannel(ctx context.Context, src frameSource) (<-chan *Frame, <-chan error) {
+	frames := make(chan *Frame)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		err := src.stream(ctx, func(frame *Frame) bool {
+			select {
+			case frames <- frame:
+				return true
+			case <-ctx.Done():
+				frame.Release()
+				return false
+			}
+		})
+		close(frames)
+		errs <- err
+	}()
+
+	return frames, errs
+}
+
+func streamFunc(ctx context.Context, src frameSource, fn func(*Frame) error) error {
+	var fnErr error
+
+	err := src.stream(ctx, func(frame *Frame) bool {
+		fnErr = fn(frame)
+		frame.Release()
+		return fnErr == nil
+	})
+
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+func dequeueLoop(ctx context.Context, src frameSource, deliver func(*Frame) bool) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		err := src.WaitForFrame(streamWaitTimeout)
+
+		switch err.(type) {
+		case nil:
+		case *Timeout:
+			continue
+		default:
+			return err
+		}
+
+		frame, err := src.GetFrameWithMetadata()
+
+		if errors.Is(err, unix.EAGAIN) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if !deliver(frame) {
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package webcam
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Frame source replaying scripted results of WaitForFrame and
+// GetFrameWithMetadata, a nil frame error delivers a new frame
+type testFrameSource struct {
+	waits  []error
+	gets   []error
+	frames []*Frame
+}
+
+func (s *testFrameSource) WaitForFrame(timeout uint32) error {
+	if len(s.waits) == 0 {
+		return errors.New("No more frames")
+	}
+	err := s.waits[0]
+	s.waits = s.waits[1:]
+	return err
+}
+
+func (s *testFrameSource) GetFrameWithMetadata() (*Frame, error) {
+	err := s.gets[0]
+	s.gets = s.gets[1:]
+	if err != nil {
+		return nil, err
+	}
+	frame := &Frame{Sequence: uint32(len(s.frames))}
+	s.frames = append(s.frames, frame)
+	return frame, nil
+}
+
+func (s *testFrameSource) stream(ctx context.Context, deliver func(*Frame) bool) error {
+	return dequeueLoop(ctx, s, deliver)
+}
+
+func TestDequeueLoopRetries(t *testing.T) {
+	src := &testFrameSource{
+		waits: []error{&Timeout{}, nil, &Timeout{}, nil, nil},
+		gets:  []error{nil, unix.EAGAIN, nil},
+	}
+
+	var delivered []uint32
+	err := dequeueLoop(context.Background(), src, func(frame *Frame) bool {
+		delivered = append(delivered, frame.Sequence)
+		return true
+	})
+
+	// Timeouts and EAGAIN are retried, the loop ends with the source
+	if err == nil || err.Error() != "No more frames" {
+		t.Errorf("loop ended with %v, want the error of the source", err)
+	}
+	if len(delivered) != 2 {
+		t.Errorf("delivered %d frames, want 2", len(delivered))
+	}
+}
+
+func TestDequeueLoopErrors(t *testing.T) {
+	src := &testFrameSource{waits: []error{nil}, gets: []error{ErrDeviceGone}}
+	if err := dequeueLoop(context.Background(), src, nil); err != ErrDeviceGone {
+		t.Errorf("loop ended with %v, want the error of GetFrameWithMetadata", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	src = &testFrameSource{}
+	if err := dequeueLoop(ctx, src, nil); err != context.Canceled {
+		t.Errorf("loop of a cancelled context ended with %v, want context.Canceled", err)
+	}
+}
+
+func TestStreamNotStreaming(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	err := cam.StreamFunc(context.Background(), func(*Frame) error { return nil })
+	if !errors.Is(err, ErrNotStreaming) {
+		t.Errorf("StreamFunc before StartStreaming = %v, want ErrNotStreaming", err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	frames, errs := cam.Stream(ctx)
+
+	for i := 0; i < 3; i++ {
+		frame, ok := <-frames
+		if !ok {
+			t.Fatal("frame channel closed while streaming")
+		}
+		if err := frame.Release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Loop blocks delivering a frame nobody receives until cancelled
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Errorf("stream ended with %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not end on cancellation")
+	}
+	if _, ok := <-frames; ok {
+		t.Error("frame channel is open after cancellation")
+	}
+	if _, ok := <-errs; ok {
+		t.Error("error channel is open after cancellation")
+	}
+
+	// Frame that was not delivered went back to the driver
+	cam.mutex.Lock()
+	held := cam.heldFrames()
+	cam.mutex.Unlock()
+	if held != 0 {
+		t.Errorf("%d frames held after cancellation, want 0", held)
+	}
+}
+
+func TestStreamFuncError(t *testing.T) {
+	cam := openTestFake(t, DefaultFakeConfig())
+
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err := cam.StreamFunc(context.Background(), func(frame *Frame) error {
+		if len(frame.Bytes()) == 0 {
+			t.Error("empty frame")
+		}
+		calls++
+		if calls == 3 {
+			return stop
+		}
+		return nil
+	})
+
+	if err != stop {
+		t.Errorf("StreamFunc = %v, want the error of the callback", err)
+	}
+	if calls != 3 {
+		t.Errorf("callback called %d times, want 3", calls)
+	}
+
+	// Frames are released once the callback returns
+	cam.mutex.Lock()
+	held := cam.heldFrames()
+	cam.mutex.Unlock()
+	if held != 0 {
+		t.Errorf("%d frames held after StreamFunc, want 0", held)
+	}
+}
+
+func TestStreamDeviceGone(t *testing.T) {
+	config := DefaultFakeConfig()
+	config.DisconnectAfter = 2
+	cam := openTestFake(t, config)
+
+	if err := cam.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	frames, errs := cam.Stream(context.Background())
+	count := 0
+	for frame := range frames {
+		frame.Release()
+		count++
+	}
+	if err := <-errs; !errors.Is(err, ErrDeviceGone) {
+		t.Errorf("stream ended with %v, want ErrDeviceGone", err)
+	}
+	if count != 2 {
+		t.Errorf("received %d frames, want 2", count)
+	}
+}
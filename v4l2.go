@@ -3,34 +3,115 @@ package webcam
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"time"
 	"unsafe"
 
 	"github.com/justinscorringe/webcam/ioctl"
 	"golang.org/x/sys/unix"
 )
 
-type controlType int
-
-const (
-	c_int controlType = iota
-	c_bool
-	c_menu
-)
-
 type control struct {
 	id     uint32
 	name   string
-	c_type controlType
-	min    int32
-	max    int32
+	c_type uint32
+	min    int64
+	max    int64
+	step   int64
+	def    int64
+	flags  uint32
+}
+
+// Value of a control passed to extended control ioctls.
+// String controls carry their value in payload instead of value
+type extControl struct {
+	id      uint32
+	c_type  uint32
+	value   int64
+	payload []byte
 }
 
 const (
-	V4L2_CAP_VIDEO_CAPTURE      uint32 = 0x00000001
-	V4L2_CAP_STREAMING          uint32 = 0x04000000
-	V4L2_BUF_TYPE_VIDEO_CAPTURE uint32 = 1
-	V4L2_MEMORY_MMAP            uint32 = 1
-	V4L2_FIELD_ANY              uint32 = 0
+	V4L2_CAP_VIDEO_CAPTURE             uint32 = 0x00000001
+	V4L2_CAP_VIDEO_CAPTURE_MPLANE      uint32 = 0x00001000
+	V4L2_CAP_READWRITE                 uint32 = 0x01000000
+	V4L2_CAP_STREAMING                 uint32 = 0x04000000
+	V4L2_CAP_DEVICE_CAPS               uint32 = 0x80000000
+	V4L2_CAP_TIMEPERFRAME              uint32 = 0x00001000
+	V4L2_BUF_TYPE_VIDEO_CAPTURE        uint32 = 1
+	V4L2_BUF_TYPE_VIDEO_CAPTURE_MPLANE uint32 = 9
+	VIDEO_MAX_PLANES                   uint32 = 8
+	V4L2_MEMORY_MMAP                   uint32 = 1
+	V4L2_MEMORY_USERPTR                uint32 = 2
+	V4L2_MEMORY_DMABUF                 uint32 = 4
+	V4L2_FIELD_ANY                     uint32 = 0
+)
+
+const (
+	V4L2_FIELD_NONE       uint32 = 1
+	V4L2_FIELD_TOP        uint32 = 2
+	V4L2_FIELD_BOTTOM     uint32 = 3
+	V4L2_FIELD_INTERLACED uint32 = 4
+)
+
+const (
+	V4L2_PIX_FMT_PRIV_MAGIC        uint32 = 0xfeedcafe
+	V4L2_PIX_FMT_FLAG_PREMUL_ALPHA uint32 = 0x00000001
+	V4L2_PIX_FMT_FLAG_SET_CSC      uint32 = 0x00000002
+)
+
+const (
+	V4L2_COLORSPACE_DEFAULT       uint32 = 0
+	V4L2_COLORSPACE_SMPTE170M     uint32 = 1
+	V4L2_COLORSPACE_SMPTE240M     uint32 = 2
+	V4L2_COLORSPACE_REC709        uint32 = 3
+	V4L2_COLORSPACE_470_SYSTEM_M  uint32 = 5
+	V4L2_COLORSPACE_470_SYSTEM_BG uint32 = 6
+	V4L2_COLORSPACE_JPEG          uint32 = 7
+	V4L2_COLORSPACE_SRGB          uint32 = 8
+	V4L2_COLORSPACE_OPRGB         uint32 = 9
+	V4L2_COLORSPACE_BT2020        uint32 = 10
+	V4L2_COLORSPACE_RAW           uint32 = 11
+	V4L2_COLORSPACE_DCI_P3        uint32 = 12
+
+	V4L2_YCBCR_ENC_DEFAULT          uint32 = 0
+	V4L2_YCBCR_ENC_601              uint32 = 1
+	V4L2_YCBCR_ENC_709              uint32 = 2
+	V4L2_YCBCR_ENC_XV601            uint32 = 3
+	V4L2_YCBCR_ENC_XV709            uint32 = 4
+	V4L2_YCBCR_ENC_BT2020           uint32 = 6
+	V4L2_YCBCR_ENC_BT2020_CONST_LUM uint32 = 7
+	V4L2_YCBCR_ENC_SMPTE240M        uint32 = 8
+
+	V4L2_QUANTIZATION_DEFAULT    uint32 = 0
+	V4L2_QUANTIZATION_FULL_RANGE uint32 = 1
+	V4L2_QUANTIZATION_LIM_RANGE  uint32 = 2
+
+	V4L2_XFER_FUNC_DEFAULT   uint32 = 0
+	V4L2_XFER_FUNC_709       uint32 = 1
+	V4L2_XFER_FUNC_SRGB      uint32 = 2
+	V4L2_XFER_FUNC_OPRGB     uint32 = 3
+	V4L2_XFER_FUNC_SMPTE240M uint32 = 4
+	V4L2_XFER_FUNC_NONE      uint32 = 5
+	V4L2_XFER_FUNC_DCI_P3    uint32 = 6
+	V4L2_XFER_FUNC_SMPTE2084 uint32 = 7
+)
+
+const (
+	V4L2_BUF_FLAG_KEYFRAME            uint32 = 0x00000008
+	V4L2_BUF_FLAG_PFRAME              uint32 = 0x00000010
+	V4L2_BUF_FLAG_BFRAME              uint32 = 0x00000020
+	V4L2_BUF_FLAG_ERROR               uint32 = 0x00000040
+	V4L2_BUF_FLAG_TIMECODE            uint32 = 0x00000100
+	V4L2_BUF_FLAG_TIMESTAMP_MASK      uint32 = 0x0000e000
+	V4L2_BUF_FLAG_TIMESTAMP_UNKNOWN   uint32 = 0x00000000
+	V4L2_BUF_FLAG_TIMESTAMP_MONOTONIC uint32 = 0x00002000
+	V4L2_BUF_FLAG_TIMESTAMP_COPY      uint32 = 0x00004000
+	V4L2_BUF_FLAG_TSTAMP_SRC_MASK     uint32 = 0x00070000
+	V4L2_BUF_FLAG_TSTAMP_SRC_EOF      uint32 = 0x00000000
+	V4L2_BUF_FLAG_TSTAMP_SRC_SOE      uint32 = 0x00010000
 )
 
 const (
@@ -39,10 +120,47 @@ const (
 	V4L2_FRMSIZE_TYPE_STEPWISE   uint32 = 3
 )
 
+const (
+	V4L2_FRMIVAL_TYPE_DISCRETE   uint32 = 1
+	V4L2_FRMIVAL_TYPE_CONTINUOUS uint32 = 2
+	V4L2_FRMIVAL_TYPE_STEPWISE   uint32 = 3
+)
+
 const (
 	V4L2_CID_BASE               uint32 = 0x00980900
 	V4L2_CID_AUTO_WHITE_BALANCE uint32 = V4L2_CID_BASE + 12
 	V4L2_CID_PRIVATE_BASE       uint32 = 0x08000000
+
+	V4L2_CID_CAMERA_CLASS_BASE  uint32 = 0x009a0900
+	V4L2_CID_EXPOSURE_AUTO      uint32 = V4L2_CID_CAMERA_CLASS_BASE + 1
+	V4L2_CID_EXPOSURE_ABSOLUTE  uint32 = V4L2_CID_CAMERA_CLASS_BASE + 2
+	V4L2_CID_EXPOSURE_AUTO_PRIO uint32 = V4L2_CID_CAMERA_CLASS_BASE + 3
+	V4L2_CID_FOCUS_ABSOLUTE     uint32 = V4L2_CID_CAMERA_CLASS_BASE + 10
+	V4L2_CID_FOCUS_RELATIVE     uint32 = V4L2_CID_CAMERA_CLASS_BASE + 11
+	V4L2_CID_FOCUS_AUTO         uint32 = V4L2_CID_CAMERA_CLASS_BASE + 12
+	V4L2_CID_ZOOM_ABSOLUTE      uint32 = V4L2_CID_CAMERA_CLASS_BASE + 13
+	V4L2_CID_AUTO_FOCUS_START   uint32 = V4L2_CID_CAMERA_CLASS_BASE + 28
+	V4L2_CID_AUTO_FOCUS_STOP    uint32 = V4L2_CID_CAMERA_CLASS_BASE + 29
+	V4L2_CID_AUTO_FOCUS_RANGE   uint32 = V4L2_CID_CAMERA_CLASS_BASE + 31
+)
+
+const (
+	V4L2_EXPOSURE_AUTO              int64 = 0
+	V4L2_EXPOSURE_MANUAL            int64 = 1
+	V4L2_EXPOSURE_SHUTTER_PRIORITY  int64 = 2
+	V4L2_EXPOSURE_APERTURE_PRIORITY int64 = 3
+)
+
+const (
+	V4L2_CTRL_CLASS_USER         uint32 = 0x00980000
+	V4L2_CTRL_CLASS_CODEC        uint32 = 0x00990000
+	V4L2_CTRL_CLASS_CAMERA       uint32 = 0x009a0000
+	V4L2_CTRL_CLASS_FLASH        uint32 = 0x009c0000
+	V4L2_CTRL_CLASS_JPEG         uint32 = 0x009d0000
+	V4L2_CTRL_CLASS_IMAGE_SOURCE uint32 = 0x009e0000
+	V4L2_CTRL_CLASS_IMAGE_PROC   uint32 = 0x009f0000
+
+	V4L2_CTRL_ID_MASK uint32 = 0x0fffffff
 )
 
 const (
@@ -63,29 +181,104 @@ const (
 )
 
 const (
-	V4L2_CTRL_FLAG_DISABLED  uint32 = 0x00000001
-	V4L2_CTRL_FLAG_NEXT_CTRL uint32 = 0x80000000
+	V4L2_CTRL_FLAG_DISABLED         uint32 = 0x00000001
+	V4L2_CTRL_FLAG_GRABBED          uint32 = 0x00000002
+	V4L2_CTRL_FLAG_READ_ONLY        uint32 = 0x00000004
+	V4L2_CTRL_FLAG_UPDATE           uint32 = 0x00000008
+	V4L2_CTRL_FLAG_INACTIVE         uint32 = 0x00000010
+	V4L2_CTRL_FLAG_SLIDER           uint32 = 0x00000020
+	V4L2_CTRL_FLAG_WRITE_ONLY       uint32 = 0x00000040
+	V4L2_CTRL_FLAG_VOLATILE         uint32 = 0x00000080
+	V4L2_CTRL_FLAG_HAS_PAYLOAD      uint32 = 0x00000100
+	V4L2_CTRL_FLAG_EXECUTE_ON_WRITE uint32 = 0x00000200
+	V4L2_CTRL_FLAG_MODIFY_LAYOUT    uint32 = 0x00000400
+	V4L2_CTRL_FLAG_NEXT_CTRL        uint32 = 0x80000000
+	V4L2_CTRL_FLAG_NEXT_COMPOUND    uint32 = 0x40000000
+)
+
+const (
+	V4L2_EVENT_ALL           uint32 = 0
+	V4L2_EVENT_VSYNC         uint32 = 1
+	V4L2_EVENT_EOS           uint32 = 2
+	V4L2_EVENT_CTRL          uint32 = 3
+	V4L2_EVENT_FRAME_SYNC    uint32 = 4
+	V4L2_EVENT_SOURCE_CHANGE uint32 = 5
+	V4L2_EVENT_MOTION_DET    uint32 = 6
+
+	V4L2_EVENT_CTRL_CH_VALUE uint32 = 0x0001
+	V4L2_EVENT_CTRL_CH_FLAGS uint32 = 0x0002
+	V4L2_EVENT_CTRL_CH_RANGE uint32 = 0x0004
+
+	V4L2_EVENT_SRC_CH_RESOLUTION uint32 = 0x0001
+
+	V4L2_EVENT_SUB_FL_SEND_INITIAL   uint32 = 0x0001
+	V4L2_EVENT_SUB_FL_ALLOW_FEEDBACK uint32 = 0x0002
 )
 
 var (
 	VIDIOC_QUERYCAP  = ioctl.IoR(uintptr('V'), 0, unsafe.Sizeof(v4l2_capability{}))
 	VIDIOC_ENUM_FMT  = ioctl.IoRW(uintptr('V'), 2, unsafe.Sizeof(v4l2_fmtdesc{}))
+	VIDIOC_G_FMT     = ioctl.IoRW(uintptr('V'), 4, unsafe.Sizeof(v4l2_format{}))
 	VIDIOC_S_FMT     = ioctl.IoRW(uintptr('V'), 5, unsafe.Sizeof(v4l2_format{}))
 	VIDIOC_REQBUFS   = ioctl.IoRW(uintptr('V'), 8, unsafe.Sizeof(v4l2_requestbuffers{}))
 	VIDIOC_QUERYBUF  = ioctl.IoRW(uintptr('V'), 9, unsafe.Sizeof(v4l2_buffer{}))
 	VIDIOC_QBUF      = ioctl.IoRW(uintptr('V'), 15, unsafe.Sizeof(v4l2_buffer{}))
+	VIDIOC_EXPBUF    = ioctl.IoRW(uintptr('V'), 16, unsafe.Sizeof(v4l2_exportbuffer{}))
 	VIDIOC_DQBUF     = ioctl.IoRW(uintptr('V'), 17, unsafe.Sizeof(v4l2_buffer{}))
+	VIDIOC_G_PARM    = ioctl.IoRW(uintptr('V'), 21, unsafe.Sizeof(v4l2_streamparm{}))
+	VIDIOC_S_PARM    = ioctl.IoRW(uintptr('V'), 22, unsafe.Sizeof(v4l2_streamparm{}))
 	VIDIOC_G_CTRL    = ioctl.IoRW(uintptr('V'), 27, unsafe.Sizeof(v4l2_control{}))
 	VIDIOC_S_CTRL    = ioctl.IoRW(uintptr('V'), 28, unsafe.Sizeof(v4l2_control{}))
 	VIDIOC_QUERYCTRL = ioctl.IoRW(uintptr('V'), 36, unsafe.Sizeof(v4l2_queryctrl{}))
+	VIDIOC_QUERYMENU = ioctl.IoRW(uintptr('V'), 37, unsafe.Sizeof(v4l2_querymenu{}))
 	//sizeof int32
-	VIDIOC_STREAMON        = ioctl.IoW(uintptr('V'), 18, 4)
-	VIDIOC_STREAMOFF       = ioctl.IoW(uintptr('V'), 19, 4)
-	VIDIOC_ENUM_FRAMESIZES = ioctl.IoRW(uintptr('V'), 74, unsafe.Sizeof(v4l2_frmsizeenum{}))
-	__p                    = unsafe.Pointer(uintptr(0))
-	NativeByteOrder        = getNativeByteOrder()
+	VIDIOC_STREAMON            = ioctl.IoW(uintptr('V'), 18, 4)
+	VIDIOC_STREAMOFF           = ioctl.IoW(uintptr('V'), 19, 4)
+	VIDIOC_ENUM_FRAMESIZES     = ioctl.IoRW(uintptr('V'), 74, unsafe.Sizeof(v4l2_frmsizeenum{}))
+	VIDIOC_ENUM_FRAMEINTERVALS = ioctl.IoRW(uintptr('V'), 75, unsafe.Sizeof(v4l2_frmivalenum{}))
+	VIDIOC_TRY_FMT             = ioctl.IoRW(uintptr('V'), 64, unsafe.Sizeof(v4l2_format{}))
+	VIDIOC_G_EXT_CTRLS         = ioctl.IoRW(uintptr('V'), 71, unsafe.Sizeof(v4l2_ext_controls{}))
+	VIDIOC_S_EXT_CTRLS         = ioctl.IoRW(uintptr('V'), 72, unsafe.Sizeof(v4l2_ext_controls{}))
+	VIDIOC_TRY_EXT_CTRLS       = ioctl.IoRW(uintptr('V'), 73, unsafe.Sizeof(v4l2_ext_controls{}))
+	VIDIOC_QUERY_EXT_CTRL      = ioctl.IoRW(uintptr('V'), 103, unsafe.Sizeof(v4l2_query_ext_ctrl{}))
+	VIDIOC_DQEVENT             = ioctl.IoR(uintptr('V'), 89, unsafe.Sizeof(v4l2_event{}))
+	VIDIOC_SUBSCRIBE_EVENT     = ioctl.IoW(uintptr('V'), 90, unsafe.Sizeof(v4l2_event_subscription{}))
+	VIDIOC_UNSUBSCRIBE_EVENT   = ioctl.IoW(uintptr('V'), 91, unsafe.Sizeof(v4l2_event_subscription{}))
+	__p                        = unsafe.Pointer(uintptr(0))
+	NativeByteOrder            = getNativeByteOrder()
 )
 
+// Names of ioctls reported by IoctlError
+var ioctlNames = map[uintptr]string{
+	VIDIOC_QUERYCAP:            "VIDIOC_QUERYCAP",
+	VIDIOC_ENUM_FMT:            "VIDIOC_ENUM_FMT",
+	VIDIOC_G_FMT:               "VIDIOC_G_FMT",
+	VIDIOC_S_FMT:               "VIDIOC_S_FMT",
+	VIDIOC_REQBUFS:             "VIDIOC_REQBUFS",
+	VIDIOC_QUERYBUF:            "VIDIOC_QUERYBUF",
+	VIDIOC_QBUF:                "VIDIOC_QBUF",
+	VIDIOC_EXPBUF:              "VIDIOC_EXPBUF",
+	VIDIOC_DQBUF:               "VIDIOC_DQBUF",
+	VIDIOC_G_PARM:              "VIDIOC_G_PARM",
+	VIDIOC_S_PARM:              "VIDIOC_S_PARM",
+	VIDIOC_G_CTRL:              "VIDIOC_G_CTRL",
+	VIDIOC_S_CTRL:              "VIDIOC_S_CTRL",
+	VIDIOC_QUERYCTRL:           "VIDIOC_QUERYCTRL",
+	VIDIOC_QUERYMENU:           "VIDIOC_QUERYMENU",
+	VIDIOC_STREAMON:            "VIDIOC_STREAMON",
+	VIDIOC_STREAMOFF:           "VIDIOC_STREAMOFF",
+	VIDIOC_ENUM_FRAMESIZES:     "VIDIOC_ENUM_FRAMESIZES",
+	VIDIOC_ENUM_FRAMEINTERVALS: "VIDIOC_ENUM_FRAMEINTERVALS",
+	VIDIOC_TRY_FMT:             "VIDIOC_TRY_FMT",
+	VIDIOC_G_EXT_CTRLS:         "VIDIOC_G_EXT_CTRLS",
+	VIDIOC_S_EXT_CTRLS:         "VIDIOC_S_EXT_CTRLS",
+	VIDIOC_TRY_EXT_CTRLS:       "VIDIOC_TRY_EXT_CTRLS",
+	VIDIOC_QUERY_EXT_CTRL:      "VIDIOC_QUERY_EXT_CTRL",
+	VIDIOC_DQEVENT:             "VIDIOC_DQEVENT",
+	VIDIOC_SUBSCRIBE_EVENT:     "VIDIOC_SUBSCRIBE_EVENT",
+	VIDIOC_UNSUBSCRIBE_EVENT:   "VIDIOC_UNSUBSCRIBE_EVENT",
+}
+
 type v4l2_capability struct {
 	driver       [16]uint8
 	card         [32]uint8
@@ -127,6 +320,41 @@ type v4l2_frmsize_stepwise struct {
 	Step_height uint32
 }
 
+type v4l2_fract struct {
+	Numerator   uint32
+	Denominator uint32
+}
+
+type v4l2_frmivalenum struct {
+	index        uint32
+	pixel_format uint32
+	width        uint32
+	height       uint32
+	_type        uint32
+	union        [24]uint8
+	reserved     [2]uint32
+}
+
+type v4l2_frmival_stepwise struct {
+	Min  v4l2_fract
+	Max  v4l2_fract
+	Step v4l2_fract
+}
+
+type v4l2_streamparm struct {
+	_type uint32
+	union [200]uint8
+}
+
+type v4l2_captureparm struct {
+	Capability   uint32
+	Capturemode  uint32
+	Timeperframe v4l2_fract
+	Extendedmode uint32
+	Readbuffers  uint32
+	Reserved     [4]uint32
+}
+
 //Hack to make go compiler properly align union
 type v4l2_format_aligned_union struct {
 	data [200 - unsafe.Sizeof(__p)]byte
@@ -153,6 +381,27 @@ type v4l2_pix_format struct {
 	Xfer_func    uint32
 }
 
+type v4l2_plane_pix_format struct {
+	Sizeimage    uint32
+	Bytesperline uint32
+	Reserved     [6]uint16
+}
+
+type v4l2_pix_format_mplane struct {
+	Width        uint32
+	Height       uint32
+	Pixelformat  uint32
+	Field        uint32
+	Colorspace   uint32
+	Plane_fmt    [VIDEO_MAX_PLANES]v4l2_plane_pix_format
+	Num_planes   uint8
+	Flags        uint8
+	Ycbcr_enc    uint8
+	Quantization uint8
+	Xfer_func    uint8
+	Reserved     [7]uint8
+}
+
 type v4l2_requestbuffers struct {
 	count    uint32
 	_type    uint32
@@ -176,6 +425,23 @@ type v4l2_buffer struct {
 	reserved  uint32
 }
 
+type v4l2_plane struct {
+	bytesused   uint32
+	length      uint32
+	m           [unsafe.Sizeof(__p)]uint8
+	data_offset uint32
+	reserved    [11]uint32
+}
+
+type v4l2_exportbuffer struct {
+	_type    uint32
+	index    uint32
+	plane    uint32
+	flags    uint32
+	fd       int32
+	reserved [11]uint32
+}
+
 type v4l2_timecode struct {
 	_type    uint32
 	flags    uint32
@@ -203,18 +469,108 @@ type v4l2_control struct {
 	value int32
 }
 
-func checkCapabilities(fd uintptr) (supportsVideoCapture bool, supportsVideoStreaming bool, deviceCard string, err error) {
+type v4l2_query_ext_ctrl struct {
+	id            uint32
+	_type         uint32
+	name          [32]uint8
+	minimum       int64
+	maximum       int64
+	step          uint64
+	default_value int64
+	flags         uint32
+	elem_size     uint32
+	elems         uint32
+	nr_of_dims    uint32
+	dims          [4]uint32
+	reserved      [32]uint32
+}
+
+// Packed in the kernel, union holds either name or value
+type v4l2_querymenu struct {
+	id       uint32
+	index    uint32
+	union    [32]uint8
+	reserved uint32
+}
+
+// Packed in the kernel, union holds value, value64 or a pointer to the payload
+type v4l2_ext_control struct {
+	id        uint32
+	size      uint32
+	reserved2 [1]uint32
+	union     [8]uint8
+}
+
+type v4l2_event_subscription struct {
+	_type    uint32
+	id       uint32
+	flags    uint32
+	reserved [5]uint32
+}
+
+// Union holds 64-bit values, so it is 64-bit aligned
+type v4l2_event_union struct {
+	_    [0]uint64
+	data [64]uint8
+}
 
-	caps := &v4l2_capability{}
+type v4l2_event struct {
+	_type     uint32
+	union     v4l2_event_union
+	pending   uint32
+	sequence  uint32
+	timestamp unix.Timespec
+	id        uint32
+	reserved  [8]uint32
+}
 
-	err = ioctl.Ioctl(fd, VIDIOC_QUERYCAP, uintptr(unsafe.Pointer(caps)))
+// Value is a union of 32-bit and 64-bit values
+type v4l2_event_ctrl struct {
+	Changes       uint32
+	Type          uint32
+	Value         [8]uint8
+	Flags         uint32
+	Minimum       int32
+	Maximum       int32
+	Step          int32
+	Default_value int32
+}
+
+type v4l2_ext_controls struct {
+	which      uint32
+	count      uint32
+	error_idx  uint32
+	request_fd int32
+	reserved   [1]uint32
+	controls   uintptr
+}
+
+// Issue ioctl, errno is wrapped into IoctlError
+func doIoctl(fd uintptr, request uintptr, arg uintptr) error {
+	return ioctlError(request, ioctl.Ioctl(fd, request, arg))
+}
+
+func queryCapabilities(fd uintptr) (caps v4l2_capability, err error) {
+
+	err = doIoctl(fd, VIDIOC_QUERYCAP, uintptr(unsafe.Pointer(&caps)))
+	return
+
+}
+
+func checkCapabilities(fd uintptr) (capabilities uint32, deviceCard string, err error) {
+
+	caps, err := queryCapabilities(fd)
 
 	if err != nil {
 		return
 	}
 
-	supportsVideoCapture = (caps.capabilities & V4L2_CAP_VIDEO_CAPTURE) != 0
-	supportsVideoStreaming = (caps.capabilities & V4L2_CAP_STREAMING) != 0
+	// Capabilities of the opened node, rather than of the whole physical device
+	capabilities = caps.capabilities
+	if (capabilities & V4L2_CAP_DEVICE_CAPS) != 0 {
+		capabilities = caps.device_caps
+	}
+
 	max := len(caps.card)
 
 	index := 0
@@ -230,14 +586,14 @@ func checkCapabilities(fd uintptr) (supportsVideoCapture bool, supportsVideoStre
 
 }
 
-func getPixelFormat(fd uintptr, index uint32) (code uint32, description string, err error) {
+func getPixelFormat(fd uintptr, bufType uint32, index uint32) (code uint32, description string, err error) {
 
 	fmtdesc := &v4l2_fmtdesc{}
 
 	fmtdesc.index = index
-	fmtdesc._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
+	fmtdesc._type = bufType
 
-	err = ioctl.Ioctl(fd, VIDIOC_ENUM_FMT, uintptr(unsafe.Pointer(fmtdesc)))
+	err = doIoctl(fd, VIDIOC_ENUM_FMT, uintptr(unsafe.Pointer(fmtdesc)))
 
 	if err != nil {
 		return
@@ -255,7 +611,7 @@ func getFrameSize(fd uintptr, index uint32, code uint32) (frameSize FrameSize, e
 	frmsizeenum.index = index
 	frmsizeenum.pixel_format = code
 
-	err = ioctl.Ioctl(fd, VIDIOC_ENUM_FRAMESIZES, uintptr(unsafe.Pointer(frmsizeenum)))
+	err = doIoctl(fd, VIDIOC_ENUM_FRAMESIZES, uintptr(unsafe.Pointer(frmsizeenum)))
 
 	if err != nil {
 		return
@@ -299,57 +655,180 @@ func getFrameSize(fd uintptr, index uint32, code uint32) (frameSize FrameSize, e
 	return
 }
 
-func setImageFormat(fd uintptr, formatcode *uint32, width *uint32, height *uint32) (err error) {
+func getFrameInterval(fd uintptr, index uint32, code uint32, width uint32, height uint32) (frameInterval FrameInterval, err error) {
 
-	format := &v4l2_format{
-		_type: V4L2_BUF_TYPE_VIDEO_CAPTURE,
+	frmivalenum := &v4l2_frmivalenum{}
+	frmivalenum.index = index
+	frmivalenum.pixel_format = code
+	frmivalenum.width = width
+	frmivalenum.height = height
+
+	err = doIoctl(fd, VIDIOC_ENUM_FRAMEINTERVALS, uintptr(unsafe.Pointer(frmivalenum)))
+
+	if err != nil {
+		return
 	}
 
-	pix := v4l2_pix_format{
-		Width:       *width,
-		Height:      *height,
-		Pixelformat: *formatcode,
-		Field:       V4L2_FIELD_ANY,
+	return frameIntervalOf(frmivalenum)
+}
+
+// Decodes a frame interval enumerated by VIDIOC_ENUM_FRAMEINTERVALS according to its type
+func frameIntervalOf(frmivalenum *v4l2_frmivalenum) (frameInterval FrameInterval, err error) {
+	switch frmivalenum._type {
+
+	case V4L2_FRMIVAL_TYPE_DISCRETE:
+		discrete := &v4l2_fract{}
+		err = binary.Read(bytes.NewBuffer(frmivalenum.union[:]), NativeByteOrder, discrete)
+
+		if err != nil {
+			return
+		}
+
+		frameInterval.MinInterval = Fraction{discrete.Numerator, discrete.Denominator}
+		frameInterval.MaxInterval = frameInterval.MinInterval
+
+	case V4L2_FRMIVAL_TYPE_CONTINUOUS, V4L2_FRMIVAL_TYPE_STEPWISE:
+		// Driver fills in the stepwise struct for continuous intervals as well,
+		// with a step of 1
+		stepwise := &v4l2_frmival_stepwise{}
+		err = binary.Read(bytes.NewBuffer(frmivalenum.union[:]), NativeByteOrder, stepwise)
+
+		if err != nil {
+			return
+		}
+
+		frameInterval.MinInterval = Fraction{stepwise.Min.Numerator, stepwise.Min.Denominator}
+		frameInterval.MaxInterval = Fraction{stepwise.Max.Numerator, stepwise.Max.Denominator}
+		frameInterval.StepInterval = Fraction{stepwise.Step.Numerator, stepwise.Step.Denominator}
 	}
 
-	pixbytes := &bytes.Buffer{}
-	err = binary.Write(pixbytes, NativeByteOrder, pix)
+	return
+}
+
+func getStreamParm(fd uintptr, bufType uint32) (parm v4l2_captureparm, err error) {
+
+	streamparm := &v4l2_streamparm{
+		_type: bufType,
+	}
+
+	err = doIoctl(fd, VIDIOC_G_PARM, uintptr(unsafe.Pointer(streamparm)))
 
 	if err != nil {
 		return
 	}
 
-	copy(format.union.data[:], pixbytes.Bytes())
+	err = binary.Read(bytes.NewBuffer(streamparm.union[:]), NativeByteOrder, &parm)
+	return
+}
+
+func setStreamParm(fd uintptr, bufType uint32, parm *v4l2_captureparm) (err error) {
+
+	streamparm := &v4l2_streamparm{
+		_type: bufType,
+	}
+
+	parmbytes := &bytes.Buffer{}
+	err = binary.Write(parmbytes, NativeByteOrder, parm)
+
+	if err != nil {
+		return
+	}
+
+	copy(streamparm.union[:], parmbytes.Bytes())
 
-	err = ioctl.Ioctl(fd, VIDIOC_S_FMT, uintptr(unsafe.Pointer(format)))
+	err = doIoctl(fd, VIDIOC_S_PARM, uintptr(unsafe.Pointer(streamparm)))
 
 	if err != nil {
 		return
 	}
 
-	pixReverse := &v4l2_pix_format{}
-	err = binary.Read(bytes.NewBuffer(format.union.data[:]), NativeByteOrder, pixReverse)
+	err = binary.Read(bytes.NewBuffer(streamparm.union[:]), NativeByteOrder, parm)
+	return
+}
+
+func getImageFormat(fd uintptr) (pix v4l2_pix_format, err error) {
+
+	format := &v4l2_format{
+		_type: V4L2_BUF_TYPE_VIDEO_CAPTURE,
+	}
+
+	err = doIoctl(fd, VIDIOC_G_FMT, uintptr(unsafe.Pointer(format)))
 
 	if err != nil {
 		return
 	}
 
-	*width = pixReverse.Width
-	*height = pixReverse.Height
-	*formatcode = pixReverse.Pixelformat
+	err = binary.Read(bytes.NewBuffer(format.union.data[:]), NativeByteOrder, &pix)
+	return
+}
 
+func setImageFormat(fd uintptr, pix *v4l2_pix_format) error {
+	return exchangeFormat(fd, VIDIOC_S_FMT, V4L2_BUF_TYPE_VIDEO_CAPTURE, pix)
+}
+
+func tryImageFormat(fd uintptr, pix *v4l2_pix_format) error {
+	return exchangeFormat(fd, VIDIOC_TRY_FMT, V4L2_BUF_TYPE_VIDEO_CAPTURE, pix)
+}
+
+func getImageFormatMplane(fd uintptr) (pix v4l2_pix_format_mplane, err error) {
+
+	format := &v4l2_format{
+		_type: V4L2_BUF_TYPE_VIDEO_CAPTURE_MPLANE,
+	}
+
+	err = doIoctl(fd, VIDIOC_G_FMT, uintptr(unsafe.Pointer(format)))
+
+	if err != nil {
+		return
+	}
+
+	err = binary.Read(bytes.NewBuffer(format.union.data[:]), NativeByteOrder, &pix)
 	return
+}
+
+func setImageFormatMplane(fd uintptr, pix *v4l2_pix_format_mplane) error {
+	return exchangeFormat(fd, VIDIOC_S_FMT, V4L2_BUF_TYPE_VIDEO_CAPTURE_MPLANE, pix)
+}
+
+func tryImageFormatMplane(fd uintptr, pix *v4l2_pix_format_mplane) error {
+	return exchangeFormat(fd, VIDIOC_TRY_FMT, V4L2_BUF_TYPE_VIDEO_CAPTURE_MPLANE, pix)
+}
+
+// Passes pix to VIDIOC_S_FMT or VIDIOC_TRY_FMT and reads back the format
+// adjusted by the driver. pix is a *v4l2_pix_format or *v4l2_pix_format_mplane
+func exchangeFormat(fd uintptr, request uintptr, bufType uint32, pix interface{}) (err error) {
+
+	format := &v4l2_format{
+		_type: bufType,
+	}
+
+	pixbytes := &bytes.Buffer{}
+	err = binary.Write(pixbytes, NativeByteOrder, pix)
+
+	if err != nil {
+		return
+	}
+
+	copy(format.union.data[:], pixbytes.Bytes())
+
+	err = doIoctl(fd, request, uintptr(unsafe.Pointer(format)))
+
+	if err != nil {
+		return
+	}
 
+	err = binary.Read(bytes.NewBuffer(format.union.data[:]), NativeByteOrder, pix)
+	return
 }
 
-func mmapRequestBuffers(fd uintptr, buf_count *uint32) (err error) {
+func requestBuffers(fd uintptr, bufType uint32, memory uint32, buf_count *uint32) (err error) {
 
 	req := &v4l2_requestbuffers{}
 	req.count = *buf_count
-	req._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
-	req.memory = V4L2_MEMORY_MMAP
+	req._type = bufType
+	req.memory = memory
 
-	err = ioctl.Ioctl(fd, VIDIOC_REQBUFS, uintptr(unsafe.Pointer(req)))
+	err = doIoctl(fd, VIDIOC_REQBUFS, uintptr(unsafe.Pointer(req)))
 
 	if err != nil {
 		return
@@ -369,7 +848,7 @@ func mmapQueryBuffer(fd uintptr, index uint32, length *uint32) (buffer []byte, e
 	req.memory = V4L2_MEMORY_MMAP
 	req.index = index
 
-	err = ioctl.Ioctl(fd, VIDIOC_QUERYBUF, uintptr(unsafe.Pointer(req)))
+	err = doIoctl(fd, VIDIOC_QUERYBUF, uintptr(unsafe.Pointer(req)))
 
 	if err != nil {
 		return
@@ -388,85 +867,274 @@ func mmapQueryBuffer(fd uintptr, index uint32, length *uint32) (buffer []byte, e
 	return
 }
 
-func mmapDequeueBuffer(fd uintptr, index *uint32, length *uint32) (err error) {
+func dequeueBuffer(fd uintptr, memory uint32) (buffer v4l2_buffer, err error) {
+
+	buffer._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
+	buffer.memory = memory
+
+	err = doIoctl(fd, VIDIOC_DQBUF, uintptr(unsafe.Pointer(&buffer)))
+	return
+
+}
+
+func mmapEnqueueBuffer(fd uintptr, index uint32) (err error) {
 
 	buffer := &v4l2_buffer{}
 
 	buffer._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
 	buffer.memory = V4L2_MEMORY_MMAP
+	buffer.index = index
+
+	err = doIoctl(fd, VIDIOC_QBUF, uintptr(unsafe.Pointer(buffer)))
+	return
+
+}
+
+// Multiplanar buffers carry a pointer to an array of planes
+func setPlanes(buffer *v4l2_buffer, planes []v4l2_plane) {
+	buffer.length = uint32(len(planes))
+	*(*uintptr)(unsafe.Pointer(&buffer.union[0])) = uintptr(unsafe.Pointer(&planes[0]))
+}
+
+func mmapQueryPlanes(fd uintptr, index uint32) (buffers [][]byte, err error) {
+
+	req := &v4l2_buffer{}
+	planes := make([]v4l2_plane, VIDEO_MAX_PLANES)
+
+	req._type = V4L2_BUF_TYPE_VIDEO_CAPTURE_MPLANE
+	req.memory = V4L2_MEMORY_MMAP
+	req.index = index
+	setPlanes(req, planes)
 
-	err = ioctl.Ioctl(fd, VIDIOC_DQBUF, uintptr(unsafe.Pointer(buffer)))
+	err = doIoctl(fd, VIDIOC_QUERYBUF, uintptr(unsafe.Pointer(req)))
+	runtime.KeepAlive(planes)
 
 	if err != nil {
 		return
 	}
 
-	*index = buffer.index
-	*length = buffer.bytesused
+	buffers = make([][]byte, req.length)
+	for p := range buffers {
+		var offset uint32
+		err = binary.Read(bytes.NewBuffer(planes[p].m[:]), NativeByteOrder, &offset)
+
+		if err == nil {
+			buffers[p], err = unix.Mmap(int(fd), int64(offset), int(planes[p].length), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		}
+
+		if err != nil {
+			for _, buffer := range buffers[:p] {
+				unix.Munmap(buffer)
+			}
+			return nil, err
+		}
+	}
+
+	return
+}
+
+func dequeuePlanes(fd uintptr, memory uint32) (buffer v4l2_buffer, planes []v4l2_plane, err error) {
+
+	planes = make([]v4l2_plane, VIDEO_MAX_PLANES)
+
+	buffer._type = V4L2_BUF_TYPE_VIDEO_CAPTURE_MPLANE
+	buffer.memory = memory
+	setPlanes(&buffer, planes)
+
+	err = doIoctl(fd, VIDIOC_DQBUF, uintptr(unsafe.Pointer(&buffer)))
+	runtime.KeepAlive(planes)
+
+	if err != nil {
+		return
+	}
 
+	planes = planes[:buffer.length]
 	return
 
 }
 
-func mmapEnqueueBuffer(fd uintptr, index uint32) (err error) {
+func mmapEnqueuePlanes(fd uintptr, index uint32, numPlanes uint32) (err error) {
 
 	buffer := &v4l2_buffer{}
+	planes := make([]v4l2_plane, numPlanes)
 
-	buffer._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
+	buffer._type = V4L2_BUF_TYPE_VIDEO_CAPTURE_MPLANE
 	buffer.memory = V4L2_MEMORY_MMAP
 	buffer.index = index
+	setPlanes(buffer, planes)
+
+	err = doIoctl(fd, VIDIOC_QBUF, uintptr(unsafe.Pointer(buffer)))
+	runtime.KeepAlive(planes)
+	return
+
+}
+
+// Queue a buffer allocated by the caller, driver writes frame data
+// directly into its memory
+func userptrEnqueueBuffer(fd uintptr, index uint32, userBuffer []byte) (err error) {
+
+	buffer := &v4l2_buffer{}
+
+	buffer._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
+	buffer.memory = V4L2_MEMORY_USERPTR
+	buffer.index = index
+	buffer.length = uint32(len(userBuffer))
+	*(*uintptr)(unsafe.Pointer(&buffer.union[0])) = uintptr(unsafe.Pointer(&userBuffer[0]))
 
-	err = ioctl.Ioctl(fd, VIDIOC_QBUF, uintptr(unsafe.Pointer(buffer)))
+	err = doIoctl(fd, VIDIOC_QBUF, uintptr(unsafe.Pointer(buffer)))
 	return
 
 }
 
+// Queue a buffer backed by a DMABUF file descriptor imported from
+// another device or allocator
+func dmabufEnqueueBuffer(fd uintptr, index uint32, dmafd int, length uint32) (err error) {
+
+	buffer := &v4l2_buffer{}
+
+	buffer._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
+	buffer.memory = V4L2_MEMORY_DMABUF
+	buffer.index = index
+	buffer.length = length
+	*(*int32)(unsafe.Pointer(&buffer.union[0])) = int32(dmafd)
+
+	err = doIoctl(fd, VIDIOC_QBUF, uintptr(unsafe.Pointer(buffer)))
+	return
+
+}
+
+// Export a driver buffer as a DMABUF file descriptor
+func exportBuffer(fd uintptr, bufType uint32, index uint32, plane uint32) (dmafd int, err error) {
+
+	expbuf := &v4l2_exportbuffer{}
+
+	expbuf._type = bufType
+	expbuf.index = index
+	expbuf.plane = plane
+	expbuf.flags = unix.O_CLOEXEC | unix.O_RDWR
+
+	err = doIoctl(fd, VIDIOC_EXPBUF, uintptr(unsafe.Pointer(expbuf)))
+
+	if err != nil {
+		return
+	}
+
+	dmafd = int(expbuf.fd)
+	return
+
+}
+
+// Map a DMABUF into memory, so its content can be read by the CPU
+func dmabufMap(dmafd int) (buffer []byte, err error) {
+
+	size, err := unix.Seek(dmafd, 0, io.SeekEnd)
+
+	if err != nil {
+		return
+	}
+
+	buffer, err = unix.Mmap(dmafd, 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	return
+}
+
 func mmapReleaseBuffer(buffer []byte) (err error) {
 	err = unix.Munmap(buffer)
 	return
 }
 
-func startStreaming(fd uintptr) (err error) {
+// Read a frame using the read() I/O method
+func readFrame(fd uintptr, buffer []byte) (n int, err error) {
+
+	for {
+		n, err = unix.Read(int(fd), buffer)
 
-	var uintPointer uint32 = V4L2_BUF_TYPE_VIDEO_CAPTURE
-	err = ioctl.Ioctl(fd, VIDIOC_STREAMON, uintptr(unsafe.Pointer(&uintPointer)))
+		if err == unix.EINTR {
+			continue
+		}
+		return n, syscallError("read", err)
+	}
+
+}
+
+func startStreaming(fd uintptr, bufType uint32) (err error) {
+
+	var uintPointer uint32 = bufType
+	err = doIoctl(fd, VIDIOC_STREAMON, uintptr(unsafe.Pointer(&uintPointer)))
 	return
 
 }
 
-func stopStreaming(fd uintptr) (err error) {
+func stopStreaming(fd uintptr, bufType uint32) (err error) {
 
-	var uintPointer uint32 = V4L2_BUF_TYPE_VIDEO_CAPTURE
-	err = ioctl.Ioctl(fd, VIDIOC_STREAMOFF, uintptr(unsafe.Pointer(&uintPointer)))
+	var uintPointer uint32 = bufType
+	err = doIoctl(fd, VIDIOC_STREAMOFF, uintptr(unsafe.Pointer(&uintPointer)))
 	return
 
 }
 
-func waitForFrame(fd uintptr, timeout uint32) (count int, err error) {
+// Wait until a frame can be dequeued or an event is pending.
+// Pending events are signalled as an exceptional condition (POLLPRI)
+func waitForFrame(fd uintptr, timeout time.Duration) (frame bool, event bool, err error) {
 
 	for {
 		fds := &unix.FdSet{}
 		fds.Set(int(fd))
+		efds := &unix.FdSet{}
+		efds.Set(int(fd))
 
-		var oneSecInNsec int64 = 1e9
-		timeoutNsec := int64(timeout) * oneSecInNsec
-		nativeTimeVal := unix.NsecToTimeval(timeoutNsec)
+		nativeTimeVal := unix.NsecToTimeval(timeout.Nanoseconds())
 		tv := &nativeTimeVal
 
-		count, err = unix.Select(int(fd+1), fds, nil, nil, tv)
+		count, err := unix.Select(int(fd+1), fds, nil, efds, tv)
 
 		if count < 0 && err == unix.EINTR {
 			continue
 		}
-		return
+
+		if err != nil {
+			return false, false, syscallError("select", err)
+		}
+
+		return fds.IsSet(int(fd)), efds.IsSet(int(fd)), nil
 	}
 
 }
 
+func subscribeEvent(fd uintptr, eventType uint32, id uint32, flags uint32) (err error) {
+
+	sub := &v4l2_event_subscription{}
+	sub._type = eventType
+	sub.id = id
+	sub.flags = flags
+
+	err = doIoctl(fd, VIDIOC_SUBSCRIBE_EVENT, uintptr(unsafe.Pointer(sub)))
+	return
+
+}
+
+func unsubscribeEvent(fd uintptr, eventType uint32, id uint32) (err error) {
+
+	sub := &v4l2_event_subscription{}
+	sub._type = eventType
+	sub.id = id
+
+	err = doIoctl(fd, VIDIOC_UNSUBSCRIBE_EVENT, uintptr(unsafe.Pointer(sub)))
+	return
+
+}
+
+// Dequeue a pending event, fails with ENOENT if there is none
+func dequeueEvent(fd uintptr) (event v4l2_event, err error) {
+
+	err = doIoctl(fd, VIDIOC_DQEVENT, uintptr(unsafe.Pointer(&event)))
+	return
+
+}
+
 func getControl(fd uintptr, id uint32) (int32, error) {
 	ctrl := &v4l2_control{}
 	ctrl.id = id
-	err := ioctl.Ioctl(fd, VIDIOC_G_CTRL, uintptr(unsafe.Pointer(ctrl)))
+	err := doIoctl(fd, VIDIOC_G_CTRL, uintptr(unsafe.Pointer(ctrl)))
 	return ctrl.value, err
 }
 
@@ -474,7 +1142,7 @@ func setControl(fd uintptr, id uint32, val int32) error {
 	ctrl := &v4l2_control{}
 	ctrl.id = id
 	ctrl.value = val
-	return ioctl.Ioctl(fd, VIDIOC_S_CTRL, uintptr(unsafe.Pointer(ctrl)))
+	return doIoctl(fd, VIDIOC_S_CTRL, uintptr(unsafe.Pointer(ctrl)))
 }
 
 func queryControls(fd uintptr) []control {
@@ -483,36 +1151,159 @@ func queryControls(fd uintptr) []control {
 	// Don't use V42L_CID_BASE since it is the same as brightness.
 	var id uint32
 	for err == nil {
-		id |= V4L2_CTRL_FLAG_NEXT_CTRL
-		query := &v4l2_queryctrl{}
-		query.id = id
-		err = ioctl.Ioctl(fd, VIDIOC_QUERYCTRL, uintptr(unsafe.Pointer(query)))
-		id = query.id
+		var c control
+		c, err = queryControl(fd, id|V4L2_CTRL_FLAG_NEXT_CTRL|V4L2_CTRL_FLAG_NEXT_COMPOUND)
+		id = c.id
 		if err == nil {
-			if (query.flags & V4L2_CTRL_FLAG_DISABLED) != 0 {
+			// Class entries only name a group of controls
+			if (c.flags&V4L2_CTRL_FLAG_DISABLED) != 0 || c.c_type == V4L2_CTRL_TYPE_CTRL_CLASS {
 				continue
 			}
-			var c control
-			switch query._type {
-			default:
-				continue
-			case V4L2_CTRL_TYPE_INTEGER, V4L2_CTRL_TYPE_INTEGER64:
-				c.c_type = c_int
-			case V4L2_CTRL_TYPE_BOOLEAN:
-				c.c_type = c_bool
-			case V4L2_CTRL_TYPE_MENU:
-				c.c_type = c_menu
-			}
-			c.id = id
-			c.name = CToGoString(query.name[:])
-			c.min = query.minimum
-			c.max = query.maximum
 			controls = append(controls, c)
 		}
 	}
 	return controls
 }
 
+// Query a control descriptor, id may be combined with
+// V4L2_CTRL_FLAG_NEXT_CTRL to enumerate controls.
+// Falls back to VIDIOC_QUERYCTRL on kernels without VIDIOC_QUERY_EXT_CTRL
+func queryControl(fd uintptr, id uint32) (c control, err error) {
+
+	query := &v4l2_query_ext_ctrl{}
+	query.id = id
+
+	err = doIoctl(fd, VIDIOC_QUERY_EXT_CTRL, uintptr(unsafe.Pointer(query)))
+
+	if errors.Is(err, unix.ENOTTY) {
+		return queryControlLegacy(fd, id)
+	}
+
+	if err != nil {
+		return
+	}
+
+	c.id = query.id
+	c.name = CToGoString(query.name[:])
+	c.c_type = query._type
+	c.min = query.minimum
+	c.max = query.maximum
+	c.step = int64(query.step)
+	c.def = query.default_value
+	c.flags = query.flags
+	return
+}
+
+func queryControlLegacy(fd uintptr, id uint32) (c control, err error) {
+
+	query := &v4l2_queryctrl{}
+	query.id = id &^ V4L2_CTRL_FLAG_NEXT_COMPOUND
+
+	err = doIoctl(fd, VIDIOC_QUERYCTRL, uintptr(unsafe.Pointer(query)))
+
+	if err != nil {
+		return
+	}
+
+	c.id = query.id
+	c.name = CToGoString(query.name[:])
+	c.c_type = query._type
+	c.min = controlValue32(query._type, uint32(query.minimum))
+	c.max = controlValue32(query._type, uint32(query.maximum))
+	c.step = int64(query.step)
+	c.def = controlValue32(query._type, uint32(query.default_value))
+	c.flags = query.flags
+	return
+}
+
+// Extends a 32-bit control value to 64 bits. Bitmasks are unsigned,
+// values of other types signed
+func controlValue32(c_type uint32, value uint32) int64 {
+	if c_type == V4L2_CTRL_TYPE_BITMASK {
+		return int64(value)
+	}
+	return int64(int32(value))
+}
+
+// Returns name of a menu item, or its value for integer menus
+func queryMenu(fd uintptr, id uint32, index uint32) (name string, value int64, err error) {
+
+	query := &v4l2_querymenu{}
+	query.id = id
+	query.index = index
+
+	err = doIoctl(fd, VIDIOC_QUERYMENU, uintptr(unsafe.Pointer(query)))
+
+	if err != nil {
+		return
+	}
+
+	name = CToGoString(query.union[:])
+	value = int64(NativeByteOrder.Uint64(query.union[:8]))
+	return
+}
+
+func getExtControls(fd uintptr, controls []extControl) (errorIdx uint32, err error) {
+	return extControls(fd, VIDIOC_G_EXT_CTRLS, controls)
+}
+
+func setExtControls(fd uintptr, controls []extControl) (errorIdx uint32, err error) {
+	return extControls(fd, VIDIOC_S_EXT_CTRLS, controls)
+}
+
+func tryExtControls(fd uintptr, controls []extControl) (errorIdx uint32, err error) {
+	return extControls(fd, VIDIOC_TRY_EXT_CTRLS, controls)
+}
+
+// Issue an extended control ioctl, values of controls are updated with
+// values returned by the driver. On failure errorIdx is the index of
+// the failed control, or len(controls) if the driver can't tell
+func extControls(fd uintptr, request uintptr, controls []extControl) (errorIdx uint32, err error) {
+
+	if len(controls) == 0 {
+		return
+	}
+
+	ctrls := make([]v4l2_ext_control, len(controls))
+	for i, c := range controls {
+		ctrls[i].id = c.id
+		switch {
+		case c.payload != nil:
+			ptr := uintptr(unsafe.Pointer(&c.payload[0]))
+			ctrls[i].size = uint32(len(c.payload))
+			copy(ctrls[i].union[:], (*[unsafe.Sizeof(ptr)]uint8)(unsafe.Pointer(&ptr))[:])
+		case c.c_type == V4L2_CTRL_TYPE_INTEGER64:
+			NativeByteOrder.PutUint64(ctrls[i].union[:], uint64(c.value))
+		default:
+			NativeByteOrder.PutUint32(ctrls[i].union[:], uint32(int32(c.value)))
+		}
+	}
+
+	req := &v4l2_ext_controls{}
+	req.count = uint32(len(ctrls))
+	req.controls = uintptr(unsafe.Pointer(&ctrls[0]))
+
+	err = doIoctl(fd, request, uintptr(unsafe.Pointer(req)))
+	runtime.KeepAlive(ctrls)
+	runtime.KeepAlive(controls)
+
+	if err != nil {
+		errorIdx = req.error_idx
+		return
+	}
+
+	for i := range controls {
+		switch {
+		case controls[i].payload != nil:
+		case controls[i].c_type == V4L2_CTRL_TYPE_INTEGER64:
+			controls[i].value = int64(NativeByteOrder.Uint64(ctrls[i].union[:]))
+		default:
+			controls[i].value = controlValue32(controls[i].c_type, NativeByteOrder.Uint32(ctrls[i].union[:]))
+		}
+	}
+	return
+}
+
 func getNativeByteOrder() binary.ByteOrder {
 	var i int32 = 0x01020304
 	u := unsafe.Pointer(&i)
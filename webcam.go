@@ -2,32 +2,96 @@ package webcam
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
+// Time StopStreaming and Close wait for held frames to be released
+const defaultReleaseTimeout = 5 * time.Second
+
 // Camera object
+// Camera is safe for concurrent use, e.g. controls can be changed
+// while another goroutine captures frames
 type Camera struct {
-	fd        uintptr
-	card      string
-	bufcount  uint32
+	dev  device
+	card string
+
+	// Guards the state below. Waiting for frames and control ioctls run
+	// without holding it, so that they don't hold up each other
+	mutex sync.Mutex
+	// Signalled when a frame is released or an ioctl run without the mutex ends
+	cond *sync.Cond
+	// Number of ioctls running without the mutex, see enter
+	busy     int
+	closed   bool
+	stopping bool
+	// Longest time stopping waits for frames to be released
+	releaseTimeout time.Duration
+
+	bufcount uint32
+	// Buffer count set for the mmap method, restored when switching
+	// back from user or DMABUF buffers, which come with their own count
+	mmapCount uint32
 	buffers   [][]byte
+	planes    [][][]byte
+	memory    uint32
+	dmabufs   []int
+	readwrite bool
+	readSize  uint32
+	readSeq   uint32
+	// Frames handed out, by buffer index, until they are released
+	held      []*Frame
+	mplane    bool
 	streaming bool
+
+	// Controls subscribed to, see SubscribeControlEvents
+	ctrlSubs   map[uint32]struct{}
+	ctrlEvents chan ControlEvent
+
+	streamSubs    bool
+	streamEvents  chan StreamEvent
+	endOfStream   bool
+	sourceChanged bool
+	sourceChanges uint32
 }
 
 type ControlID uint32
 
+// Control descriptor
 type Control struct {
 	Name string
-	Min  int32
-	Max  int32
+	// Range of values, saturated to int32 for values that don't fit,
+	// like those of 64-bit and bitmask controls
+	Min int32
+	Max int32
+	// Range of values of controls of any type
+	Min64 int64
+	Max64 int64
+	// Control type, see V4L2_CTRL_TYPE_* constants
+	Type uint32
+	// Step between valid values
+	Step int64
+	// Default value
+	Default int64
+	// Control flags, see V4L2_CTRL_FLAG_* constants
+	Flags uint32
+	// Control class, see V4L2_CTRL_CLASS_* constants
+	Class uint32
+	// Items of menu and integer menu controls, skipped items are not listed
+	Menu []MenuItem
 }
 
 // Open a camera with a given path
 // Checks if device is a v4l2 device and if it is
-// capable to stream video
+// capable to stream video. Devices that do not support streaming
+// are read with the read() I/O method instead
 func Open(path string) (*Camera, error) {
 
 	handle, err := unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK, 0666)
@@ -37,27 +101,81 @@ func Open(path string) (*Camera, error) {
 		return nil, err
 	}
 
-	supportsVideoCapture, supportsVideoStreaming, card, err := checkCapabilities(fd)
+	w, err := newCamera(&v4l2Device{fd: fd})
+
+	if err != nil {
+		unix.Close(handle)
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Check capabilities of a device backend and wrap it into a Camera
+// Single-planar API is preferred when device supports both APIs
+func newCamera(dev device) (*Camera, error) {
+
+	capabilities, card, err := dev.checkCapabilities()
 
 	if err != nil {
 		return nil, err
 	}
 
-	if !supportsVideoCapture {
-		return nil, errors.New("Not a video capture device")
+	supportsVideoCapture := (capabilities & V4L2_CAP_VIDEO_CAPTURE) != 0
+	supportsVideoCaptureMplane := (capabilities & V4L2_CAP_VIDEO_CAPTURE_MPLANE) != 0
+	supportsVideoStreaming := (capabilities & V4L2_CAP_STREAMING) != 0
+	supportsReadWrite := (capabilities & V4L2_CAP_READWRITE) != 0
+
+	if !supportsVideoCapture && !supportsVideoCaptureMplane {
+		return nil, ErrNotCapture
+	}
+
+	mplane := !supportsVideoCapture
+
+	// read() I/O is not defined for the multiplanar API
+	if mplane && !supportsVideoStreaming {
+		return nil, errors.New("Multiplanar device does not support streaming")
 	}
 
-	if !supportsVideoStreaming {
-		return nil, errors.New("Device does not support the streaming I/O method")
+	if !supportsVideoStreaming && !supportsReadWrite {
+		return nil, errors.New("Device supports neither the streaming nor the read I/O method")
 	}
 
 	w := new(Camera)
-	w.fd = uintptr(fd)
+	w.cond = sync.NewCond(&w.mutex)
+	w.dev = dev
 	w.bufcount = 256
+	w.mmapCount = w.bufcount
+	w.releaseTimeout = defaultReleaseTimeout
+	w.memory = V4L2_MEMORY_MMAP
+	w.readwrite = !supportsVideoStreaming
+	w.mplane = mplane
 	w.card = card
+	w.ctrlSubs = make(map[uint32]struct{})
+	w.ctrlEvents = make(chan ControlEvent, controlEventBuffer)
+	w.streamEvents = make(chan StreamEvent, streamEventBuffer)
+
+	if mplane {
+		dev.setBufferType(V4L2_BUF_TYPE_VIDEO_CAPTURE_MPLANE)
+	} else {
+		dev.setBufferType(V4L2_BUF_TYPE_VIDEO_CAPTURE)
+	}
+
 	return w, nil
 }
 
+// Returns true if frames are captured with the read() I/O method,
+// because the device does not support streaming
+func (w *Camera) IsReadWrite() bool {
+	return w.readwrite
+}
+
+// Returns true if the device is driven through the multiplanar API,
+// frames of such devices may consist of several planes, see Frame.Planes
+func (w *Camera) IsMultiplanar() bool {
+	return w.mplane
+}
+
 // Get the card/name of the device
 func (w *Camera) Card() (string, error) {
 	if w.card != "" {
@@ -72,13 +190,19 @@ func (w *Camera) Card() (string, error) {
 func (w *Camera) GetSupportedFormats() map[PixelFormat]string {
 
 	result := make(map[PixelFormat]string)
+
+	if w.enter() != nil {
+		return result
+	}
+	defer w.leave()
+
 	var err error
 	var code uint32
 	var desc string
 	var index uint32
 
 	for index = 0; err == nil; index++ {
-		code, desc, err = getPixelFormat(w.fd, index)
+		code, desc, err = w.dev.getPixelFormat(index)
 
 		if err != nil {
 			break
@@ -94,11 +218,16 @@ func (w *Camera) GetSupportedFormats() map[PixelFormat]string {
 func (w *Camera) GetSupportedFrameSizes(f PixelFormat) []FrameSize {
 	result := make([]FrameSize, 0)
 
+	if w.enter() != nil {
+		return result
+	}
+	defer w.leave()
+
 	var index uint32
 	var err error
 
 	for index = 0; err == nil; index++ {
-		s, err := getFrameSize(w.fd, index, uint32(f))
+		s, err := w.dev.getFrameSize(index, uint32(f))
 
 		if err != nil {
 			break
@@ -110,74 +239,471 @@ func (w *Camera) GetSupportedFrameSizes(f PixelFormat) []FrameSize {
 	return result
 }
 
+// Returns supported frame intervals for a given image format and frame size
+func (w *Camera) GetSupportedFrameIntervals(f PixelFormat, width, height uint32) []FrameInterval {
+	result := make([]FrameInterval, 0)
+
+	if w.enter() != nil {
+		return result
+	}
+	defer w.leave()
+
+	var index uint32
+	var err error
+
+	for index = 0; err == nil; index++ {
+		i, err := w.dev.getFrameInterval(index, uint32(f), width, height)
+
+		if err != nil {
+			break
+		}
+
+		result = append(result, i)
+	}
+
+	return result
+}
+
+// Sets desired frame rate in frames per second
+// Note, that device driver can change that value.
+// Resulting frame rate is returned by a function
+// alongside with an error if any
+func (w *Camera) SetFrameRate(fps float32) (float32, error) {
+	if fps <= 0 {
+		return 0, errors.New("Frame rate must be positive")
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	parm, err := w.dev.getStreamParm()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if (parm.Capability & V4L2_CAP_TIMEPERFRAME) == 0 {
+		return 0, errors.New("Device does not support setting the frame rate")
+	}
+
+	// Express frame rate in thousandths to keep fractional rates like 29.97
+	parm.Timeperframe.Numerator = 1000
+	parm.Timeperframe.Denominator = uint32(fps*1000 + 0.5)
+
+	err = w.dev.setStreamParm(&parm)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return Fraction{parm.Timeperframe.Numerator, parm.Timeperframe.Denominator}.FPS(), nil
+}
+
+// Get current frame rate in frames per second
+func (w *Camera) GetFrameRate() (float32, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	parm, err := w.dev.getStreamParm()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return Fraction{parm.Timeperframe.Numerator, parm.Timeperframe.Denominator}.FPS(), nil
+}
+
 // Sets desired image format and frame size
 // Note, that device driver can change that values.
 // Resulting values are returned by a function
 // alongside with an error if any
 func (w *Camera) SetImageFormat(f PixelFormat, width, height uint32) (PixelFormat, uint32, uint32, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return 0, 0, 0, ErrClosed
+	}
 
-	code := uint32(f)
-	cw := width
-	ch := height
+	if w.mplane {
+		return w.setImageFormatMplane(f, width, height)
+	}
+
+	pix := v4l2_pix_format{
+		Width:       width,
+		Height:      height,
+		Pixelformat: uint32(f),
+		Field:       V4L2_FIELD_ANY,
+	}
 
-	err := setImageFormat(w.fd, &code, &width, &height)
+	err := w.dev.setImageFormat(&pix)
 
 	if err != nil {
 		return 0, 0, 0, err
-	} else {
-		return PixelFormat(code), cw, ch, nil
 	}
+
+	return PixelFormat(pix.Pixelformat), pix.Width, pix.Height, nil
+}
+
+func (w *Camera) setImageFormatMplane(f PixelFormat, width, height uint32) (PixelFormat, uint32, uint32, error) {
+	pix, err := w.dev.getImageFormatMplane()
+
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	pix.Pixelformat = uint32(f)
+	pix.Width = width
+	pix.Height = height
+	pix.Field = V4L2_FIELD_ANY
+	pix.Num_planes = 0
+
+	err = w.dev.setImageFormatMplane(&pix)
+
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return PixelFormat(pix.Pixelformat), pix.Width, pix.Height, nil
+}
+
+// Returns image format currently set on the device, including line and
+// frame sizes and colorimetry chosen by the driver
+func (w *Camera) GetImageFormat() (ImageFormat, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return ImageFormat{}, ErrClosed
+	}
+
+	if w.mplane {
+		pix, err := w.dev.getImageFormatMplane()
+
+		if err != nil {
+			return ImageFormat{}, err
+		}
+
+		return newImageFormatMplane(&pix), nil
+	}
+
+	pix, err := w.dev.getImageFormat()
+
+	if err != nil {
+		return ImageFormat{}, err
+	}
+
+	return newImageFormat(&pix), nil
 }
 
-// Set the number of frames to be buffered.
+// Returns the format the driver would choose if f was set, without
+// changing the state of the device. Zero fields are filled in by the driver,
+// so it is enough to set PixelFormat, Width and Height
+func (w *Camera) TryImageFormat(f ImageFormat) (ImageFormat, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return ImageFormat{}, ErrClosed
+	}
+
+	if w.mplane {
+		pix := f.pixMplane()
+		err := w.dev.tryImageFormatMplane(&pix)
+
+		if err != nil {
+			return ImageFormat{}, err
+		}
+
+		return newImageFormatMplane(&pix), nil
+	}
+
+	pix := f.pix()
+	err := w.dev.tryImageFormat(&pix)
+
+	if err != nil {
+		return ImageFormat{}, err
+	}
+
+	return newImageFormat(&pix), nil
+}
+
+// Returns image format currently set on the device
+func (w *Camera) imageFormat() (PixelFormat, uint32, uint32, error) {
+	if w.mplane {
+		pix, err := w.dev.getImageFormatMplane()
+		return PixelFormat(pix.Pixelformat), pix.Width, pix.Height, err
+	}
+
+	pix, err := w.dev.getImageFormat()
+	return PixelFormat(pix.Pixelformat), pix.Width, pix.Height, err
+}
+
+// Set the number of frames to be buffered by the mmap and read methods.
+// User and DMABUF buffers are counted by SetUserBuffers and SetDmabufBuffers,
+// the count set here applies once switched back to the mmap method.
 // Not allowed if streaming is already on.
 func (w *Camera) SetBufferCount(count uint32) error {
-	if w.streaming {
-		return errors.New("Cannot set buffer count when streaming")
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.streaming || w.stopping {
+		return fmt.Errorf("Cannot set buffer count: %w", ErrAlreadyStreaming)
+	}
+	w.mmapCount = count
+	if w.memory == V4L2_MEMORY_MMAP {
+		w.bufcount = count
+	}
+	return nil
+}
+
+// Switches back to buffers mapped from the driver
+func (w *Camera) useMmapBuffers() {
+	w.memory = V4L2_MEMORY_MMAP
+	w.buffers = nil
+	w.dmabufs = nil
+	w.bufcount = w.mmapCount
+}
+
+// Stream into buffers allocated by the caller (USERPTR I/O method)
+// instead of buffers mapped from the driver. Driver fills the buffers
+// directly, so frames returned by GetFrame alias them.
+// Buffers should be page aligned and large enough to hold a full frame.
+// Passing nil switches back to the mmap method.
+// Not allowed if streaming is already on.
+func (w *Camera) SetUserBuffers(buffers [][]byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.streaming || w.stopping {
+		return fmt.Errorf("Cannot set user buffers: %w", ErrAlreadyStreaming)
+	}
+	if w.readwrite {
+		return errors.New("Device supports only the read I/O method")
+	}
+	if w.mplane {
+		return errors.New("User buffers are not supported for multiplanar devices")
+	}
+	if buffers == nil {
+		w.useMmapBuffers()
+		return nil
+	}
+	if len(buffers) == 0 {
+		return errors.New("No user buffers given")
+	}
+	for _, buffer := range buffers {
+		if len(buffer) == 0 {
+			return errors.New("User buffer is empty")
+		}
+	}
+	w.memory = V4L2_MEMORY_USERPTR
+	w.buffers = buffers
+	w.dmabufs = nil
+	w.bufcount = uint32(len(buffers))
+	return nil
+}
+
+// Stream into DMABUF file descriptors supplied by the caller (DMABUF I/O method),
+// e.g. allocated by a GPU, encoder or udmabuf. Driver fills the buffers directly,
+// frames returned by GetFrame are read through a mapping of the DMABUF and
+// FrameFd returns the descriptor of a frame.
+// Descriptors stay owned by the caller. Passing nil switches back to the mmap method.
+// Not allowed if streaming is already on.
+func (w *Camera) SetDmabufBuffers(fds []int) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.streaming || w.stopping {
+		return fmt.Errorf("Cannot set DMABUF buffers: %w", ErrAlreadyStreaming)
+	}
+	if w.readwrite {
+		return errors.New("Device supports only the read I/O method")
+	}
+	if w.mplane {
+		return errors.New("DMABUF buffers are not supported for multiplanar devices")
+	}
+	if fds == nil {
+		w.useMmapBuffers()
+		return nil
+	}
+	if len(fds) == 0 {
+		return errors.New("No DMABUF buffers given")
+	}
+	for _, fd := range fds {
+		if fd < 0 {
+			return errors.New("Invalid DMABUF file descriptor")
+		}
 	}
-	w.bufcount = count
+	w.memory = V4L2_MEMORY_DMABUF
+	w.dmabufs = fds
+	w.buffers = nil
+	w.bufcount = uint32(len(fds))
 	return nil
 }
 
+// Export a driver buffer as a DMABUF file descriptor, so it can be handed
+// to other devices or processes without copying.
+// Only available for the mmap method while streaming.
+// Returned descriptor is owned by the caller and must be closed
+func (w *Camera) ExportBuffer(index uint32) (int, error) {
+	return w.ExportPlane(index, 0)
+}
+
+// Export a single plane of a driver buffer as a DMABUF file descriptor.
+// Plane 0 is the whole buffer for single-planar devices
+func (w *Camera) ExportPlane(index uint32, plane uint32) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.streaming {
+		return -1, fmt.Errorf("Cannot export buffer: %w", ErrNotStreaming)
+	}
+	if w.memory != V4L2_MEMORY_MMAP || w.readwrite {
+		return -1, errors.New("Only mmap buffers can be exported")
+	}
+	return w.dev.exportBuffer(index, plane)
+}
+
+// Returns DMABUF file descriptor of the frame buffer obtained via GetFrame.
+// Only available for the DMABUF method, see ExportBuffer for the mmap method
+func (w *Camera) FrameFd(index uint32) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.memory != V4L2_MEMORY_DMABUF {
+		return -1, errors.New("Not streaming DMABUF buffers")
+	}
+	if int(index) >= len(w.dmabufs) {
+		return -1, errors.New("Invalid buffer index")
+	}
+	return w.dmabufs[index], nil
+}
+
 // Get a map of available controls.
 func (w *Camera) GetControls() map[ControlID]Control {
 	cmap := make(map[ControlID]Control)
-	for _, c := range queryControls(w.fd) {
-		cmap[ControlID(c.id)] = Control{c.name, c.min, c.max}
+
+	if w.enter() != nil {
+		return cmap
+	}
+	defer w.leave()
+
+	for _, c := range w.dev.queryControls() {
+		cmap[ControlID(c.id)] = w.newControl(c)
 	}
 	return cmap
 }
 
 // Get the value of a control.
 func (w *Camera) GetControl(id ControlID) (int32, error) {
-	return getControl(w.fd, uint32(id))
+	if err := w.enter(); err != nil {
+		return 0, err
+	}
+	defer w.leave()
+
+	return w.dev.getControl(uint32(id))
 }
 
 // Set a control.
 func (w *Camera) SetControl(id ControlID, value int32) error {
-	return setControl(w.fd, uint32(id), value)
+	if err := w.enter(); err != nil {
+		return err
+	}
+	defer w.leave()
+
+	return w.dev.setControl(uint32(id), value)
 }
 
 // Start streaming process
 func (w *Camera) StartStreaming() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for w.stopping {
+		w.cond.Wait()
+	}
+
+	return w.startStreaming()
+}
+
+func (w *Camera) startStreaming() error {
 	if w.streaming {
-		return errors.New("Already streaming")
+		return ErrAlreadyStreaming
+	}
+	if w.closed {
+		return ErrClosed
+	}
+
+	if w.readwrite {
+		return w.startReading()
+	}
+
+	w.subscribeStreamEvents()
+	w.endOfStream = false
+
+	var err error
+
+	w.sourceChanged = false
+	w.sourceChanges = 0
+
+	switch {
+	case w.mplane:
+		err = w.startPlanarStreaming()
+	case w.memory == V4L2_MEMORY_USERPTR:
+		err = w.startUserStreaming()
+	case w.memory == V4L2_MEMORY_DMABUF:
+		err = w.startDmabufStreaming()
+	default:
+		err = w.startMmapStreaming()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// All buffers are owned by the driver from now on, guard them before
+	// the driver starts filling them, as poisoning would overwrite frames
+	for index := uint32(0); index < w.bufcount; index++ {
+		w.guardBuffer(index, false)
 	}
 
-	err := mmapRequestBuffers(w.fd, &w.bufcount)
+	err = w.dev.startStreaming()
 
 	if err != nil {
-		return errors.New("Failed to map request buffers: " + string(err.Error()))
+		for index := uint32(0); index < w.bufcount; index++ {
+			w.guardBuffer(index, true)
+		}
+		return fmt.Errorf("Failed to start streaming: %w", err)
+	}
+	w.held = make([]*Frame, w.bufcount, w.bufcount)
+	w.streaming = true
+
+	return nil
+}
+
+func (w *Camera) startMmapStreaming() error {
+	err := w.dev.requestBuffers(V4L2_MEMORY_MMAP, &w.bufcount)
+
+	if err != nil {
+		return fmt.Errorf("Failed to map request buffers: %w", err)
 	}
 
 	w.buffers = make([][]byte, w.bufcount, w.bufcount)
 	for index, _ := range w.buffers {
 		var length uint32
 
-		buffer, err := mmapQueryBuffer(w.fd, uint32(index), &length)
+		buffer, err := w.dev.queryBuffer(uint32(index), &length)
 
 		if err != nil {
-			return errors.New("Failed to map memory: " + string(err.Error()))
+			return fmt.Errorf("Failed to map memory: %w", err)
 		}
 
 		w.buffers[index] = buffer
@@ -185,33 +711,230 @@ func (w *Camera) StartStreaming() error {
 
 	for index, _ := range w.buffers {
 
-		err := mmapEnqueueBuffer(w.fd, uint32(index))
+		err := w.dev.enqueueBuffer(uint32(index))
+
+		if err != nil {
+			return fmt.Errorf("Failed to enqueue buffer: %w", err)
+		}
+
+	}
+
+	return nil
+}
+
+func (w *Camera) startPlanarStreaming() error {
+	err := w.dev.requestBuffers(V4L2_MEMORY_MMAP, &w.bufcount)
+
+	if err != nil {
+		return fmt.Errorf("Failed to map request buffers: %w", err)
+	}
+
+	w.planes = make([][][]byte, w.bufcount, w.bufcount)
+	for index, _ := range w.planes {
+
+		planes, err := w.dev.queryPlanes(uint32(index))
+
+		if err != nil {
+			return fmt.Errorf("Failed to map memory: %w", err)
+		}
+
+		w.planes[index] = planes
+	}
+
+	for index, planes := range w.planes {
+
+		err := w.dev.enqueuePlanes(uint32(index), uint32(len(planes)))
 
 		if err != nil {
-			return errors.New("Failed to enqueue buffer: " + string(err.Error()))
+			return fmt.Errorf("Failed to enqueue buffer: %w", err)
 		}
 
 	}
 
-	err = startStreaming(w.fd)
+	return nil
+}
+
+func (w *Camera) startUserStreaming() error {
+	err := w.checkBufferSizes(w.buffers)
 
 	if err != nil {
-		return errors.New("Failed to start streaming: " + string(err.Error()))
+		return err
 	}
+
+	count := uint32(len(w.buffers))
+	err = w.dev.requestBuffers(V4L2_MEMORY_USERPTR, &count)
+
+	if err != nil {
+		return fmt.Errorf("Failed to request user buffers: %w", err)
+	}
+
+	// Driver may support less buffers than requested, the rest stays unused
+	if count < uint32(len(w.buffers)) {
+		w.bufcount = count
+	}
+
+	for index := uint32(0); index < w.bufcount; index++ {
+
+		err := w.dev.enqueueUserBuffer(index, w.buffers[index])
+
+		if err != nil {
+			return fmt.Errorf("Failed to enqueue buffer: %w", err)
+		}
+
+	}
+
+	return nil
+}
+
+func (w *Camera) startDmabufStreaming() error {
+	count := uint32(len(w.dmabufs))
+	err := w.dev.requestBuffers(V4L2_MEMORY_DMABUF, &count)
+
+	if err != nil {
+		return fmt.Errorf("Failed to request DMABUF buffers: %w", err)
+	}
+
+	if count < uint32(len(w.dmabufs)) {
+		w.bufcount = count
+	}
+
+	w.buffers = make([][]byte, w.bufcount, w.bufcount)
+	for index, _ := range w.buffers {
+
+		buffer, err := w.dev.mapDmabuf(w.dmabufs[index])
+
+		if err != nil {
+			return fmt.Errorf("Failed to map DMABUF: %w", err)
+		}
+
+		w.buffers[index] = buffer
+	}
+
+	err = w.checkBufferSizes(w.buffers)
+
+	if err != nil {
+		for _, buffer := range w.buffers {
+			w.dev.releaseBuffer(buffer)
+		}
+		w.buffers = nil
+		return err
+	}
+
+	for index, buffer := range w.buffers {
+
+		err := w.dev.enqueueDmabuf(uint32(index), w.dmabufs[index], uint32(len(buffer)))
+
+		if err != nil {
+			return fmt.Errorf("Failed to enqueue buffer: %w", err)
+		}
+
+	}
+
+	return nil
+}
+
+// Check that buffers supplied by the caller hold a frame of the current
+// format, which changes when the source does. Drivers may accept short
+// buffers and fail only once they fill them
+func (w *Camera) checkBufferSizes(buffers [][]byte) error {
+	pix, err := w.dev.getImageFormat()
+
+	if err != nil {
+		return fmt.Errorf("Failed to get image format: %w", err)
+	}
+
+	for index, buffer := range buffers {
+		if uint32(len(buffer)) < pix.Sizeimage {
+			return fmt.Errorf("Buffer %d holds %d bytes, frames need %d: %w", index, len(buffer), pix.Sizeimage, ErrBufferTooSmall)
+		}
+	}
+
+	return nil
+}
+
+// Devices without streaming support start capturing on first read,
+// so only a pool of frame buffers is set up here
+func (w *Camera) startReading() error {
+	pix, err := w.dev.getImageFormat()
+
+	if err != nil {
+		return fmt.Errorf("Failed to get image format: %w", err)
+	}
+
+	if pix.Sizeimage == 0 {
+		return errors.New("Device reported empty image size")
+	}
+
+	// Buffers are allocated on demand, as frames are held by the caller
+	w.buffers = make([][]byte, w.bufcount, w.bufcount)
+	w.held = make([]*Frame, w.bufcount, w.bufcount)
+	w.readSeq = 0
+	w.readSize = pix.Sizeimage
 	w.streaming = true
 
 	return nil
 }
 
+// Read a frame with the read() I/O method into a free buffer of the pool
+// There is no metadata with this method, frames are timestamped and
+// numbered on arrival. Frames that have outgrown the buffers, e.g. after
+// a source change, fail with ErrBufferTooSmall until streaming is restarted
+func (w *Camera) getReadFrame() (*Frame, error) {
+	for index, held := range w.held {
+		if held != nil {
+			continue
+		}
+
+		if w.buffers[index] == nil {
+			w.buffers[index] = make([]byte, w.readSize)
+		}
+
+		length, err := w.dev.read(w.buffers[index])
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Only a full buffer may hold a truncated frame
+		if length == len(w.buffers[index]) {
+			pix, err := w.dev.getImageFormat()
+
+			if err == nil && pix.Sizeimage > uint32(length) {
+				return nil, fmt.Errorf("Frame of %d bytes was read into a buffer of %d: %w", pix.Sizeimage, length, ErrBufferTooSmall)
+			}
+		}
+
+		var ts unix.Timespec
+		unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+
+		w.readSeq++
+		return &Frame{
+			Index:     uint32(index),
+			Sequence:  w.readSeq - 1,
+			Timestamp: time.Duration(ts.Nano()),
+			Flags:     V4L2_BUF_FLAG_TIMESTAMP_MONOTONIC,
+			Field:     V4L2_FIELD_NONE,
+			data:      w.buffers[index][:length],
+		}, nil
+	}
+
+	return nil, errors.New("All frame buffers are held, release a frame first")
+}
+
 // Read a single frame from the Camera
 // If frame cannot be read at the moment
 // function will return empty slice
+// Buffer is released right away, so the data is a copy
 func (w *Camera) ReadFrame() ([]byte, error) {
-	result, index, err := w.GetFrame()
-	if err == nil {
-		w.ReleaseFrame(index)
+	frame, err := w.GetFrameWithMetadata()
+
+	if err != nil {
+		return nil, err
 	}
-	return result, err
+
+	result := append([]byte(nil), frame.Bytes()...)
+	frame.Release()
+	return result, nil
 }
 
 // Get a single frame from the Camera and return the frame and
@@ -219,60 +942,445 @@ func (w *Camera) ReadFrame() ([]byte, error) {
 // If frame cannot be read at the moment
 // function will return empty slice
 func (w *Camera) GetFrame() ([]byte, uint32, error) {
-	var index uint32
-	var length uint32
-
-	err := mmapDequeueBuffer(w.fd, &index, &length)
+	frame, err := w.GetFrameWithMetadata()
 
 	if err != nil {
 		return nil, 0, err
 	}
 
-	return w.buffers[int(index)][:length], index, nil
+	return frame.Bytes(), frame.Index, nil
+
+}
+
+// Get a single frame from the Camera alongside with its timestamp,
+// sequence number, field and flags reported by the driver.
+// To return the buffer, ReleaseFrame must be called with frame Index.
+func (w *Camera) GetFrameWithMetadata() (*Frame, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.streaming {
+		return nil, fmt.Errorf("Request to read frame: %w", ErrNotStreaming)
+	}
+
+	var frame *Frame
+	var err error
+
+	switch {
+	case w.readwrite:
+		frame, err = w.getReadFrame()
+	case w.mplane:
+		frame, err = w.getPlanarFrame()
+	default:
+		frame, err = w.getBufferFrame()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	frame.owner = w
+	w.held[frame.Index] = frame
+	w.guardBuffer(frame.Index, true)
+	return frame, nil
+
+}
+
+// Dequeue a buffer of a single-planar device
+func (w *Camera) getBufferFrame() (*Frame, error) {
+	buffer, err := w.dev.dequeueBuffer(w.memory)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newFrame(&buffer, w.buffers[int(buffer.index)][:buffer.bytesused]), nil
+}
+
+// Dequeue a buffer of a multiplanar device. Data of a frame is the first plane,
+// all planes are available through Frame.Planes
+func (w *Camera) getPlanarFrame() (*Frame, error) {
+	buffer, planes, err := w.dev.dequeuePlanes(V4L2_MEMORY_MMAP)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mappings := w.planes[int(buffer.index)]
+	data := make([][]byte, len(planes))
+	for p, plane := range planes {
+		if p >= len(mappings) || plane.bytesused > uint32(len(mappings[p])) || plane.data_offset > plane.bytesused {
+			w.dev.enqueuePlanes(buffer.index, uint32(len(mappings)))
+			return nil, errors.New("Driver returned invalid plane")
+		}
+		data[p] = mappings[p][plane.data_offset:plane.bytesused]
+	}
 
+	frame := newFrame(&buffer, nil)
+	frame.planes = data
+	if len(data) > 0 {
+		frame.data = data[0]
+	}
+	return frame, nil
 }
 
-// Release the frame buffer that was obtained via GetFrame
+// Release the frame buffer that was obtained via GetFrame,
+// same as Release of the frame. Releasing a buffer that is not held fails
 func (w *Camera) ReleaseFrame(index uint32) error {
-	return mmapEnqueueBuffer(w.fd, index)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if int(index) >= len(w.held) || w.held[index] == nil {
+		return errors.New("Invalid buffer index")
+	}
+
+	return w.releaseFrame(w.held[index])
+}
+
+// Release a frame on behalf of Frame.Release
+func (w *Camera) release(f *Frame) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// Buffer is either free or held by a frame dequeued later
+	if int(f.Index) >= len(w.held) || w.held[f.Index] != f {
+		return ErrFrameReleased
+	}
+
+	return w.releaseFrame(f)
+}
+
+func (w *Camera) releaseFrame(f *Frame) error {
+	index := f.Index
+	w.held[index] = nil
+	atomic.StoreInt32(&f.released, 1)
+	w.guardBuffer(index, false)
+	w.cond.Broadcast()
+
+	// Buffers of frames held when the camera was abandoned are unmapped last
+	if w.closed && !w.streaming && !w.stopping && !w.readwrite {
+		return w.releaseMapping(index)
+	}
+
+	// Buffers released while stopping are queued again,
+	// as streaming goes on if stopping times out
+	if w.readwrite || (!w.streaming && !w.stopping) {
+		return nil
+	}
+
+	var err error
+
+	switch {
+	case w.mplane:
+		err = w.dev.enqueuePlanes(index, uint32(len(w.planes[index])))
+	case w.memory == V4L2_MEMORY_USERPTR:
+		err = w.dev.enqueueUserBuffer(index, w.buffers[index])
+	case w.memory == V4L2_MEMORY_DMABUF:
+		err = w.dev.enqueueDmabuf(index, w.dmabufs[index], uint32(len(w.buffers[index])))
+	default:
+		err = w.dev.enqueueBuffer(index)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Restart after a source change waits for the last frame to be released
+	return w.restartOnSourceChange()
+}
+
+// Returns number of frames not released yet
+func (w *Camera) heldFrames() int {
+	count := 0
+	for _, held := range w.held {
+		if held != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// Protect a buffer from access while it is owned by the driver, so that
+// frames used after release are detected. Only in debug builds, see frame_debug.go
+func (w *Camera) guardBuffer(index uint32, accessible bool) {
+	if !debugFrames {
+		return
+	}
+
+	switch {
+	case w.mplane:
+		for _, plane := range w.planes[index] {
+			protectBuffer(plane, accessible)
+		}
+	case w.readwrite || w.memory == V4L2_MEMORY_USERPTR:
+		// Memory is not mapped by Camera, so it can only be poisoned
+		if !accessible && w.buffers[index] != nil {
+			poisonBuffer(w.buffers[index])
+		}
+	default:
+		protectBuffer(w.buffers[index], accessible)
+	}
+}
+
+// Mark the device as used by an ioctl that runs without holding the mutex,
+// Close waits for it to finish. Fails once the camera is closed
+func (w *Camera) enter() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	w.busy++
+	return nil
+}
+
+func (w *Camera) leave() {
+	w.mutex.Lock()
+	w.busy--
+	w.cond.Broadcast()
+	w.mutex.Unlock()
 }
 
 // Wait until frame could be read
+// Pending events are dispatched while waiting, see SubscribeControlEvents
+// and StreamEvents. Returns io.EOF once the last frame of a stream
+// has been dequeued
 func (w *Camera) WaitForFrame(timeout uint32) error {
 
-	count, err := waitForFrame(w.fd, timeout)
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
 
-	if count < 0 || err != nil {
-		return err
-	} else if count == 0 {
-		return new(Timeout)
-	} else {
-		return nil
+	for {
+		w.mutex.Lock()
+		err := w.restartOnSourceChange()
+		streaming := w.streaming
+		endOfStream := w.endOfStream
+		w.mutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		if !streaming {
+			return fmt.Errorf("Request to wait for frame: %w", ErrNotStreaming)
+		}
+
+		// After the end of stream only frames already captured are waited for
+		left := time.Until(deadline)
+		if left < 0 || endOfStream {
+			left = 0
+		}
+
+		if err = w.enter(); err != nil {
+			return err
+		}
+
+		frame, event, err := w.dev.waitForFrame(left)
+
+		w.leave()
+
+		if err != nil {
+			return err
+		}
+
+		if event {
+			w.mutex.Lock()
+			err = w.dispatchEvents()
+			endOfStream = w.endOfStream
+			w.mutex.Unlock()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if frame {
+			return nil
+		} else if endOfStream {
+			return io.EOF
+		} else if !event || left == 0 {
+			return new(Timeout)
+		}
 	}
 }
 
+// Stop streaming. Waits until all frames obtained via GetFrame are
+// released, so that buffers are not unmapped under them. If frames are
+// not released within 5 seconds, e.g. because the calling goroutine holds
+// one of them, fails with ErrFramesHeld and streaming goes on
 func (w *Camera) StopStreaming() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for w.stopping {
+		w.cond.Wait()
+	}
+
+	return w.stopStreaming()
+}
+
+func (w *Camera) stopStreaming() error {
 	if !w.streaming {
-		return errors.New("Request to stop streaming when not streaming")
+		return fmt.Errorf("Request to stop streaming: %w", ErrNotStreaming)
 	}
 	w.streaming = false
-	for _, buffer := range w.buffers {
-		err := mmapReleaseBuffer(buffer)
-		if err != nil {
-			return err
+
+	err := w.waitForRelease()
+
+	if err != nil {
+		w.streaming = true
+		return fmt.Errorf("Request to stop streaming: %w", err)
+	}
+
+	return w.releaseBuffers()
+}
+
+// Unmap buffers and stop the driver streaming. Buffers of frames still
+// held are left mapped, they are unmapped when the frames are released
+func (w *Camera) releaseBuffers() error {
+	// There is no way to stop capturing with the read I/O method,
+	// driver stops when the device is closed
+	if w.readwrite {
+		w.buffers = nil
+		w.held = nil
+		return nil
+	}
+
+	count := len(w.buffers)
+	if w.mplane {
+		count = len(w.planes)
+	}
+
+	var err error
+
+	for index := 0; index < count; index++ {
+		if index < len(w.held) && w.held[index] != nil {
+			continue
+		}
+		if e := w.releaseMapping(uint32(index)); err == nil {
+			err = e
+		}
+	}
+
+	// User buffers are owned by the caller and are left untouched
+	if w.heldFrames() == 0 {
+		w.held = nil
+		w.planes = nil
+		if w.memory != V4L2_MEMORY_USERPTR {
+			w.buffers = nil
+		}
+	}
+
+	if e := w.dev.stopStreaming(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// Unmap memory of a buffer, unless it is a user buffer
+func (w *Camera) releaseMapping(index uint32) error {
+	switch {
+	case w.mplane:
+		for _, plane := range w.planes[index] {
+			err := w.dev.releaseBuffer(plane)
+			if err != nil {
+				return err
+			}
 		}
+	case w.memory == V4L2_MEMORY_MMAP, w.memory == V4L2_MEMORY_DMABUF:
+		if w.buffers[index] != nil {
+			return w.dev.releaseBuffer(w.buffers[index])
+		}
+	}
+	return nil
+}
+
+// Wait until all frames are released, at most releaseTimeout
+func (w *Camera) waitForRelease() error {
+	if w.heldFrames() == 0 {
+		return nil
 	}
 
-	return stopStreaming(w.fd)
+	w.stopping = true
+	defer func() {
+		w.stopping = false
+		w.cond.Broadcast()
+	}()
+
+	expired := false
+	timer := time.AfterFunc(w.releaseTimeout, func() {
+		w.mutex.Lock()
+		expired = true
+		w.cond.Broadcast()
+		w.mutex.Unlock()
+	})
+	defer timer.Stop()
+
+	for w.heldFrames() > 0 {
+		if expired {
+			return ErrFramesHeld
+		}
+		w.cond.Wait()
+	}
+
+	return nil
 }
 
-// Close the device
+// Close the device. Like StopStreaming, waits until all frames are
+// released, and also for calls running in other goroutines to return.
+// The device is closed even if frames are not released in time, like
+// StopStreaming would fail, or if stopping streaming fails. Frames still
+// held stay readable until they are released, and ErrFramesHeld is returned
 func (w *Camera) Close() error {
+	return w.close(true)
+}
+
+// Close the device without waiting for frames to be released, when it is
+// gone or its owner stops watching it. Frames held stay readable, their
+// buffers are unmapped when they are released
+func (w *Camera) abandon() error {
+	return w.close(false)
+}
+
+// Close the device, waiting at most releaseTimeout for frames to be
+// released if wait is set. Frames still held afterwards are abandoned
+func (w *Camera) close(wait bool) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+
+	for w.stopping {
+		w.cond.Wait()
+	}
+
+	var err error
+
 	if w.streaming {
-		w.StopStreaming()
+		w.streaming = false
+
+		if wait {
+			if e := w.waitForRelease(); e != nil {
+				err = fmt.Errorf("Device closed with frames still held: %w", e)
+			}
+		}
+
+		if e := w.releaseBuffers(); err == nil {
+			err = e
+		}
 	}
 
-	err := unix.Close(int(w.fd))
+	for w.busy > 0 {
+		w.cond.Wait()
+	}
+
+	if e := w.dev.close(); err == nil {
+		err = e
+	}
 
 	return err
 }
@@ -283,7 +1391,7 @@ func (w *Camera) SetAutoWhiteBalance(val bool) error {
 	if val {
 		v = 1
 	}
-	return setControl(w.fd, V4L2_CID_AUTO_WHITE_BALANCE, v)
+	return w.SetControl(ControlID(V4L2_CID_AUTO_WHITE_BALANCE), v)
 }
 
 func gobytes(p unsafe.Pointer, n int) []byte {